@@ -0,0 +1,81 @@
+package audit
+
+import (
+	"log"
+	"net/http"
+	"rbi/auth"
+	"rbi/config"
+	"rbi/models"
+	"rbi/sqlite"
+)
+
+var Db = sqlite.Db
+
+// Init 为升级前的事件补上哈希链，并按配置启动 syslog 转发
+func Init() {
+	if err := backfill(); err != nil {
+		log.Printf("Failed to hash existing audit events: %v", err)
+	}
+	startSyslog(config.Config.Audit.Syslog)
+}
+
+// Write 写入一条审计事件并接到哈希链末尾，失败只记录日志，不影响业务
+func Write(e models.AuditEvent) {
+	if e.Outcome == "" {
+		e.Outcome = models.AuditSuccess
+	}
+	chain.Lock()
+	err := appendEvent(&e)
+	chain.Unlock()
+	if err != nil {
+		log.Printf("Failed to save audit event %s/%s: %v", e.Category, e.Action, err)
+		return
+	}
+	forward(&e)
+}
+
+// Record 记录当前请求用户的操作
+func Record(r *http.Request, category, action, target, outcome, detail string) {
+	e := models.AuditEvent{Category: category, Action: action, IP: auth.ClientIP(r), Target: target, Outcome: outcome, Detail: detail}
+	if id := auth.Current(r); id != nil {
+		e.ActorID, e.Actor, e.TenantID = id.UserID, id.Username, id.TenantID
+	}
+	Write(e)
+}
+
+// RecordAs 记录未登录请求的操作，如登录，操作者按用户 ID 补全租户
+func RecordAs(r *http.Request, userID uint, username, category, action, target, outcome, detail string) {
+	e := models.AuditEvent{Category: category, Action: action, ActorID: userID, Actor: username,
+		IP: auth.ClientIP(r), Target: target, Outcome: outcome, Detail: detail}
+	if id := auth.Current(r); id != nil {
+		e.ActorID, e.Actor, e.TenantID = id.UserID, id.Username, id.TenantID
+	} else if userID != 0 {
+		var user models.User
+		if Db.Select("tenant_id").First(&user, userID).Error == nil {
+			e.TenantID = user.TenantID
+		}
+	}
+	Write(e)
+}
+
+// Session 记录会话内发生的事件，操作者和租户取会话所有者
+func Session(containerID, category, action, outcome, detail string) {
+	e := models.AuditEvent{Category: category, Action: action, Target: containerID, Outcome: outcome, Detail: detail}
+	var c models.ContainerInfo
+	if Db.Where("container_id = ?", containerID).First(&c).Error == nil {
+		e.ActorID, e.TenantID = uint(c.UserID), c.TenantID
+		var user models.User
+		if Db.Select("username").First(&user, c.UserID).Error == nil {
+			e.Actor = user.Username
+		}
+	}
+	Write(e)
+}
+
+// Outcome 按错误返回结果
+func Outcome(err error) string {
+	if err != nil {
+		return models.AuditFailure
+	}
+	return models.AuditSuccess
+}
@@ -0,0 +1,163 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gorm.io/gorm"
+	"log"
+	"rbi/models"
+	"sync"
+	"time"
+)
+
+// 校验报告中最多列出的断点数
+const maxBreaks = 1000
+
+// chain 最后一条事件的哈希，写入时持锁保证链的顺序
+var chain struct {
+	sync.Mutex
+	head   string
+	loaded bool
+}
+
+// hashed 参与哈希的字段，顺序固定
+type hashed struct {
+	Time     string `json:"time"`
+	Category string `json:"category"`
+	Action   string `json:"action"`
+	ActorID  uint   `json:"actorId"`
+	Actor    string `json:"actor"`
+	TenantID uint   `json:"tenantId"`
+	IP       string `json:"ip"`
+	Target   string `json:"target"`
+	Outcome  string `json:"outcome"`
+	Detail   string `json:"detail"`
+}
+
+// ComputeHash sha256(PrevHash + "\n" + 事件内容的 JSON)
+func ComputeHash(e *models.AuditEvent) string {
+	body, _ := json.Marshal(hashed{
+		Time:     e.CreatedAt.UTC().Format(time.RFC3339Nano),
+		Category: e.Category,
+		Action:   e.Action,
+		ActorID:  e.ActorID,
+		Actor:    e.Actor,
+		TenantID: e.TenantID,
+		IP:       e.IP,
+		Target:   e.Target,
+		Outcome:  e.Outcome,
+		Detail:   e.Detail,
+	})
+	sum := sha256.Sum256(append([]byte(e.PrevHash+"\n"), body...))
+	return hex.EncodeToString(sum[:])
+}
+
+// appendEvent 接在链尾写入，调用方持有 chain 锁
+func appendEvent(e *models.AuditEvent) error {
+	if !chain.loaded {
+		var last models.AuditEvent
+		err := Db.Select("hash").Order("id desc").Limit(1).Find(&last).Error
+		if err != nil {
+			return err
+		}
+		chain.head, chain.loaded = last.Hash, true
+	}
+	// 数据库中的时间精度为微秒
+	e.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	e.PrevHash = chain.head
+	e.Hash = ComputeHash(e)
+	if err := Db.Create(e).Error; err != nil {
+		return err
+	}
+	chain.head = e.Hash
+	return nil
+}
+
+// backfill 启用哈希链之前写入的事件按 ID 顺序补上哈希，已有哈希链时不处理
+func backfill() error {
+	var hashedCount int64
+	if err := Db.Model(&models.AuditEvent{}).Where("hash <> ''").Count(&hashedCount).Error; err != nil || hashedCount > 0 {
+		return err
+	}
+	chain.Lock()
+	defer chain.Unlock()
+	prev := ""
+	var batch []models.AuditEvent
+	err := Db.Where("hash = ''").FindInBatches(&batch, exportBatch, func(tx *gorm.DB, _ int) error {
+		for i := range batch {
+			e := &batch[i]
+			e.CreatedAt = e.CreatedAt.UTC().Truncate(time.Microsecond)
+			e.PrevHash = prev
+			e.Hash = ComputeHash(e)
+			// 只追加的约束由 BeforeUpdate 钩子保证，补哈希时跳过
+			err := Db.Session(&gorm.Session{SkipHooks: true}).Model(e).
+				UpdateColumns(map[string]interface{}{"created_at": e.CreatedAt, "prev_hash": e.PrevHash, "hash": e.Hash}).Error
+			if err != nil {
+				return err
+			}
+			prev = e.Hash
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return err
+	}
+	if prev != "" {
+		log.Printf("Audit: hashed existing events, chain head %s", prev)
+	}
+	chain.loaded = false
+	return nil
+}
+
+// Break 哈希链中的一处断点
+type Break struct {
+	ID     int64  `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// Report 哈希链校验结果，Head 可定期抄送到外部以发现链尾被截断
+type Report struct {
+	OK      bool    `json:"ok"`
+	Checked int64   `json:"checked"`
+	HeadID  int64   `json:"headId"`
+	Head    string  `json:"head"`
+	Breaks  []Break `json:"breaks"`
+}
+
+// Verify 按 ID 顺序遍历全部事件，检查每条的 PrevHash 和重新计算的 Hash
+func Verify() (*Report, error) {
+	report := &Report{Breaks: []Break{}}
+	prev := ""
+	add := func(id int64, reason string) {
+		if len(report.Breaks) < maxBreaks {
+			report.Breaks = append(report.Breaks, Break{ID: id, Reason: reason})
+		}
+	}
+	var batch []models.AuditEvent
+	err := Db.FindInBatches(&batch, exportBatch, func(tx *gorm.DB, _ int) error {
+		for i := range batch {
+			e := &batch[i]
+			report.Checked++
+			switch {
+			case e.Hash == "":
+				add(e.ID, "missing hash")
+			case e.PrevHash != prev:
+				add(e.ID, fmt.Sprintf("prevHash %.12s does not match previous hash %.12s, events removed or reordered", e.PrevHash, prev))
+			}
+			if e.Hash != "" && ComputeHash(e) != e.Hash {
+				add(e.ID, "content does not match hash, event modified")
+			}
+			// 从存储的哈希继续，一处篡改只报告一次
+			prev = e.Hash
+			report.HeadID, report.Head = e.ID, e.Hash
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	report.OK = len(report.Breaks) == 0
+	return report, nil
+}
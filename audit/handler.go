@@ -0,0 +1,195 @@
+package audit
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"net/http"
+	"rbi/auth"
+	"rbi/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func RegisterRoutes(router *mux.Router) {
+	router.Handle("/audit/events", auth.Require(models.PermAuditView, listEvents)).Methods(http.MethodGet)
+	router.Handle("/audit/export", auth.Require(models.PermAuditView, exportEvents)).Methods(http.MethodGet)
+	router.Handle("/audit/verify", auth.RequireAdmin(verifyChain)).Methods(http.MethodGet)
+}
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+	exportBatch     = 1000
+)
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// parseTime 支持 RFC3339 和 2006-01-02
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, time.Local)
+}
+
+// filter 按查询参数过滤，非全局管理员只能看到本租户的事件
+func filter(r *http.Request) (*gorm.DB, error) {
+	q := r.URL.Query()
+	id := auth.Current(r)
+	query := Db.Model(&models.AuditEvent{}).Scopes(id.Scope)
+	for _, field := range []string{"category", "action", "actor", "target", "outcome", "ip"} {
+		if v := q.Get(field); v != "" {
+			query = query.Where(field+" = ?", v)
+		}
+	}
+	if v := q.Get("actorId"); v != "" {
+		query = query.Where("actor_id = ?", v)
+	}
+	if v := q.Get("tenantId"); v != "" && id.IsAdmin {
+		query = query.Where("tenant_id = ?", v)
+	}
+	if v := q.Get("from"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid from: %s", v)
+		}
+		query = query.Where("created_at >= ?", t)
+	}
+	if v := q.Get("to"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid to: %s", v)
+		}
+		// 只有日期时包含当天
+		if len(v) == len("2006-01-02") {
+			t = t.AddDate(0, 0, 1)
+		}
+		query = query.Where("created_at < ?", t)
+	}
+	if v := q.Get("q"); v != "" {
+		query = query.Where("detail LIKE ?", "%"+v+"%")
+	}
+	// 计数和分页查询复用同一组条件
+	return query.Session(&gorm.Session{}), nil
+}
+
+// listEvents 分页查询，按时间倒序
+func listEvents(w http.ResponseWriter, r *http.Request) {
+	query, err := filter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page <= 0 {
+		page = 1
+	}
+	size, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	if size <= 0 || size > maxPageSize {
+		size = defaultPageSize
+	}
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	events := []models.AuditEvent{}
+	if err := query.Order("id desc").Offset((page - 1) * size).Limit(size).Find(&events).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"items":    events,
+		"total":    total,
+		"page":     page,
+		"pageSize": size,
+	})
+}
+
+var csvHeader = []string{"id", "time", "category", "action", "actor_id", "actor", "tenant_id", "ip", "target", "outcome", "detail", "prev_hash", "hash"}
+
+func csvRecord(e *models.AuditEvent) []string {
+	record := []string{
+		strconv.FormatInt(e.ID, 10), e.CreatedAt.Format(time.RFC3339), e.Category, e.Action,
+		strconv.FormatUint(uint64(e.ActorID), 10), e.Actor, strconv.FormatUint(uint64(e.TenantID), 10),
+		e.IP, e.Target, e.Outcome, e.Detail, e.PrevHash, e.Hash,
+	}
+	for i, cell := range record {
+		record[i] = csvCell(cell)
+	}
+	return record
+}
+
+// csvCell 用户可控的内容可能被表格软件当作公式执行，以公式字符开头时加单引号
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// exportEvents 按过滤条件导出，format 为 csv 或 jsonl，按时间正序分批写出
+func exportEvents(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "jsonl" {
+		http.Error(w, "format must be csv or jsonl", http.StatusBadRequest)
+		return
+	}
+	query, err := filter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := "audit-" + time.Now().Format("20060102-150405") + "." + format
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	var write func(e *models.AuditEvent) error
+	var flush func() error
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		cw.Write(csvHeader)
+		write = func(e *models.AuditEvent) error { return cw.Write(csvRecord(e)) }
+		flush = func() error { cw.Flush(); return cw.Error() }
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		write = func(e *models.AuditEvent) error { return enc.Encode(e) }
+		flush = func() error { return nil }
+	}
+
+	var batch []models.AuditEvent
+	err = query.FindInBatches(&batch, exportBatch, func(tx *gorm.DB, _ int) error {
+		for i := range batch {
+			if err := write(&batch[i]); err != nil {
+				return err
+			}
+		}
+		return flush()
+	}).Error
+	if err != nil {
+		// 响应头已发出，只能中断输出
+		fmt.Fprintf(w, "\nexport aborted: %v\n", err)
+	}
+}
+
+// verifyChain 校验整条哈希链，链跨所有租户，只有全局管理员可以调用
+func verifyChain(w http.ResponseWriter, r *http.Request) {
+	report, err := Verify()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,159 @@
+package audit
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"rbi/config"
+	"rbi/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	syslogDialTimeout = 5 * time.Second
+	syslogRetryDelay  = 10 * time.Second
+	// RFC 5424 结构化数据 ID，私有 ID 需带企业编号
+	syslogSDID = "audit@32473"
+)
+
+// syslogQueue 为 nil 时不转发
+var syslogQueue chan models.AuditEvent
+
+// startSyslog 启动后台转发，网络问题不阻塞事件写入
+func startSyslog(conf config.SyslogConf) {
+	if !conf.Enabled {
+		return
+	}
+	if conf.Network == "" {
+		conf.Network = "udp"
+	}
+	if conf.Network != "udp" && conf.Network != "tcp" {
+		log.Printf("Audit syslog disabled: unsupported network %q", conf.Network)
+		return
+	}
+	if conf.Address == "" {
+		log.Printf("Audit syslog disabled: address is required")
+		return
+	}
+	if conf.Facility <= 0 || conf.Facility > 23 {
+		conf.Facility = 13
+	}
+	if conf.AppName == "" {
+		conf.AppName = "rbi"
+	}
+	if conf.Hostname == "" {
+		conf.Hostname, _ = os.Hostname()
+	}
+	if conf.QueueSize <= 0 {
+		conf.QueueSize = 1024
+	}
+	syslogQueue = make(chan models.AuditEvent, conf.QueueSize)
+	go runSyslog(conf)
+	log.Printf("Audit: forwarding events to syslog %s://%s", conf.Network, conf.Address)
+}
+
+// forward 放入发送队列，队列满时丢弃
+func forward(e *models.AuditEvent) {
+	if syslogQueue == nil {
+		return
+	}
+	select {
+	case syslogQueue <- *e:
+	default:
+		log.Printf("Audit syslog queue full, dropped event %d", e.ID)
+	}
+}
+
+func runSyslog(conf config.SyslogConf) {
+	var conn net.Conn
+	for e := range syslogQueue {
+		msg := formatSyslog(conf, &e)
+		if conf.Network == "tcp" {
+			// RFC 6587 octet counting
+			msg = strconv.Itoa(len(msg)) + " " + msg
+		}
+		for conn == nil {
+			c, err := net.DialTimeout(conf.Network, conf.Address, syslogDialTimeout)
+			if err != nil {
+				log.Printf("Audit syslog dial %s failed: %v", conf.Address, err)
+				time.Sleep(syslogRetryDelay)
+				continue
+			}
+			conn = c
+		}
+		conn.SetWriteDeadline(time.Now().Add(syslogDialTimeout))
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			// 下一条事件时重连，本条丢弃
+			log.Printf("Audit syslog write failed, event %d dropped: %v", e.ID, err)
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+// syslogSeverity 成功为 informational，拒绝为 notice，失败为 warning
+func syslogSeverity(outcome string) int {
+	switch outcome {
+	case models.AuditDenied:
+		return 5
+	case models.AuditFailure:
+		return 4
+	}
+	return 6
+}
+
+// headerField 头部字段不能为空或含空白，最长 maxLen 个字符
+func headerField(s string, maxLen int) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "-"
+	}
+	if len(s) > maxLen {
+		s = s[:maxLen]
+	}
+	return s
+}
+
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// formatSyslog 按 RFC 5424 格式化，事件字段放在结构化数据中，详情作为 MSG
+func formatSyslog(conf config.SyslogConf, e *models.AuditEvent) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d %s [%s",
+		conf.Facility*8+syslogSeverity(e.Outcome),
+		e.CreatedAt.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		headerField(conf.Hostname, 255),
+		headerField(conf.AppName, 48),
+		os.Getpid(),
+		headerField(e.Category, 32),
+		syslogSDID)
+	params := [][2]string{
+		{"id", strconv.FormatInt(e.ID, 10)},
+		{"action", e.Action},
+		{"actor", e.Actor},
+		{"actorId", strconv.FormatUint(uint64(e.ActorID), 10)},
+		{"tenantId", strconv.FormatUint(uint64(e.TenantID), 10)},
+		{"ip", e.IP},
+		{"target", e.Target},
+		{"outcome", e.Outcome},
+		{"hash", e.Hash},
+	}
+	for _, p := range params {
+		fmt.Fprintf(&b, ` %s="%s"`, p[0], sdEscaper.Replace(p[1]))
+	}
+	b.WriteString("]")
+	if e.Detail != "" {
+		// MSG 为 UTF-8 时以 BOM 开头
+		b.WriteString(" \xef\xbb\xbf")
+		b.WriteString(e.Detail)
+	}
+	return b.String()
+}
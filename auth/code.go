@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// ExchangeCodeParam 新窗口地址中携带一次性换取码的参数名
+const ExchangeCodeParam = "auth_code"
+
+// 换取码的有效期，只用于刚打开的窗口
+const exchangeCodeTTL = time.Minute
+
+// exchangeCode 一次性换取码对应的登录会话
+type exchangeCode struct {
+	token     string
+	userID    uint
+	expiresAt time.Time
+}
+
+var exchangeCodes = struct {
+	sync.Mutex
+	m map[string]exchangeCode
+}{m: map[string]exchangeCode{}}
+
+// NewExchangeCode 为当前登录会话生成一次性换取码。浏览器直接打开的新窗口无法携带请求头，
+// 地址中只放换取码，访问令牌不出现在地址、历史记录和日志中
+func NewExchangeCode(id *Identity) string {
+	code := newToken()
+	now := time.Now()
+	exchangeCodes.Lock()
+	defer exchangeCodes.Unlock()
+	for k, c := range exchangeCodes.m {
+		if now.After(c.expiresAt) {
+			delete(exchangeCodes.m, k)
+		}
+	}
+	exchangeCodes.m[HashToken(code)] = exchangeCode{token: id.Token, userID: id.UserID, expiresAt: now.Add(exchangeCodeTTL)}
+	return code
+}
+
+// takeExchangeCode 取出并作废换取码，过期时返回 false
+func takeExchangeCode(code string) (exchangeCode, bool) {
+	exchangeCodes.Lock()
+	defer exchangeCodes.Unlock()
+	c, ok := exchangeCodes.m[HashToken(code)]
+	delete(exchangeCodes.m, HashToken(code))
+	return c, ok && time.Now().Before(c.expiresAt)
+}
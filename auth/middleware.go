@@ -0,0 +1,308 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net"
+	"net/http"
+	"path"
+	"rbi/config"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Identity 当前请求的登录用户
+type Identity struct {
+	UserID    uint
+	Username  string
+	IsAdmin   bool
+	SessionID int64
+	// 所属租户，租户管理员拥有本租户内的全部权限
+	TenantID    uint
+	TenantAdmin bool
+	ExpiresAt   time.Time
+	// 请求携带的访问令牌
+	Token string
+	// 通过角色获得的权限
+	Permissions map[string]bool
+	// 密码被重置，修改前只能访问 AllowPasswordChange 声明的路径
+	MustChangePassword bool
+	// 角色要求两步验证但尚未绑定，绑定前只能访问 AllowTOTPEnrollment 声明的路径
+	MustEnrollTOTP bool
+	// 通过 API Key 认证时为密钥 ID，此时 Permissions 受密钥 scope 限制
+	APIKeyID int64
+}
+
+// Can 管理员和租户管理员拥有全部权限，数据范围由 Scope 限定
+func (i *Identity) Can(perm string) bool {
+	return i.IsAdmin || i.TenantAdmin || i.Permissions[perm]
+}
+
+// Key 用户在 hub 等处的字符串标识
+func (i *Identity) Key() string {
+	return strconv.FormatUint(uint64(i.UserID), 10)
+}
+
+type identityKey struct{}
+
+// FromContext 取出认证中间件放入的用户，公开路由上可能为空
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
+
+// Current 取出当前请求的用户
+func Current(r *http.Request) *Identity {
+	return FromContext(r.Context())
+}
+
+var public = struct {
+	m map[string]bool
+	sync.RWMutex
+}{m: make(map[string]bool)}
+
+// Public 声明不需要登录的路径，各模块在 RegisterRoutes 中调用
+func Public(paths ...string) {
+	public.Lock()
+	defer public.Unlock()
+	for _, p := range paths {
+		public.m[p] = true
+	}
+}
+
+func isPublic(path string) bool {
+	public.RLock()
+	defer public.RUnlock()
+	return public.m[path]
+}
+
+// pathPatterns 一组 path.Match 通配路径
+type pathPatterns struct {
+	patterns []string
+	sync.RWMutex
+}
+
+func (p *pathPatterns) add(patterns ...string) {
+	p.Lock()
+	defer p.Unlock()
+	p.patterns = append(p.patterns, patterns...)
+}
+
+func (p *pathPatterns) match(s string) bool {
+	p.RLock()
+	defer p.RUnlock()
+	for _, pattern := range p.patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+var passwordChange, totpEnrollment pathPatterns
+
+// AllowPasswordChange 声明必须修改密码的用户仍可访问的路径，支持 path.Match 通配
+func AllowPasswordChange(patterns ...string) {
+	passwordChange.add(patterns...)
+}
+
+// AllowTOTPEnrollment 声明必须绑定两步验证的用户仍可访问的路径，支持 path.Match 通配
+func AllowTOTPEnrollment(patterns ...string) {
+	totpEnrollment.add(patterns...)
+}
+
+// Middleware 校验 Authorization 头或 cookie 中的登录令牌或 API Key，公开路径直接放行
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := tokenFromRequest(r)
+		if token == "" && isPublic(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// 新窗口打开会话页面时无法携带请求头，地址中带 /login/code 生成的一次性换取码，换成 cookie 后去掉
+		if code := r.URL.Query().Get(ExchangeCodeParam); code != "" && r.Method == http.MethodGet {
+			if c, ok := takeExchangeCode(code); ok {
+				// 浏览器已登录其他用户时不覆盖，避免通过链接把对方登录到别人的会话
+				var current *Identity
+				if token != "" {
+					current, _ = lookup(token)
+				}
+				if current == nil || current.UserID == c.userID {
+					if id, err := lookup(c.token); err == nil && id.UserID == c.userID {
+						setCookie(w, c.token, id.ExpiresAt)
+					}
+				}
+			}
+			q := r.URL.Query()
+			q.Del(ExchangeCodeParam)
+			u := *r.URL
+			u.RawQuery = q.Encode()
+			http.Redirect(w, r, u.RequestURI(), http.StatusFound)
+			return
+		}
+
+		var id *Identity
+		var err error
+		if isAPIKey(token) {
+			id, err = lookupAPIKey(token, r)
+		} else {
+			id, err = lookup(token)
+		}
+		if err != nil {
+			if isPublic(r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			Unauthorized(w)
+			return
+		}
+		id.Token = token
+		if id.MustChangePassword && !passwordChange.match(r.URL.Path) {
+			writeError(w, http.StatusForbidden, "Password change required")
+			return
+		}
+		if id.MustEnrollTOTP && !totpEnrollment.match(r.URL.Path) {
+			writeError(w, http.StatusForbidden, "Two-factor enrollment required")
+			return
+		}
+		// API Key 默认拒绝，只能访问声明了权限的路由，scope 在路由上检查
+		if id.APIKeyID != 0 && !declaresPermission(r) {
+			writeError(w, http.StatusForbidden, "API key not allowed on this route")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	})
+}
+
+// guarded 声明了权限要求的路由处理器，API Key 只能访问这类路由
+type guarded struct {
+	allow func(id *Identity) bool
+	h     http.HandlerFunc
+}
+
+func (g guarded) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := Current(r)
+	if id == nil {
+		Unauthorized(w)
+		return
+	}
+	if !g.allow(id) {
+		Forbidden(w)
+		return
+	}
+	g.h(w, r)
+}
+
+// declaresPermission 匹配到的路由是否由 Require 或 RequireAdmin 包装
+func declaresPermission(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+	_, ok := route.GetHandler().(guarded)
+	return ok
+}
+
+// Require 包装需要指定权限的路由，用 router.Handle 注册
+func Require(perm string, h http.HandlerFunc) http.Handler {
+	return guarded{allow: func(id *Identity) bool { return id.Can(perm) }, h: h}
+}
+
+// Unauthorized 返回前端约定格式的 401
+func Unauthorized(w http.ResponseWriter) {
+	writeError(w, http.StatusUnauthorized, "Unauthorized")
+}
+
+// Forbidden 返回前端约定格式的 403
+func Forbidden(w http.ResponseWriter) {
+	writeError(w, http.StatusForbidden, "Forbidden")
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":    status,
+		"message": message,
+	})
+}
+
+// tokenFromRequest 支持 "Authorization: Bearer xxx"、不带前缀的 Authorization 和 cookie
+func tokenFromRequest(r *http.Request) string {
+	if h := strings.TrimSpace(r.Header.Get("Authorization")); h != "" {
+		if scheme, token, ok := strings.Cut(h, " "); ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return h
+	}
+	if c, err := r.Cookie(cookieName()); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// ClientIP 客户端地址。连接来自受信任的反向代理时，从右往左取 X-Forwarded-For 中第一个不受信任的地址，
+// 其余情况使用连接地址，避免客户端伪造 X-Forwarded-For 绕过登录锁定或篡改审计 IP
+func ClientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !trustedProxy(ip) {
+		return ip
+	}
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			// 无法解析的地址之前的内容都不可信
+			return ip
+		}
+		ip = hops[i]
+		if !trustedProxy(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// trustedProxy ip 是否在 auth.trustedProxies 中
+func trustedProxy(s string) bool {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return false
+	}
+	for _, p := range config.Config.Auth.TrustedProxies {
+		if _, network, err := net.ParseCIDR(p); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if trusted := net.ParseIP(p); trusted != nil && trusted.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// StripCredentials 去掉请求头中的登录令牌，请求转发给不受信任的上游前调用
+func StripCredentials(h http.Header) {
+	h.Del("Authorization")
+	cookies := (&http.Request{Header: h}).Cookies()
+	h.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name == cookieName() {
+			continue
+		}
+		h.Add("Cookie", c.Name+"="+c.Value)
+	}
+}
@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"rbi/config"
+	"rbi/models"
+	"rbi/sqlite"
+	"time"
+)
+
+var Db = sqlite.Db
+
+var (
+	ErrInvalidToken = errors.New("invalid or expired token")
+)
+
+// Tokens 登录后返回给客户端的令牌
+type Tokens struct {
+	Token            string    `json:"token"`
+	RefreshToken     string    `json:"refreshToken"`
+	ExpiresAt        time.Time `json:"expiresAt"`
+	RefreshExpiresAt time.Time `json:"refreshExpiresAt"`
+}
+
+func tokenTTL() time.Duration {
+	if m := config.Config.Auth.TokenTTLMinutes; m > 0 {
+		return time.Duration(m) * time.Minute
+	}
+	return time.Hour
+}
+
+func refreshTTL() time.Duration {
+	if h := config.Config.Auth.RefreshTTLHours; h > 0 {
+		return time.Duration(h) * time.Hour
+	}
+	return 7 * 24 * time.Hour
+}
+
+// Issue 为用户创建新的登录会话
+func Issue(user *models.User, r *http.Request) (*Tokens, error) {
+	t := &Tokens{
+		Token:            newToken(),
+		RefreshToken:     newToken(),
+		ExpiresAt:        time.Now().Add(tokenTTL()),
+		RefreshExpiresAt: time.Now().Add(refreshTTL()),
+	}
+	session := &models.AuthSession{
+		UserID:           user.UserID,
+		TokenHash:        HashToken(t.Token),
+		RefreshHash:      HashToken(t.RefreshToken),
+		ExpiresAt:        t.ExpiresAt,
+		RefreshExpiresAt: t.RefreshExpiresAt,
+		IP:               ClientIP(r),
+		UserAgent:        r.UserAgent(),
+	}
+	if err := Db.Create(session).Error; err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Refresh 用刷新令牌换取新令牌，旧会话随即作废
+func Refresh(refreshToken string, r *http.Request) (*Tokens, *models.User, error) {
+	var session models.AuthSession
+	err := Db.Where("refresh_hash = ? AND revoked_at IS NULL AND refresh_expires_at > ?", HashToken(refreshToken), time.Now()).
+		First(&session).Error
+	if err != nil {
+		return nil, nil, ErrInvalidToken
+	}
+	var user models.User
+	if err := Db.First(&user, session.UserID).Error; err != nil || user.Disabled() {
+		return nil, nil, ErrInvalidToken
+	}
+	if err := revoke(&session); err != nil {
+		return nil, nil, err
+	}
+	t, err := Issue(&user, r)
+	return t, &user, err
+}
+
+// Revoke 作废访问令牌对应的会话
+func Revoke(token string) error {
+	var session models.AuthSession
+	if err := Db.Where("token_hash = ? AND revoked_at IS NULL", HashToken(token)).First(&session).Error; err != nil {
+		return ErrInvalidToken
+	}
+	return revoke(&session)
+}
+
+// RevokeUser 作废用户的全部会话
+func RevokeUser(userID uint) error {
+	return Db.Model(&models.AuthSession{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// RevokeOthers 作废用户除 keep 以外的会话，修改密码后使用
+func RevokeOthers(userID uint, keep int64) error {
+	return Db.Model(&models.AuthSession{}).
+		Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userID, keep).
+		Update("revoked_at", time.Now()).Error
+}
+
+func revoke(session *models.AuthSession) error {
+	now := time.Now()
+	session.RevokedAt = &now
+	return Db.Model(session).Update("revoked_at", now).Error
+}
+
+// lookup 根据访问令牌找到用户
+func lookup(token string) (*Identity, error) {
+	var session models.AuthSession
+	err := Db.Where("token_hash = ? AND revoked_at IS NULL AND expires_at > ?", HashToken(token), time.Now()).
+		First(&session).Error
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var user models.User
+	if err := Db.First(&user, session.UserID).Error; err != nil || user.Disabled() {
+		return nil, ErrInvalidToken
+	}
+	id := &Identity{UserID: user.UserID, Username: user.Username, IsAdmin: user.IsAdmin, SessionID: session.ID, ExpiresAt: session.ExpiresAt,
+		TenantID: user.TenantID, TenantAdmin: user.TenantAdmin, MustChangePassword: user.MustChangePassword}
+	codes, err := PermissionCodes(user.UserID)
+	if err != nil {
+		return nil, err
+	}
+	id.Permissions = make(map[string]bool, len(codes))
+	for _, code := range codes {
+		id.Permissions[code] = true
+	}
+	// 单点登录的账号同样受角色的两步验证要求约束
+	if !user.TOTPEnabled {
+		if id.MustEnrollTOTP, err = RequiresTOTP(user.UserID); err != nil {
+			return nil, err
+		}
+	}
+	return id, nil
+}
+
+// RequiresTOTP 用户是否拥有要求两步验证的角色
+func RequiresTOTP(userID uint) (bool, error) {
+	var count int64
+	err := Db.Model(&models.Role{}).
+		Joins("JOIN user_roles ON user_roles.role_id = roles.id").
+		Where("user_roles.user_id = ? AND roles.require_totp = ?", userID, true).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// PermissionCodes 用户所有角色的权限合集
+func PermissionCodes(userID uint) ([]string, error) {
+	var codes []string
+	err := Db.Model(&models.Permission{}).Distinct("permissions.code").
+		Joins("JOIN role_permissions ON role_permissions.permission_id = permissions.id").
+		Joins("JOIN user_roles ON user_roles.role_id = role_permissions.role_id").
+		Where("user_roles.user_id = ?", userID).
+		Pluck("permissions.code", &codes).Error
+	return codes, err
+}
+
+// SetCookie 浏览器直接打开的页面(会话代理、下载)依赖 cookie 认证
+func SetCookie(w http.ResponseWriter, t *Tokens) {
+	setCookie(w, t.Token, t.ExpiresAt)
+}
+
+func setCookie(w http.ResponseWriter, token string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieName(),
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   config.Config.Auth.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func ClearCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieName(),
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   config.Config.Auth.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func cookieName() string {
+	if name := config.Config.Auth.CookieName; name != "" {
+		return name
+	}
+	return "rbi_session"
+}
+
+// HashToken 令牌在数据库中只保存 SHA-256
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,29 @@
+package auth
+
+import (
+	"gorm.io/gorm"
+	"net/http"
+)
+
+// Scope 按租户过滤查询，全局管理员不受限制，表需有 tenant_id 列
+func (i *Identity) Scope(db *gorm.DB) *gorm.DB {
+	if i.IsAdmin {
+		return db
+	}
+	return db.Where("tenant_id = ?", i.TenantID)
+}
+
+// InTenant 资源是否在当前用户可见的租户内
+func (i *Identity) InTenant(tenantID uint) bool {
+	return i.IsAdmin || i.TenantID == tenantID
+}
+
+// ManagesTenant 是否可以管理租户内其他用户的资源
+func (i *Identity) ManagesTenant(tenantID uint) bool {
+	return i.IsAdmin || (i.TenantAdmin && i.TenantID == tenantID)
+}
+
+// RequireAdmin 包装只允许全局管理员访问的路由，如租户和角色的维护，用 router.Handle 注册
+func RequireAdmin(h http.HandlerFunc) http.Handler {
+	return guarded{allow: func(id *Identity) bool { return id.IsAdmin }, h: h}
+}
@@ -4,15 +4,24 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"os"
 	"time"
 
 	"github.com/chromedp/chromedp"
 )
 
+// mustEnv 读取必填的环境变量，账号密码不写在代码中
+func mustEnv(name string) string {
+	v := os.Getenv(name)
+	if v == "" {
+		log.Fatalf("environment variable %s is required", name)
+	}
+	return v
+}
+
 func main() {
-	// 远程调试端点 URL （remote-server-ip:9333）
-	//shh的本地浏览器调试
-	remoteURL := "ws://202.63.172.204:9444"
+	// 远程调试端点 URL，如 ws://remote-server-ip:9333
+	remoteURL := mustEnv("AUTO_REMOTE_URL")
 	// 创建上下文，连接到远程 Chrome 实例
 	ctx, cancel := chromedp.NewRemoteAllocator(context.Background(), remoteURL)
 	defer cancel()
@@ -23,10 +32,10 @@ func main() {
 	// 设置超时
 	ctx, cancel = context.WithTimeout(ctx, 15*time.Second)
 	defer cancel()
-	// 设置登录界面的url
-	loginUrl := "http://git.avocado.wiki"
-	username := "sunhaohang@buaa.edu.cn"
-	password := "St111535"
+	// 登录界面的url和账号
+	loginUrl := mustEnv("AUTO_LOGIN_URL")
+	username := mustEnv("AUTO_USERNAME")
+	password := mustEnv("AUTO_PASSWORD")
 	// 执行浏览器操作
 	var pageTitle string
 	err := chromedp.Run(ctx,
@@ -0,0 +1,376 @@
+package automation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/dom"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+	"github.com/chromedp/chromedp/kb"
+	"net/url"
+	"path"
+	"rbi/config"
+	"rbi/models"
+	"rbi/policy"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 单个 sleep 动作的上限，整个脚本的执行时间为 60 秒
+const maxSleep = 60 * time.Second
+
+var variableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,63}$`)
+
+// namedKeys keyPress 支持的按键名，如 Enter、Tab、ArrowDown
+var namedKeys = func() map[string]string {
+	keys := map[string]string{}
+	for r, k := range kb.Keys {
+		if len(k.Key) > 1 {
+			keys[k.Key] = string(r)
+		}
+	}
+	return keys
+}()
+
+// Artifact 脚本生成的截图或 PDF，JSON 中 Data 为 base64
+type Artifact struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Data []byte `json:"data"`
+}
+
+// runState 一次执行中提取的变量和生成的文件
+type runState struct {
+	Variables map[string]string `json:"variables"`
+	Artifacts []Artifact        `json:"artifacts"`
+}
+
+// validateAction 检查动作类型和必填字段
+func validateAction(a *models.Action) error {
+	need := func(field, value string) error {
+		if strings.TrimSpace(value) == "" {
+			return fmt.Errorf("缺少 %s", field)
+		}
+		return nil
+	}
+	needVariable := func() error {
+		if !variableName.MatchString(a.Variable) {
+			return fmt.Errorf("variable 必须是字母、数字和下划线组成的变量名")
+		}
+		return nil
+	}
+	for field, text := range templateFields(a) {
+		if err := checkTemplate(field, text); err != nil {
+			return err
+		}
+	}
+	if err := checkSecretRefs(a); err != nil {
+		return err
+	}
+	if err := validateSelector(a); err != nil {
+		return err
+	}
+	// 含模板的值在执行时替换后再检查
+	literal := !hasTemplate(a.Value)
+	switch a.ActionType {
+	case models.ActionNavigate:
+		return need("url", a.URL)
+	case models.ActionNavigateBack, models.ActionPDF:
+	case models.ActionWaitVisible, models.ActionWaitNotVisible, models.ActionClick,
+		models.ActionSendKeys, models.ActionSelect, models.ActionSetValue:
+		return need("selector", a.Selector)
+	case models.ActionSleep:
+		if a.Duration <= 0 || time.Duration(a.Duration)*time.Millisecond > maxSleep {
+			return fmt.Errorf("duration 必须在 1 到 %d 毫秒之间", maxSleep.Milliseconds())
+		}
+	case models.ActionKeyPress:
+		if _, ok := namedKeys[a.Value]; literal && !ok && len([]rune(a.Value)) != 1 {
+			return fmt.Errorf("value 必须是单个字符或按键名，如 Enter、Tab、Escape")
+		}
+	case models.ActionScroll:
+		if a.Selector == "" && literal {
+			if _, _, err := scrollOffset(a.Value); err != nil {
+				return err
+			}
+		}
+	case models.ActionUpload:
+		if err := need("selector", a.Selector); err != nil {
+			return err
+		}
+		if err := need("value", a.Value); err != nil || !literal {
+			return err
+		}
+		if _, err := uploadPath(a.Value); err != nil {
+			return err
+		}
+	case models.ActionEvaluate:
+		if err := need("value", a.Value); err != nil {
+			return err
+		}
+		if a.Variable != "" {
+			return needVariable()
+		}
+	case models.ActionText:
+		if err := need("selector", a.Selector); err != nil {
+			return err
+		}
+		return needVariable()
+	case models.ActionAttribute:
+		if err := need("selector", a.Selector); err != nil {
+			return err
+		}
+		if err := need("attribute", a.Attribute); err != nil {
+			return err
+		}
+		return needVariable()
+	case models.ActionScreenshot:
+		if a.Variable != "" {
+			return needVariable()
+		}
+	default:
+		return fmt.Errorf("未知的 ActionType: %s", a.ActionType)
+	}
+	return nil
+}
+
+// validateActions 校验整个脚本，错误带上动作序号
+func validateActions(actions []models.Action) error {
+	for i := range actions {
+		if err := validateAction(&actions[i]); err != nil {
+			return fmt.Errorf("第 %d 个动作 %s: %v", i+1, actions[i].ActionType, err)
+		}
+	}
+	return checkSecretScript(actions)
+}
+
+// scrollOffset 解析 "x,y" 像素偏移
+func scrollOffset(s string) (int, int, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) == 2 {
+		x, errX := strconv.Atoi(strings.TrimSpace(parts[0]))
+		y, errY := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if errX == nil && errY == nil {
+			return x, y, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("没有 selector 时 value 必须是滚动偏移 \"x,y\"")
+}
+
+// uploadPath 上传的文件只能是已导入会话的文件，即容器内导入目录下的相对路径
+func uploadPath(name string) (string, error) {
+	clean := path.Clean(name)
+	if name == "" || clean != name || path.IsAbs(name) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("value 必须是导入目录下的文件名")
+	}
+	dir := config.Config.Ingest.ContainerDir
+	if dir == "" {
+		return "", fmt.Errorf("未配置导入目录 ingest.containerDir")
+	}
+	return path.Join(dir, clean), nil
+}
+
+// nodeOrigin 元素所在文档的来源，iframe 中的元素取 iframe 的文档。
+// 沿 DevTools 的节点树向上查找，不经过页面脚本，页面无法伪造
+func nodeOrigin(n *cdp.Node) string {
+	for n != nil {
+		n.RLock()
+		typ, docURL, parent := n.NodeType, n.DocumentURL, n.Parent
+		n.RUnlock()
+		if typ == cdp.NodeTypeDocument {
+			u, err := url.Parse(docURL)
+			if err != nil {
+				return ""
+			}
+			return urlOrigin(u)
+		}
+		n = parent
+	}
+	return ""
+}
+
+// checkOrigin 密钥只能填入 allowed 中的来源，allowed 为 nil 表示动作没有引用密钥
+func checkOrigin(n *cdp.Node, allowed []string) error {
+	if allowed == nil {
+		return nil
+	}
+	origin := nodeOrigin(n)
+	for _, o := range allowed {
+		if origin != "" && origin == o {
+			return nil
+		}
+	}
+	return fmt.Errorf("页面来源 %q 不在密钥允许的来源中", origin)
+}
+
+// sendKeys 与 chromedp.SendKeys 相同，输入前检查元素所在页面的来源
+func sendKeys(a *models.Action, allowed []string) chromedp.Action {
+	return chromedp.QueryAfter(a.Selector, func(ctx context.Context, _ runtime.ExecutionContextID, nodes ...*cdp.Node) error {
+		if len(nodes) == 0 {
+			return fmt.Errorf("selector %q 没有匹配的元素", a.Selector)
+		}
+		if err := checkOrigin(nodes[0], allowed); err != nil {
+			return err
+		}
+		return chromedp.KeyEventNode(nodes[0], a.Value).Do(ctx)
+	}, selectorOption(a), chromedp.NodeVisible)
+}
+
+// setValue 设置表单值并触发 input、change 事件，select 不存在对应选项时报错
+func setValue(a *models.Action, isSelect bool, allowed []string) chromedp.Action {
+	const fn = `function(v, isSelect) {
+	this.value = v;
+	if (isSelect && this.value !== v) throw new Error('option not found: ' + v);
+	this.dispatchEvent(new Event('input', {bubbles: true}));
+	this.dispatchEvent(new Event('change', {bubbles: true}));
+}`
+	return chromedp.QueryAfter(a.Selector, func(ctx context.Context, _ runtime.ExecutionContextID, nodes ...*cdp.Node) error {
+		if len(nodes) == 0 {
+			return fmt.Errorf("selector %q 没有匹配的元素", a.Selector)
+		}
+		if err := checkOrigin(nodes[0], allowed); err != nil {
+			return err
+		}
+		obj, err := dom.ResolveNode().WithNodeID(nodes[0].NodeID).Do(ctx)
+		if err != nil {
+			return err
+		}
+		defer runtime.ReleaseObject(obj.ObjectID).Do(ctx)
+		return chromedp.CallFunctionOn(fn, nil, func(p *runtime.CallFunctionOnParams) *runtime.CallFunctionOnParams {
+			return p.WithObjectID(obj.ObjectID)
+		}, a.Value, isSelect).Do(ctx)
+	}, selectorOption(a))
+}
+
+// artifactName 未指定文件名时按动作序号命名
+func artifactName(a *models.Action, step int, ext string) string {
+	name := a.Variable
+	if name == "" {
+		name = fmt.Sprintf("%s-%d", a.ActionType, step)
+	}
+	return name + ext
+}
+
+// buildAction 把一个动作转成 chromedp 任务，结果写入 state。allowed 为动作引用的密钥允许填入的来源
+func buildAction(tenantID uint, a *models.Action, step int, state *runState, allowed []string) (chromedp.Action, error) {
+	if err := validateAction(a); err != nil {
+		return nil, err
+	}
+	by := selectorOption(a)
+	switch a.ActionType {
+	case models.ActionNavigate:
+		if err := policy.CheckFor(tenantID, a.URL); err != nil {
+			return nil, err
+		}
+		return chromedp.Navigate(a.URL), nil
+	case models.ActionNavigateBack:
+		return chromedp.NavigateBack(), nil
+	case models.ActionWaitVisible:
+		return chromedp.WaitVisible(a.Selector, by), nil
+	case models.ActionWaitNotVisible:
+		return chromedp.WaitNotVisible(a.Selector, by), nil
+	case models.ActionSleep:
+		return chromedp.Sleep(time.Duration(a.Duration) * time.Millisecond), nil
+	case models.ActionClick:
+		return chromedp.Click(a.Selector, by), nil
+	case models.ActionSendKeys:
+		if allowed != nil {
+			return sendKeys(a, allowed), nil
+		}
+		return chromedp.SendKeys(a.Selector, a.Value, by), nil
+	case models.ActionKeyPress:
+		key, ok := namedKeys[a.Value]
+		if !ok {
+			key = a.Value
+		}
+		// 指定 selector 时先聚焦到该元素
+		if a.Selector != "" {
+			return chromedp.SendKeys(a.Selector, key, by), nil
+		}
+		return chromedp.KeyEvent(key), nil
+	case models.ActionScroll:
+		if a.Selector != "" {
+			return chromedp.ScrollIntoView(a.Selector, by), nil
+		}
+		x, y, _ := scrollOffset(a.Value)
+		return chromedp.Evaluate(fmt.Sprintf("window.scrollBy(%d, %d)", x, y), nil), nil
+	case models.ActionSelect:
+		return setValue(a, true, allowed), nil
+	case models.ActionSetValue:
+		return setValue(a, false, allowed), nil
+	case models.ActionUpload:
+		file, err := uploadPath(a.Value)
+		if err != nil {
+			return nil, err
+		}
+		return chromedp.SetUploadFiles(a.Selector, []string{file}, by), nil
+	case models.ActionEvaluate:
+		var raw []byte
+		return chromedp.Tasks{
+			chromedp.Evaluate(a.Value, &raw, func(p *runtime.EvaluateParams) *runtime.EvaluateParams {
+				return p.WithAwaitPromise(true)
+			}),
+			chromedp.ActionFunc(func(context.Context) error {
+				if a.Variable == "" {
+					return nil
+				}
+				// 字符串结果直接存入，其它类型存 JSON
+				var s string
+				if json.Unmarshal(raw, &s) != nil {
+					s = string(raw)
+				}
+				state.Variables[a.Variable] = s
+				return nil
+			}),
+		}, nil
+	case models.ActionText:
+		var text string
+		return chromedp.Tasks{
+			chromedp.Text(a.Selector, &text, by),
+			chromedp.ActionFunc(func(context.Context) error {
+				state.Variables[a.Variable] = text
+				return nil
+			}),
+		}, nil
+	case models.ActionAttribute:
+		var value string
+		var ok bool
+		return chromedp.Tasks{
+			chromedp.AttributeValue(a.Selector, a.Attribute, &value, &ok, by),
+			chromedp.ActionFunc(func(context.Context) error {
+				if !ok {
+					return fmt.Errorf("元素 %s 没有属性 %s", a.Selector, a.Attribute)
+				}
+				state.Variables[a.Variable] = value
+				return nil
+			}),
+		}, nil
+	case models.ActionScreenshot:
+		var buf []byte
+		var shot chromedp.Action = chromedp.FullScreenshot(&buf, 100)
+		if a.Selector != "" {
+			shot = chromedp.Screenshot(a.Selector, &buf, by)
+		}
+		return chromedp.Tasks{
+			shot,
+			chromedp.ActionFunc(func(context.Context) error {
+				state.Artifacts = append(state.Artifacts, Artifact{Name: artifactName(a, step, ".png"), Type: "image/png", Data: buf})
+				return nil
+			}),
+		}, nil
+	case models.ActionPDF:
+		return chromedp.ActionFunc(func(ctx context.Context) error {
+			buf, _, err := page.PrintToPDF().WithPrintBackground(true).Do(ctx)
+			if err != nil {
+				return err
+			}
+			state.Artifacts = append(state.Artifacts, Artifact{Name: artifactName(a, step, ".pdf"), Type: "application/pdf", Data: buf})
+			return nil
+		}), nil
+	}
+	return nil, fmt.Errorf("未知的 ActionType: %s", a.ActionType)
+}
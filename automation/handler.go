@@ -3,22 +3,33 @@ package automation
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/chromedp/chromedp"
 	"github.com/gorilla/mux"
+	"net"
 	"net/http"
+	"rbi/audit"
+	"rbi/auth"
+	"rbi/config"
+	"rbi/hub"
 	"rbi/models"
+	"rbi/policy"
 	"rbi/sqlite"
+	"rbi/tenant"
 	"strconv"
 	"time"
 )
 
 func RegisterRoutes(router *mux.Router) {
-	router.HandleFunc("/automation/newScript", newScript).Methods(http.MethodPost)
-	router.HandleFunc("/automation/getScripts", getScripts).Methods(http.MethodGet)
-	router.HandleFunc("/automation/delScript", delScript).Methods(http.MethodPost)
-	router.HandleFunc("/automation/updateAction", updateAction).Methods(http.MethodPost)
-	router.HandleFunc("/automation/runScript", runScript).Methods(http.MethodPost)
+	router.Handle("/automation/newScript", auth.Require(models.PermAutomationManage, newScript)).Methods(http.MethodPost)
+	router.Handle("/automation/getScripts", auth.Require(models.PermAutomationView, getScripts)).Methods(http.MethodGet)
+	router.Handle("/automation/delScript", auth.Require(models.PermAutomationManage, delScript)).Methods(http.MethodPost)
+	router.Handle("/automation/updateAction", auth.Require(models.PermAutomationManage, updateAction)).Methods(http.MethodPost)
+	router.Handle("/automation/runScript", auth.Require(models.PermAutomationRun, runScript)).Methods(http.MethodPost)
+	router.Handle("/automation/secrets", auth.Require(models.PermAutomationManage, listSecrets)).Methods(http.MethodGet)
+	router.Handle("/automation/secrets/save", auth.Require(models.PermAutomationManage, saveSecret)).Methods(http.MethodPost)
+	router.Handle("/automation/secrets/delete", auth.Require(models.PermAutomationManage, delSecret)).Methods(http.MethodPost)
 }
 
 var Db = sqlite.Db
@@ -30,20 +41,41 @@ func newScript(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	id := auth.Current(r)
+	automation.UserID = int(id.UserID)
+	automation.TenantID = id.TenantID
+	automation.Archived = false
+	// 创建时附带的动作与 updateAction 一样先校验，ID 由数据库分配，不能指向已有记录
+	automation.AutomationID = 0
+	for i := range automation.Actions {
+		automation.Actions[i].ActionID = 0
+		automation.Actions[i].AutomationID = 0
+	}
+	if err := validateActions(automation.Actions); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := tenant.CheckQuota(id.TenantID, tenant.QuotaAutomations); err != nil {
+		tenant.WriteQuotaError(w, err)
+		return
+	}
 
 	if err := Db.Create(&automation).Error; err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	audit.Record(r, models.AuditAutomation, "automation_create", strconv.Itoa(automation.AutomationID), models.AuditSuccess, automation.Name)
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte(fmt.Sprintf("自动化脚本 %d 创建成功", automation.AutomationID)))
 }
 
-// 获取全部脚本
+// 获取本租户的全部脚本
 func getScripts(w http.ResponseWriter, r *http.Request) {
 	var automations []models.Automation
-	if err := Db.Preload("Actions").Find(&automations).Error; err != nil {
+	// 归档的脚本只在 archived=true 时列出
+	archived := r.URL.Query().Get("archived") == "true"
+	if err := Db.Scopes(auth.Current(r).Scope).Preload("Actions").Where("archived = ?", archived).Find(&automations).Error; err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -62,11 +94,17 @@ func delScript(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := Db.Delete(&models.Automation{}, scriptID).Error; err != nil {
+	result := Db.Scopes(auth.Current(r).Scope).Delete(&models.Automation{}, scriptID)
+	if result.Error != nil {
 		http.Error(w, "删除脚本失败", http.StatusInternalServerError)
 		return
 	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "无法找到指定的 Automation", http.StatusNotFound)
+		return
+	}
 
+	audit.Record(r, models.AuditAutomation, "automation_delete", strconv.Itoa(scriptID), models.AuditSuccess, "")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(fmt.Sprintf("自动化脚本 %d 删除成功", scriptID)))
 }
@@ -87,10 +125,14 @@ func updateAction(w http.ResponseWriter, r *http.Request) {
 
 	// 查找指定的 Automation 记录
 	var automation models.Automation
-	if err := Db.Preload("Actions").First(&automation, req.AutomationID).Error; err != nil {
+	if err := Db.Scopes(auth.Current(r).Scope).Preload("Actions").First(&automation, req.AutomationID).Error; err != nil {
 		http.Error(w, "无法找到指定的 Automation", http.StatusNotFound)
 		return
 	}
+	if err := validateActions(req.Actions); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// 开始事务
 	tx := Db.Begin()
@@ -119,6 +161,8 @@ func updateAction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	audit.Record(r, models.AuditAutomation, "automation_update", strconv.Itoa(req.AutomationID), models.AuditSuccess,
+		fmt.Sprintf("%s, %d actions", automation.Name, len(req.Actions)))
 	// 成功返回
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(fmt.Sprintf("Automation %d 的 Actions 更新成功", req.AutomationID)))
@@ -126,7 +170,9 @@ func updateAction(w http.ResponseWriter, r *http.Request) {
 
 type RunScriptRequest struct {
 	AutomationID int    `json:"automation_id"`
-	RemoteURL    string `json:"remote_url"` // 浏览器调试地址
+	Session      string `json:"session"` // 执行脚本的会话，必须是调用者自己的会话，同时向该会话推送执行进度
+	// 运行参数，动作中以 {{name}} 引用
+	Params map[string]string `json:"params"`
 }
 
 // 执行自动化脚本
@@ -138,22 +184,109 @@ func runScript(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var automation models.Automation
-	if err := Db.Preload("Actions").First(&automation, req.AutomationID).Error; err != nil {
+	if err := Db.Scopes(auth.Current(r).Scope).Preload("Actions").First(&automation, req.AutomationID).Error; err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	if automation.Archived {
+		http.Error(w, "脚本已归档", http.StatusConflict)
+		return
+	}
 
-	err := executeActions(automation.Actions, req.RemoteURL)
+	// 调试地址由服务端按会话确定，密钥会被填入该会话的浏览器，只能是调用者自己在脚本所属租户的会话
+	id := auth.Current(r)
+	remoteURL, err := runTarget(id, req.Session, automation.TenantID)
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// 执行进度推送到调用者的 /appws 连接
+	owner := id.Key()
+	progress := func(p hub.AutomationProgressData) {
+		p.AutomationID = automation.AutomationID
+		msg := hub.New(hub.TypeAutomationProgress, req.Session, p)
+		hub.SendToUser(owner, msg)
+		hub.SendToSession(req.Session, msg)
+	}
+
+	scope, err := newScope(automation.TenantID, req.Params)
+	if err == nil {
+		err = scope.checkRefs(automation.Actions)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	state, err := executeActions(automation.TenantID, automation.Actions, scope, remoteURL, progress)
+	target := strconv.Itoa(automation.AutomationID)
+	var denied *policy.DeniedError
+	if errors.As(err, &denied) {
+		audit.Record(r, models.AuditAutomation, "automation_run", target, models.AuditDenied, denied.Error())
+		policy.WriteDenied(w, denied)
+		return
+	}
+	if err != nil {
+		audit.Record(r, models.AuditAutomation, "automation_run", target, models.AuditFailure, err.Error())
 		http.Error(w, fmt.Sprintf("执行脚本时发生错误: %v", err), http.StatusInternalServerError)
 		return
 	}
+	audit.Record(r, models.AuditAutomation, "automation_run", target, models.AuditSuccess, req.Session)
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf("Automation %d 的脚本执行成功", req.AutomationID)))
+	// 返回提取动作得到的变量和截图、PDF，不含运行参数和密钥
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":   fmt.Sprintf("Automation %d 的脚本执行成功", req.AutomationID),
+		"variables": state.Variables,
+		"artifacts": state.Artifacts,
+	})
+}
+
+// runTarget 返回会话容器内浏览器的调试地址，会话必须属于调用者且与脚本在同一租户
+func runTarget(id *auth.Identity, session string, tenantID uint) (string, error) {
+	var info models.ContainerInfo
+	if session == "" || Db.Where("container_id = ?", session).First(&info).Error != nil ||
+		info.UserID != int64(id.UserID) || info.TenantID != tenantID || info.IP == "" {
+		return "", errors.New("会话不存在")
+	}
+	port := config.Config.Automation.DevToolsPort
+	if port == 0 {
+		port = 9222
+	}
+	return "http://" + net.JoinHostPort(info.IP, strconv.Itoa(port)), nil
+}
+
+// newScope 校验运行参数并加载租户密钥
+func newScope(tenantID uint, params map[string]string) (*templateScope, error) {
+	for name := range params {
+		if !variableName.MatchString(name) {
+			return nil, fmt.Errorf("参数名 %q 必须由字母、数字和下划线组成", name)
+		}
+	}
+	secrets, err := loadSecrets(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return &templateScope{params: params, variables: map[string]string{}, secrets: secrets}, nil
 }
 
-func executeActions(actions []models.Action, remoteURL string) error {
+func executeActions(tenantID uint, actions []models.Action, scope *templateScope, remoteURL string, progress func(hub.AutomationProgressData)) (*runState, error) {
+	// 执行前检查全部动作，不含模板的导航地址先做策略检查
+	if err := checkSecretScript(actions); err != nil {
+		return nil, err
+	}
+	for i := range actions {
+		a := &actions[i]
+		if err := validateAction(a); err != nil {
+			return nil, fmt.Errorf("第 %d 个动作 %s: %v", i+1, a.ActionType, err)
+		}
+		if a.ActionType == models.ActionNavigate && !hasTemplate(a.URL) {
+			if err := policy.CheckFor(tenantID, a.URL); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	// 连接到远程 Chrome 实例
 	ctx, cancel := chromedp.NewRemoteAllocator(context.Background(), remoteURL)
 	defer cancel()
@@ -164,26 +297,45 @@ func executeActions(actions []models.Action, remoteURL string) error {
 	ctx, cancel = context.WithTimeout(ctx, 60*time.Second)
 	defer cancel()
 
-	// 创建任务列表
-	var tasks chromedp.Tasks
-	for _, action := range actions {
-		switch action.ActionType {
-		case "navigate":
-			tasks = append(tasks, chromedp.Navigate(action.URL))
-		case "waitVisible":
-			tasks = append(tasks, chromedp.WaitVisible(action.Selector, chromedp.ByQuery))
-		case "sendKeys":
-			tasks = append(tasks, chromedp.SendKeys(action.Selector, action.Value, chromedp.ByQuery))
-		case "click":
-			tasks = append(tasks, chromedp.Click(action.Selector, chromedp.ByQuery))
-		default:
-			return fmt.Errorf("未知的 ActionType: %s", action.ActionType)
+	// 逐条替换模板并执行，后面的动作可以引用前面提取的变量
+	state := &runState{Variables: scope.variables, Artifacts: []Artifact{}}
+	for i := range actions {
+		step := hub.AutomationProgressData{Step: i + 1, Total: len(actions), ActionType: actions[i].ActionType, Status: "running"}
+		progress(step)
+		err := runAction(ctx, tenantID, &actions[i], i+1, scope, state)
+		if err != nil {
+			var denied *policy.DeniedError
+			if errors.As(err, &denied) {
+				denied.Decision.URL = scope.redact(denied.Decision.URL)
+				denied.Decision.Reason = scope.redact(denied.Decision.Reason)
+				step.Status, step.Error = "failed", denied.Error()
+				progress(step)
+				return nil, err
+			}
+			step.Status, step.Error = "failed", scope.redact(err.Error())
+			progress(step)
+			return nil, fmt.Errorf("第 %d 个动作 %s 执行失败: %s", i+1, actions[i].ActionType, step.Error)
 		}
 	}
+	progress(hub.AutomationProgressData{Step: len(actions), Total: len(actions), Status: "done"})
 
-	if err := chromedp.Run(ctx, tasks); err != nil {
-		return fmt.Errorf("执行 chromedp 任务失败: %v", err)
-	}
+	state.Variables = scope.redactVariables(state.Variables)
+	return state, nil
+}
 
-	return nil
+// runAction 替换模板后执行单个动作
+func runAction(ctx context.Context, tenantID uint, action *models.Action, step int, scope *templateScope, state *runState) error {
+	allowed, err := scope.secretOrigins(action)
+	if err != nil {
+		return err
+	}
+	resolved, err := scope.resolve(*action)
+	if err != nil {
+		return err
+	}
+	task, err := buildAction(tenantID, &resolved, step, state, allowed)
+	if err != nil {
+		return err
+	}
+	return chromedp.Run(ctx, task)
 }
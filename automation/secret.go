@@ -0,0 +1,225 @@
+package automation
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"rbi/audit"
+	"rbi/auth"
+	"rbi/config"
+	"rbi/models"
+	"strings"
+)
+
+// 密钥值的存储格式 v1:base64(nonce || AES-256-GCM 密文)，附加数据为租户和名称，密文不能挪给其它密钥使用
+const sealedPrefix = "v1:"
+
+// secretCipher 由 automation.secretKey 创建 AES-GCM
+func secretCipher() (cipher.AEAD, error) {
+	raw := config.Config.Automation.SecretKey
+	if raw == "" {
+		return nil, errors.New("未配置 automation.secretKey，不能保存和使用密钥")
+	}
+	key, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("automation.secretKey 必须是 base64 编码的 32 字节密钥")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func secretAAD(tenantID uint, name string) []byte {
+	return []byte(fmt.Sprintf("%d/%s", tenantID, name))
+}
+
+// sealSecret 加密后写入 secret.Value
+func sealSecret(secret *models.AutomationSecret, value string) error {
+	aead, err := secretCipher()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), secretAAD(secret.TenantID, secret.Name))
+	secret.Value = sealedPrefix + base64.StdEncoding.EncodeToString(sealed)
+	return nil
+}
+
+// openSecret 解密 secret.Value
+func openSecret(aead cipher.AEAD, secret *models.AutomationSecret) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(secret.Value, sealedPrefix))
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("密钥 %s 已损坏，请重新保存", secret.Name)
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, secretAAD(secret.TenantID, secret.Name))
+	if err != nil {
+		return "", fmt.Errorf("密钥 %s 无法解密，automation.secretKey 更换后需要重新保存", secret.Name)
+	}
+	return string(plain), nil
+}
+
+// secretValue 解密后的密钥值和允许填入的来源
+type secretValue struct {
+	value   string
+	origins []string
+}
+
+// normalizeOrigin 规范为 scheme://host[:port]，只接受 http、https，去掉默认端口，不能带路径
+func normalizeOrigin(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || u.User != nil ||
+		(u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("来源 %q 应为 https://host[:port] 形式", raw)
+	}
+	return urlOrigin(u), nil
+}
+
+// urlOrigin 地址的来源 scheme://host[:port]，去掉默认端口，不是 http、https 时返回空
+func urlOrigin(u *url.URL) string {
+	if u.Scheme != "http" && u.Scheme != "https" || u.Hostname() == "" {
+		return ""
+	}
+	host := strings.ToLower(u.Hostname())
+	if port := u.Port(); port != "" && !(u.Scheme == "http" && port == "80") && !(u.Scheme == "https" && port == "443") {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return u.Scheme + "://" + host
+}
+
+// loadSecrets 租户的全部密钥，名称 -> 值。加密之前保存的明文值在这里加密后写回
+func loadSecrets(tenantID uint) (map[string]secretValue, error) {
+	var secrets []models.AutomationSecret
+	if err := Db.Where("tenant_id = ?", tenantID).Find(&secrets).Error; err != nil {
+		return nil, err
+	}
+	m := make(map[string]secretValue, len(secrets))
+	if len(secrets) == 0 {
+		return m, nil
+	}
+	aead, err := secretCipher()
+	if err != nil {
+		return nil, err
+	}
+	for i := range secrets {
+		s := &secrets[i]
+		if !strings.HasPrefix(s.Value, sealedPrefix) {
+			plain := s.Value
+			if err := sealSecret(s, plain); err != nil {
+				return nil, err
+			}
+			if err := Db.Model(s).Update("value", s.Value).Error; err != nil {
+				return nil, err
+			}
+			m[s.Name] = secretValue{value: plain, origins: s.OriginList()}
+			continue
+		}
+		plain, err := openSecret(aead, s)
+		if err != nil {
+			return nil, err
+		}
+		m[s.Name] = secretValue{value: plain, origins: s.OriginList()}
+	}
+	return m, nil
+}
+
+// listSecrets 只返回名称和更新信息，不返回值
+func listSecrets(w http.ResponseWriter, r *http.Request) {
+	secrets := []models.AutomationSecret{}
+	if err := Db.Where("tenant_id = ?", auth.Current(r).TenantID).Order("name asc").Find(&secrets).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(secrets)
+}
+
+type saveSecretRequest struct {
+	Name    string   `json:"name"`
+	Value   string   `json:"value"` // 修改已有密钥时为空表示只更新 origins
+	Origins []string `json:"origins"`
+}
+
+// saveSecret 按名称新建或覆盖本租户的密钥
+func saveSecret(w http.ResponseWriter, r *http.Request) {
+	var req saveSecretRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if !variableName.MatchString(req.Name) {
+		http.Error(w, "name 必须由字母、数字和下划线组成", http.StatusBadRequest)
+		return
+	}
+	// 密钥只能填入这些来源的页面，至少需要一个
+	var origins []string
+	for _, o := range req.Origins {
+		origin, err := normalizeOrigin(o)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		origins = append(origins, origin)
+	}
+	if len(origins) == 0 {
+		http.Error(w, "origins 不能为空", http.StatusBadRequest)
+		return
+	}
+	id := auth.Current(r)
+	secret := models.AutomationSecret{TenantID: id.TenantID, Name: req.Name}
+	if err := Db.Where(&secret).FirstOrInit(&secret).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if req.Value == "" && secret.ID == 0 {
+		http.Error(w, "value 不能为空", http.StatusBadRequest)
+		return
+	}
+	if req.Value != "" {
+		if err := sealSecret(&secret, req.Value); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	secret.Origins = strings.Join(origins, ",")
+	secret.UpdatedBy = id.Username
+	if err := Db.Save(&secret).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit.Record(r, models.AuditAutomation, "secret_save", secret.Name, models.AuditSuccess, secret.Origins)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(secret)
+}
+
+// delSecret 删除本租户的密钥，引用它的脚本在执行前报错
+func delSecret(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	result := Db.Where("tenant_id = ? AND name = ?", auth.Current(r).TenantID, name).Delete(&models.AutomationSecret{})
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "密钥不存在", http.StatusNotFound)
+		return
+	}
+	audit.Record(r, models.AuditAutomation, "secret_delete", name, models.AuditSuccess, "")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("密钥 %s 删除成功", name)))
+}
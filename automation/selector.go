@@ -0,0 +1,116 @@
+package automation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/dom"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+	"rbi/models"
+	"regexp"
+)
+
+// 可直接拼成 #id 的 CSS 选择器
+var elementID = regexp.MustCompile(`^#?-?[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// validateSelector 按类型检查选择器，CSS、XPath 和 JS path 在保存时只检查括号和引号，语法错误在执行时报告；
+// 含模板的选择器在执行时替换后再检查
+func validateSelector(a *models.Action) error {
+	if a.Selector == "" || hasTemplate(a.Selector) {
+		return nil
+	}
+	switch a.SelectorType {
+	case "", models.SelectorCSS, models.SelectorXPath, models.SelectorJSPath:
+		return checkBalanced(a.Selector)
+	case models.SelectorID:
+		if !elementID.MatchString(a.Selector) {
+			return fmt.Errorf("selector 不是合法的元素 id: %s", a.Selector)
+		}
+	case models.SelectorSearch:
+	default:
+		return fmt.Errorf("未知的 selectorType: %s，可选 css、xpath、id、search、jspath", a.SelectorType)
+	}
+	return nil
+}
+
+// checkBalanced 检查引号是否闭合，引号外的括号是否配对
+func checkBalanced(s string) error {
+	pairs := map[rune]rune{')': '(', ']': '[', '}': '{'}
+	var stack []rune
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'' || r == '`':
+			quote = r
+		case r == '(' || r == '[' || r == '{':
+			stack = append(stack, r)
+		case pairs[r] != 0:
+			if len(stack) == 0 || stack[len(stack)-1] != pairs[r] {
+				return fmt.Errorf("selector 中的 %c 没有配对: %s", r, s)
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if quote != 0 {
+		return fmt.Errorf("selector 中的引号没有闭合: %s", s)
+	}
+	if len(stack) > 0 {
+		return fmt.Errorf("selector 中的 %c 没有配对: %s", stack[len(stack)-1], s)
+	}
+	return nil
+}
+
+// selectorOption 选择器类型对应的 chromedp 查询方式
+func selectorOption(a *models.Action) chromedp.QueryOption {
+	switch a.SelectorType {
+	case models.SelectorXPath:
+		return byXPath(a.Selector)
+	case models.SelectorID:
+		return chromedp.ByID
+	case models.SelectorSearch:
+		return chromedp.BySearch
+	case models.SelectorJSPath:
+		return chromedp.ByJSPath
+	}
+	return chromedp.ByQuery
+}
+
+// jsString 转成 JS 字符串字面量
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// byXPath 取 XPath 匹配的第一个元素，未匹配时返回空，由 chromedp 继续等待
+func byXPath(expr string) chromedp.QueryOption {
+	script := fmt.Sprintf("document.evaluate(%s, document, null, XPathResult.FIRST_ORDERED_NODE_TYPE, null).singleNodeValue", jsString(expr))
+	return chromedp.ByFunc(func(ctx context.Context, _ *cdp.Node) ([]cdp.NodeID, error) {
+		v, exp, err := runtime.Evaluate(script).Do(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if exp != nil {
+			return nil, exp
+		}
+		if v.ObjectID == "" {
+			return []cdp.NodeID{}, nil
+		}
+		defer runtime.ReleaseObject(v.ObjectID).Do(ctx)
+		id, err := dom.RequestNode(v.ObjectID).Do(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return []cdp.NodeID{id}, nil
+	})
+}
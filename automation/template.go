@@ -0,0 +1,229 @@
+package automation
+
+import (
+	"errors"
+	"fmt"
+	"rbi/models"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// 模板引用：{{name}} 为运行参数或前面动作提取的变量，{{secret.name}} 为租户密钥
+var templateRef = regexp.MustCompile(`\{\{\s*(secret\.)?([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+func hasTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+// checkTemplate 去掉合法引用后不能再有 {{
+func checkTemplate(field, s string) error {
+	if strings.Contains(templateRef.ReplaceAllString(s, ""), "{{") {
+		return fmt.Errorf("%s 中的模板引用应为 {{name}} 或 {{secret.name}}", field)
+	}
+	return nil
+}
+
+// templateFields 动作中支持模板的字段
+func templateFields(a *models.Action) map[string]string {
+	return map[string]string{"selector": a.Selector, "value": a.Value, "url": a.URL}
+}
+
+// 可以引用密钥的动作，密钥只作为输入值填入页面
+var secretInputs = map[string]bool{
+	models.ActionSendKeys: true,
+	models.ActionSetValue: true,
+	models.ActionSelect:   true,
+}
+
+// checkSecretRefs 密钥不能出现在会执行的脚本、选择器和导航地址中，否则可以被读出或发送到其它站点
+func checkSecretRefs(a *models.Action) error {
+	for field, text := range templateFields(a) {
+		for _, m := range templateRef.FindAllStringSubmatch(text, -1) {
+			if m[1] != "" && (field != "value" || !secretInputs[a.ActionType]) {
+				return fmt.Errorf("%s 中不能引用密钥 %s，密钥只能用于 sendKeys、setValue、select 的 value", field, m[2])
+			}
+		}
+	}
+	return nil
+}
+
+// checkSecretScript 引用密钥的脚本不能包含 evaluate 和 jspath 选择器，否则可以在填入页面后再读出密钥
+func checkSecretScript(actions []models.Action) error {
+	secret, script := "", ""
+	for i := range actions {
+		a := &actions[i]
+		for _, m := range templateRef.FindAllStringSubmatch(a.Value, -1) {
+			if m[1] != "" && secret == "" {
+				secret = m[2]
+			}
+		}
+		if script == "" && (a.ActionType == models.ActionEvaluate || a.SelectorType == models.SelectorJSPath) {
+			script = fmt.Sprintf("第 %d 个动作 %s", i+1, a.ActionType)
+		}
+	}
+	if secret != "" && script != "" {
+		return fmt.Errorf("引用密钥 %s 的脚本不能使用 evaluate 或 jspath 选择器: %s", secret, script)
+	}
+	return nil
+}
+
+// executable 字段的内容会作为 JS 执行，替换的值按 JS 字符串字面量写入
+func executable(a *models.Action, field string) bool {
+	switch field {
+	case "value":
+		return a.ActionType == models.ActionEvaluate
+	case "selector":
+		return a.SelectorType == models.SelectorJSPath
+	}
+	return false
+}
+
+// templateScope 一次执行中可引用的值，Variables 随提取动作增加
+type templateScope struct {
+	params    map[string]string
+	variables map[string]string
+	secrets   map[string]secretValue
+}
+
+func (s *templateScope) lookup(secret bool, name string) (string, bool) {
+	if secret {
+		v, ok := s.secrets[name]
+		return v.value, ok
+	}
+	if v, ok := s.variables[name]; ok {
+		return v, true
+	}
+	v, ok := s.params[name]
+	return v, ok
+}
+
+// render 替换全部引用，引用不存在时报错，替换的值先经过 encode
+func (s *templateScope) render(text string, encode func(secret bool, v string) string) (string, error) {
+	var missing []string
+	out := templateRef.ReplaceAllStringFunc(text, func(ref string) string {
+		m := templateRef.FindStringSubmatch(ref)
+		v, ok := s.lookup(m[1] != "", m[2])
+		if !ok {
+			missing = append(missing, m[1]+m[2])
+		}
+		return encode(m[1] != "", v)
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("未定义的变量: %s", strings.Join(missing, ", "))
+	}
+	return out, nil
+}
+
+// resolve 返回替换了模板的动作副本。evaluate 的脚本和 jspath 选择器中替换为 JS 字符串字面量，
+// 模板应写成 document.title = {{name}}，不要再加引号，参数值不会被当作代码执行
+func (s *templateScope) resolve(a models.Action) (models.Action, error) {
+	fields := map[string]*string{"selector": &a.Selector, "value": &a.Value, "url": &a.URL}
+	for field, f := range fields {
+		if !hasTemplate(*f) {
+			continue
+		}
+		js := executable(&a, field)
+		// 提取的变量可能带有密钥的值，不能绕过 {{secret.name}} 的检查进入任何字段
+		leaked := false
+		rendered, err := s.render(*f, func(secret bool, v string) string {
+			if !secret && s.redact(v) != v {
+				leaked = true
+			}
+			if js {
+				return jsString(v)
+			}
+			return v
+		})
+		if err != nil {
+			return a, err
+		}
+		if leaked {
+			return a, fmt.Errorf("%s 引用的变量中包含密钥的值", field)
+		}
+		*f = rendered
+	}
+	return a, nil
+}
+
+// secretOrigins 动作引用的密钥共同允许的来源，没有引用密钥时返回 nil
+func (s *templateScope) secretOrigins(a *models.Action) ([]string, error) {
+	var allowed []string
+	for _, m := range templateRef.FindAllStringSubmatch(a.Value, -1) {
+		if m[1] == "" {
+			continue
+		}
+		origins := s.secrets[m[2]].origins
+		if len(origins) == 0 {
+			return nil, fmt.Errorf("密钥 %s 没有配置允许填入的来源", m[2])
+		}
+		if allowed == nil {
+			allowed = origins
+			continue
+		}
+		var both []string
+		for _, o := range allowed {
+			for _, p := range origins {
+				if o == p {
+					both = append(both, o)
+				}
+			}
+		}
+		if len(both) == 0 {
+			return nil, errors.New("value 中引用的密钥没有共同允许的来源")
+		}
+		allowed = both
+	}
+	return allowed, nil
+}
+
+// redact 把错误信息、返回的变量中的密钥值替换为 ***，长的先替换
+func (s *templateScope) redact(msg string) string {
+	values := make([]string, 0, len(s.secrets))
+	for _, v := range s.secrets {
+		if v.value != "" {
+			values = append(values, v.value)
+		}
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	for _, v := range values {
+		msg = strings.ReplaceAll(msg, v, "***")
+	}
+	return msg
+}
+
+// redactVariables 返回给调用者的变量，页面上读到的密钥值替换为 ***
+func (s *templateScope) redactVariables(vars map[string]string) map[string]string {
+	out := make(map[string]string, len(vars))
+	for k, v := range vars {
+		out[k] = s.redact(v)
+	}
+	return out
+}
+
+// checkRefs 执行前检查引用：参数和密钥必须存在，变量必须由前面的动作提取
+func (s *templateScope) checkRefs(actions []models.Action) error {
+	extracted := map[string]bool{}
+	for i := range actions {
+		a := &actions[i]
+		for field, text := range templateFields(a) {
+			for _, m := range templateRef.FindAllStringSubmatch(text, -1) {
+				secret, name := m[1] != "", m[2]
+				_, ok := s.lookup(secret, name)
+				if !secret && extracted[name] {
+					ok = true
+				}
+				if !ok {
+					return fmt.Errorf("第 %d 个动作 %s: %s 引用了未定义的变量 %s%s", i+1, a.ActionType, field, m[1], name)
+				}
+			}
+		}
+		switch a.ActionType {
+		case models.ActionText, models.ActionAttribute, models.ActionEvaluate:
+			if a.Variable != "" {
+				extracted[a.Variable] = true
+			}
+		}
+	}
+	return nil
+}
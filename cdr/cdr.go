@@ -0,0 +1,287 @@
+package cdr
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"rbi/config"
+	"rbi/convert"
+	"rbi/models"
+	"rbi/policy"
+	"rbi/sqlite"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var Db = sqlite.Db
+
+// Transformation 对文件实际执行的一次处理
+type Transformation struct {
+	Converter string `json:"converter"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	SHA256    string `json:"sha256"`
+}
+
+// Result 处理完成、等待放入容器的文件
+type Result struct {
+	Path   string
+	Name   string
+	Record *models.IngestedFile
+	dir    string
+}
+
+// Cleanup 删除中间文件
+func (r *Result) Cleanup() {
+	os.RemoveAll(r.dir)
+}
+
+// Attach 会话创建后关联导入记录
+func (r *Result) Attach(containerID string) {
+	r.Record.ContainerId = containerID
+	if err := Db.Save(r.Record).Error; err != nil {
+		log.Printf("Failed to save ingest record: %v", err)
+	}
+}
+
+// Ingest 为用户在服务端下载 fileURL，按 steps 依次执行 CDR 插件，下载地址和每次跳转按 tenantID 的 URL 策略检查
+func Ingest(ctx context.Context, userID int64, tenantID uint, fileURL string, steps []string) (*Result, error) {
+	conf := config.Config.Ingest
+	timeout := time.Duration(conf.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 2 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if conf.WorkDir != "" {
+		if err := os.MkdirAll(conf.WorkDir, 0o700); err != nil {
+			return nil, err
+		}
+	}
+	dir, err := os.MkdirTemp(conf.WorkDir, "ingest-")
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{dir: dir}
+
+	src, err := fetch(ctx, tenantID, fileURL, dir)
+	if err != nil {
+		result.Cleanup()
+		return nil, err
+	}
+	origSum, err := hashFile(src)
+	if err != nil {
+		result.Cleanup()
+		return nil, err
+	}
+
+	out, applied, err := Run(ctx, src, steps, dir)
+	if err != nil {
+		result.Cleanup()
+		return nil, err
+	}
+	sum := applied[len(applied)-1].SHA256
+
+	transformations, _ := json.Marshal(applied)
+	result.Path = out
+	result.Name = filepath.Base(out)
+	result.Record = &models.IngestedFile{
+		UserID:          userID,
+		TenantID:        tenantID,
+		SourceURL:       fileURL,
+		OrigName:        filepath.Base(src),
+		OrigSHA256:      origSum,
+		Name:            result.Name,
+		SHA256:          sum,
+		Transformations: string(transformations),
+	}
+	if err := Db.Create(result.Record).Error; err != nil {
+		log.Printf("Failed to save ingest record: %v", err)
+	}
+	log.Printf("Ingested %s as %s, transformations: %s", fileURL, result.Name, transformations)
+	return result, nil
+}
+
+// Run 依次执行插件，不接受当前文件的插件跳过，任何一步失败则整个导入失败。
+// 没有任何插件接受的文件未经处理，不能当作已处理的文件放入容器
+func Run(ctx context.Context, src string, steps []string, workDir string) (string, []Transformation, error) {
+	var applied []Transformation
+	current := src
+	for i, name := range steps {
+		c, ok := convert.Get(name)
+		if !ok {
+			return "", nil, fmt.Errorf("unknown CDR converter %q", name)
+		}
+		if !c.Accepts(filepath.Base(current)) {
+			continue
+		}
+		stepDir := filepath.Join(workDir, fmt.Sprintf("step%d", i+1))
+		if err := os.MkdirAll(stepDir, 0o700); err != nil {
+			return "", nil, err
+		}
+		out, err := c.Convert(ctx, current, stepDir)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: %v", name, err)
+		}
+		sum, err := hashFile(out)
+		if err != nil {
+			return "", nil, err
+		}
+		applied = append(applied, Transformation{
+			Converter: name,
+			From:      filepath.Base(current),
+			To:        filepath.Base(out),
+			SHA256:    sum,
+		})
+		current = out
+	}
+	if len(applied) == 0 {
+		return "", nil, fmt.Errorf("no CDR converter in %s accepts %s", strings.Join(steps, ","), filepath.Base(src))
+	}
+	return current, applied, nil
+}
+
+// 服务端下载不能访问的地址：回环、私有、链路本地、组播和运营商 NAT 地址
+var internalNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{"0.0.0.0/8", "100.64.0.0/10", "198.18.0.0/15", "240.0.0.0/4", "64:ff9b::/96"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+func internalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, n := range internalNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// denyInternal 在建立连接前检查解析后的地址，域名解析到内网地址或 DNS 重绑定都会被拒绝
+func denyInternal(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || internalIP(ip) {
+		return fmt.Errorf("connection to internal address %s is not allowed", host)
+	}
+	return nil
+}
+
+// newClient 服务端下载使用的客户端，不走环境变量中的代理，每次跳转都按租户的 URL 策略检查
+func newClient(tenantID uint) *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, Control: denyInternal}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return policy.CheckFor(tenantID, req.URL.String())
+		},
+	}
+}
+
+// fetch 下载文件到 dir，文件名取自 Content-Disposition 或 URL
+func fetch(ctx context.Context, tenantID uint, fileURL, dir string) (string, error) {
+	if err := policy.CheckFor(tenantID, fileURL); err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := newClient(tenantID).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetch %s: %s", fileURL, resp.Status)
+	}
+
+	name := fileName(resp, fileURL)
+	dst := filepath.Join(dir, name)
+	f, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	body := io.Reader(resp.Body)
+	max := config.Config.Ingest.MaxFileBytes
+	if max > 0 {
+		body = io.LimitReader(resp.Body, max+1)
+	}
+	n, err := io.Copy(f, body)
+	if err != nil {
+		return "", err
+	}
+	if max > 0 && n > max {
+		return "", fmt.Errorf("file exceeds %d bytes", max)
+	}
+	return dst, f.Close()
+}
+
+func fileName(resp *http.Response, fileURL string) string {
+	var name string
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+	if name == "" {
+		if u, err := url.Parse(fileURL); err == nil {
+			name, _ = url.PathUnescape(path.Base(u.Path))
+		}
+	}
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "" || name == "." || name == "/" {
+		name = "document-" + randHex(4)
+	}
+	return name
+}
+
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func randHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
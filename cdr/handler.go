@@ -0,0 +1,41 @@
+package cdr
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"rbi/auth"
+	"rbi/models"
+)
+
+func RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/ingest/list", listIngested).Methods(http.MethodGet)
+}
+
+// listIngested 查看导入文件经过的 CDR 处理，可按 session 过滤。
+// 普通用户只看到自己的记录，租户管理员看到本租户的记录
+func listIngested(w http.ResponseWriter, r *http.Request) {
+	id := auth.Current(r)
+	query := Db.Scopes(id.Scope).Order("created_at desc")
+	if !id.IsAdmin && !id.TenantAdmin {
+		query = query.Where("user_id = ?", id.UserID)
+	}
+	if session := r.URL.Query().Get("session"); session != "" {
+		var info models.ContainerInfo
+		if err := Db.Where("container_id = ?", session).First(&info).Error; err != nil ||
+			(info.UserID != int64(id.UserID) && !id.ManagesTenant(info.TenantID)) {
+			http.Error(w, "会话不存在", http.StatusNotFound)
+			return
+		}
+		query = query.Where("container_id = ?", session)
+	}
+	var files []models.IngestedFile
+	if err := query.Find(&files).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(files); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -6,9 +6,229 @@ import (
 )
 
 type ConfStructure struct {
-	TTLMinutes              int `yaml:"ttlMinutes"`
-	CheckIntervalSeconds    int `yaml:"checkIntervalSeconds"`
-	WsUpdateIntervalSeconds int `yaml:"wsUpdateIntervalSeconds"`
+	TTLMinutes              int            `yaml:"ttlMinutes"`
+	CheckIntervalSeconds    int            `yaml:"checkIntervalSeconds"`
+	WsUpdateIntervalSeconds int            `yaml:"wsUpdateIntervalSeconds"`
+	ExpiryWarningSeconds    int            `yaml:"expiryWarningSeconds"`
+	Rewrite                 RewriteConf    `yaml:"rewrite"`
+	CORS                    CORSConf       `yaml:"cors"`
+	Security                SecurityConf   `yaml:"security"`
+	Downloads               DownloadConf   `yaml:"downloads"`
+	Scanner                 ScannerConf    `yaml:"scanner"`
+	Convert                 ConvertConf    `yaml:"convert"`
+	Ingest                  IngestConf     `yaml:"ingest"`
+	Policy                  PolicyConf     `yaml:"policy"`
+	Egress                  EgressConf     `yaml:"egress"`
+	Auth                    AuthConf       `yaml:"auth"`
+	Password                PasswordConf   `yaml:"password"`
+	Lockout                 LockoutConf    `yaml:"lockout"`
+	Audit                   AuditConf      `yaml:"audit"`
+	Automation              AutomationConf `yaml:"automation"`
+}
+
+// RewriteConf 代理 HTML 改写配置
+type RewriteConf struct {
+	// 超过该大小(字节)的响应不做改写，0 表示不限制
+	MaxBodyBytes int64 `yaml:"maxBodyBytes"`
+	// 按顺序启用的改写插件
+	Transforms []string `yaml:"transforms"`
+}
+
+// CORSConf 跨域配置
+type CORSConf struct {
+	// 允许的来源，支持 https://*.example.com 形式的子域通配
+	AllowedOrigins   []string `yaml:"allowedOrigins"`
+	AllowCredentials bool     `yaml:"allowCredentials"`
+}
+
+// SecurityConf 安全响应头配置，留空的项不下发
+type SecurityConf struct {
+	// CSP 策略，{nonce} 会被替换为本次请求的 'nonce-xxx'
+	ContentSecurityPolicy string   `yaml:"contentSecurityPolicy"`
+	FrameAncestors        []string `yaml:"frameAncestors"`
+	HSTS                  string   `yaml:"hsts"`
+	ReferrerPolicy        string   `yaml:"referrerPolicy"`
+}
+
+// DownloadConf 会话文件下载网关配置
+type DownloadConf struct {
+	// 宿主机目录，每个会话一个子目录挂载到容器的 ContainerDir，留空则不开放下载
+	HostDir      string `yaml:"hostDir"`
+	ContainerDir string `yaml:"containerDir"`
+	// 通过检查、等待用户下载的文件存放目录
+	StoreDir    string `yaml:"storeDir"`
+	PollSeconds int    `yaml:"pollSeconds"`
+	// 单个文件大小上限(字节)，0 表示不限制
+	MaxFileBytes int64 `yaml:"maxFileBytes"`
+}
+
+// ScannerConf 文件扫描配置
+type ScannerConf struct {
+	// local 或 clamd
+	Engine         string   `yaml:"engine"`
+	ClamdNetwork   string   `yaml:"clamdNetwork"`
+	ClamdAddr      string   `yaml:"clamdAddr"`
+	TimeoutSeconds int      `yaml:"timeoutSeconds"`
+	DenySHA256     []string `yaml:"denySha256"`
+}
+
+// ConvertConf 文件转换使用的外部工具
+type ConvertConf struct {
+	SofficePath     string `yaml:"sofficePath"`
+	GhostscriptPath string `yaml:"ghostscriptPath"`
+	// flatten-pdf 渲染分辨率
+	FlattenDPI     int `yaml:"flattenDpi"`
+	TimeoutSeconds int `yaml:"timeoutSeconds"`
+}
+
+// IngestConf 文件导入(CDR)配置
+type IngestConf struct {
+	// 单个文件大小上限(字节)，0 表示不限制
+	MaxFileBytes   int64 `yaml:"maxFileBytes"`
+	TimeoutSeconds int   `yaml:"timeoutSeconds"`
+	// 处理中间文件的目录
+	WorkDir string `yaml:"workDir"`
+	// 处理后的文件放到容器内的目录
+	ContainerDir string `yaml:"containerDir"`
+}
+
+// PolicyConf URL 访问策略配置
+type PolicyConf struct {
+	// 没有规则命中时的动作，allow 或 deny
+	DefaultAction string `yaml:"defaultAction"`
+	// 会话启动时写入 Chromium 托管策略的目录，留空不写入
+	ChromiumPolicyDir string `yaml:"chromiumPolicyDir"`
+	// PAC 中被拒绝地址使用的代理，指向不可达地址
+	PacBlockProxy string `yaml:"pacBlockProxy"`
+}
+
+// EgressConf 会话容器的出口代理配置
+type EgressConf struct {
+	// 监听地址，留空不启动出口代理
+	Listen string `yaml:"listen"`
+	// 容器访问代理使用的地址，如 docker0 网桥地址
+	Advertise string `yaml:"advertise"`
+	// 不经过代理的地址，逗号分隔
+	NoProxy string `yaml:"noProxy"`
+	// 会话容器使用的 docker 网络，必须是 internal 网络，出口代理是唯一的出路
+	Network string `yaml:"network"`
+	// CONNECT 隧道允许的目标端口，留空只允许 443
+	ConnectPorts []int `yaml:"connectPorts"`
+}
+
+// AuthConf 登录会话配置
+type AuthConf struct {
+	TokenTTLMinutes int    `yaml:"tokenTtlMinutes"`
+	RefreshTTLHours int    `yaml:"refreshTtlHours"`
+	CookieName      string `yaml:"cookieName"`
+	// 仅通过 HTTPS 部署时开启
+	CookieSecure bool `yaml:"cookieSecure"`
+	// 按顺序尝试的登录后端：local、ldap
+	Backends []string `yaml:"backends"`
+	LDAP     LDAPConf `yaml:"ldap"`
+	OIDC     OIDCConf `yaml:"oidc"`
+	TOTP     TOTPConf `yaml:"totp"`
+	// API Key 的最长有效天数，0 为不限制且允许永不过期
+	APIKeyMaxDays int `yaml:"apiKeyMaxDays"`
+	// 受信任的反向代理 IP 或 CIDR，只有来自这些地址的请求才采信 X-Forwarded-For
+	TrustedProxies []string `yaml:"trustedProxies"`
+}
+
+// TOTPConf 两步验证配置
+type TOTPConf struct {
+	// 验证器 App 中显示的发行方名称
+	Issuer string `yaml:"issuer"`
+}
+
+// LDAPConf LDAP / Active Directory 登录配置
+type LDAPConf struct {
+	// ldap://host:389 或 ldaps://host:636
+	URL                string `yaml:"url"`
+	StartTLS           bool   `yaml:"startTls"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+	// 用于查找用户的服务账号，留空则匿名查找
+	BindDN       string `yaml:"bindDn"`
+	BindPassword string `yaml:"bindPassword"`
+	BaseDN       string `yaml:"baseDn"`
+	// {username} 会被替换为转义后的登录名，AD 可用 (sAMAccountName={username})
+	UserFilter     string `yaml:"userFilter"`
+	GroupAttribute string `yaml:"groupAttribute"`
+	// 组 DN 到角色名的映射，登录时整体同步用户角色
+	GroupRoles map[string][]string `yaml:"groupRoles"`
+	// 目录中存在但本地没有的用户登录时自动创建
+	Provision      bool `yaml:"provision"`
+	TimeoutSeconds int  `yaml:"timeoutSeconds"`
+}
+
+// OIDCConf OpenID Connect 单点登录配置
+type OIDCConf struct {
+	Enabled bool `yaml:"enabled"`
+	// 提供方地址，{issuer}/.well-known/openid-configuration 必须可访问
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"clientId"`
+	ClientSecret string `yaml:"clientSecret"`
+	// 提供方登录完成后回调的地址，指向本服务的 /oidc/callback
+	RedirectURL string   `yaml:"redirectUrl"`
+	Scopes      []string `yaml:"scopes"`
+	// 作为用户名的 claim，默认 preferred_username
+	UsernameClaim string `yaml:"usernameClaim"`
+	// 包含组或角色列表的 claim，支持 a.b 形式的嵌套路径
+	RolesClaim string `yaml:"rolesClaim"`
+	// claim 中的值到角色名的映射，登录时整体同步用户角色
+	ClaimRoles map[string][]string `yaml:"claimRoles"`
+	// 本地没有的用户登录时自动创建
+	Provision bool `yaml:"provision"`
+	// 登录完成后跳转的前端地址，会附带一次性的 ticket 参数
+	PostLoginRedirect string `yaml:"postLoginRedirect"`
+}
+
+// PasswordConf 密码策略
+type PasswordConf struct {
+	MinLength     int  `yaml:"minLength"`
+	RequireUpper  bool `yaml:"requireUpper"`
+	RequireLower  bool `yaml:"requireLower"`
+	RequireDigit  bool `yaml:"requireDigit"`
+	RequireSymbol bool `yaml:"requireSymbol"`
+	// 新密码不能与最近 History 次使用过的密码相同，0 表示不检查
+	History int `yaml:"history"`
+}
+
+// LockoutConf 登录失败锁定配置，阈值为 0 表示不限制
+type LockoutConf struct {
+	// 同一用户名、同一 IP 在 WindowMinutes 内允许的失败次数
+	MaxAttempts   int `yaml:"maxAttempts"`
+	IPMaxAttempts int `yaml:"ipMaxAttempts"`
+	WindowMinutes int `yaml:"windowMinutes"`
+	// 首次锁定时长，之后每次锁定翻倍，不超过 MaxLockMinutes
+	BaseLockSeconds int `yaml:"baseLockSeconds"`
+	MaxLockMinutes  int `yaml:"maxLockMinutes"`
+}
+
+// AuditConf 审计日志配置
+type AuditConf struct {
+	Syslog SyslogConf `yaml:"syslog"`
+}
+
+// AutomationConf 自动化脚本配置
+type AutomationConf struct {
+	// 加密租户密钥的 AES-256 密钥，base64 编码的 32 字节，可用 openssl rand -base64 32 生成；
+	// 留空时不能保存和使用密钥
+	SecretKey string `yaml:"secretKey"`
+	// 会话容器内 Chromium 远程调试端口，脚本只连接调用者自己会话的这个端口
+	DevToolsPort int `yaml:"devtoolsPort"`
+}
+
+// SyslogConf 审计事件按 RFC 5424 转发到外部 syslog
+type SyslogConf struct {
+	Enabled bool `yaml:"enabled"`
+	// udp 或 tcp，tcp 使用 RFC 6587 的长度前缀分帧
+	Network  string `yaml:"network"`
+	Address  string `yaml:"address"`
+	Facility int    `yaml:"facility"` // 默认 13 (log audit)
+	AppName  string `yaml:"appName"`
+	Hostname string `yaml:"hostname"` // 默认取本机名
+	// 等待发送的事件上限，receiver 不可用时超出的事件丢弃
+	QueueSize int `yaml:"queueSize"`
 }
 
 var Config = &ConfStructure{}
@@ -1,37 +1,54 @@
 package containers
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
+	crand "crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/api/types/strslice"
 	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
 	"github.com/gorilla/mux"
 	"gorm.io/gorm"
+	"io"
 	"log"
 	"math/rand"
 	"net"
 	"net/http"
+	"os"
+	"path"
+	"rbi/audit"
+	"rbi/auth"
+	"rbi/cdr"
 	config2 "rbi/config"
+	"rbi/downloads"
+	"rbi/egress"
+	"rbi/hub"
 	"rbi/models"
+	"rbi/policy"
+	"rbi/profile"
 	"rbi/sqlite"
+	"rbi/tenant"
+	"strings"
 	"time"
 )
 
 func RegisterRoutes(router *mux.Router) {
-	router.HandleFunc("/start", startContainer).Methods(http.MethodGet, http.MethodPost)
-	router.HandleFunc("/stop", stopContainer).Methods(http.MethodPost)
-	router.HandleFunc("/list", listContainer).Methods(http.MethodGet)
+	router.Handle("/start", auth.Require(models.PermContainerManage, startContainer)).Methods(http.MethodPost)
+	router.Handle("/stop", auth.Require(models.PermContainerManage, stopContainer)).Methods(http.MethodPost)
+	router.Handle("/list", auth.Require(models.PermContainerView, listContainer)).Methods(http.MethodGet)
 }
 
 const (
 	FileURL    = "fileUrl"
+	Profile    = "profile"
 	ByteLen    = 16
-	UserId     = "uid"
 	Connection = "Connection"
 	Upgrade    = "Upgrade"
 	// 定义端口范围
@@ -55,13 +72,13 @@ func InitTTLCheck() {
 			case <-ticker.C:
 				fmt.Println("定时检查ttl")
 				checkAndDeleteExpiredContainers()
+				warnExpiringContainers()
 			}
 		}
 	}()
 }
 
 type StartRequest struct {
-	UserId  string `json:"userId"`
 	FileUrl string `json:"fileUrl"`
 }
 
@@ -71,7 +88,13 @@ type StopRequest struct {
 
 func listContainer(w http.ResponseWriter, r *http.Request) {
 	var containers []models.ContainerInfo
-	if err := Db.Find(&containers).Error; err != nil {
+	// 全局管理员可以看到所有会话，租户管理员看到本租户的会话
+	id := auth.Current(r)
+	query := Db.Scopes(id.Scope)
+	if !id.IsAdmin && !id.TenantAdmin {
+		query = query.Where("user_id = ?", id.UserID)
+	}
+	if err := query.Find(&containers).Error; err != nil {
 		log.Fatal("failed to retrieve data: ", err)
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -84,12 +107,7 @@ func listContainer(w http.ResponseWriter, r *http.Request) {
 
 func startContainer(w http.ResponseWriter, r *http.Request) {
 	var req StartRequest
-	hasUid := getUid(r)
-	if hasUid != "" && len(hasUid) == ByteLen*2 { // ByteLen*2 for hex representation
-		req.UserId = hasUid
-	} else {
-		req.UserId = randUid(ByteLen)
-	}
+	id := auth.Current(r)
 
 	queryParams := r.URL.Query()
 	fileUrl := queryParams.Get(FileURL)
@@ -98,6 +116,35 @@ func startContainer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	req.FileUrl = fileUrl
+	if err := policy.CheckFor(id.TenantID, fileUrl); err != nil {
+		audit.Record(r, models.AuditSession, "session_start", fileUrl, models.AuditDenied, err.Error())
+		policy.WriteDenied(w, err.(*policy.DeniedError))
+		return
+	}
+	if err := tenant.CheckQuota(id.TenantID, tenant.QuotaContainers); err != nil {
+		audit.Record(r, models.AuditSession, "session_start", fileUrl, models.AuditDenied, err.Error())
+		tenant.WriteQuotaError(w, err)
+		return
+	}
+
+	sessionProfile, err := profile.ResolveFor(id.TenantID, queryParams.Get(Profile))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	// profile 配置了 CDR 时由服务端下载并处理文件，再放入容器
+	var ingested *cdr.Result
+	if steps := profile.CDRSteps(sessionProfile); len(steps) > 0 {
+		ingested, err = cdr.Ingest(ctx, int64(id.UserID), id.TenantID, req.FileUrl, steps)
+		if err != nil {
+			audit.Record(r, models.AuditFile, "ingest", req.FileUrl, models.AuditFailure, err.Error())
+			http.Error(w, fmt.Sprintf("Failed to ingest file: %s", err.Error()), http.StatusUnprocessableEntity)
+			return
+		}
+		defer ingested.Cleanup()
+	}
 
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
@@ -105,7 +152,12 @@ func startContainer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx := context.Background()
+	network, err := sessionNetwork(ctx, cli)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to prepare session network: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
 	startPort, endPort, err := generateRandomPortRange(minPort, maxPort, rangeSize)
 	if err != nil {
 		// if range fail re open it
@@ -132,6 +184,8 @@ func startContainer(w http.ResponseWriter, r *http.Request) {
 		fmt.Sprintf("NEKO_EPR=%d-%d", startPort, endPort),
 		"NEKO_NAT1TO1=202.63.172.204",
 	}
+	// 强制经过出口代理
+	env = append(env, egress.Env()...)
 
 	portBindings := make(nat.PortMap, 0)
 	exposedPorts := make(nat.PortSet, 0)
@@ -144,6 +198,27 @@ func startContainer(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	mounts := []mount.Mount{
+		{
+			Type:   mount.TypeBind,
+			Source: "/opt/neko/dist",
+			Target: "/var/www",
+		},
+	}
+	// 会话下载目录，由下载网关取走文件
+	downloadDir, err := downloads.SessionDir(sessionProfile)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to prepare download dir: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if downloadDir != "" {
+		mounts = append(mounts, mount.Mount{
+			Type:   mount.TypeBind,
+			Source: downloadDir,
+			Target: config2.Config.Downloads.ContainerDir,
+		})
+	}
+
 	//cwd, err := os.Getwd()
 	//if err != nil {
 	//	fmt.Println("Error getting current working directory:", err)
@@ -158,20 +233,16 @@ func startContainer(w http.ResponseWriter, r *http.Request) {
 		PortBindings: portBindings,
 		CapAdd:       strslice.StrSlice{"SYS_ADMIN"},
 		AutoRemove:   true,
-		Mounts: []mount.Mount{
-			{
-				Type:   mount.TypeBind,
-				Source: "/opt/neko/dist",
-				Target: "/var/www",
-			},
-		},
-	}, nil, nil, "neko_user_"+req.UserId)
+		Mounts:       mounts,
+		NetworkMode:  container.NetworkMode(network),
+	}, nil, nil, "neko_user_"+id.Key()+"_"+randUid(4))
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create Docker container: %s", err.Error()), http.StatusInternalServerError)
 		return
 	}
 
 	if err := cli.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+		audit.Record(r, models.AuditSession, "session_start", resp.ID, models.AuditFailure, err.Error())
 		http.Error(w, fmt.Sprintf("Failed to start Docker container %s", err.Error()), http.StatusInternalServerError)
 		return
 	}
@@ -184,6 +255,9 @@ func startContainer(w http.ResponseWriter, r *http.Request) {
 
 	// 获取容器的IP地址
 	containerIP := containerJSON.NetworkSettings.IPAddress
+	if ep, ok := containerJSON.NetworkSettings.Networks[network]; ok && network != "" {
+		containerIP = ep.IPAddress
+	}
 	if containerIP == "" {
 		fmt.Println("Container IP address not found")
 	} else {
@@ -197,13 +271,35 @@ func startContainer(w http.ResponseWriter, r *http.Request) {
 		ContainerId: resp.ID,
 		MinPort:     startPort,
 		IP:          containerIP,
+		UserID:      int64(id.UserID),
+		TenantID:    id.TenantID,
+		ProfileID:   sessionProfile.ID,
+		DownloadDir: downloadDir,
 		ExpireAt:    time.Now().Add(time.Duration(ttl) * time.Minute),
 	}
 	err = Db.Save(containerInfo).Error
 	if err != nil {
 		fmt.Println("Save ContainerInfo err:", err)
 	}
-	cmd := fmt.Sprintf("url=%s && filename=$(basename $url) && wget -O \"$filename\" $url && wps \"$filename\"", req.FileUrl)
+	exportPolicy(ctx, cli, resp.ID, id.TenantID)
+	audit.Record(r, models.AuditSession, "session_start", resp.ID, models.AuditSuccess,
+		fmt.Sprintf("profile=%s url=%s", sessionProfile.Name, req.FileUrl))
+	// fileUrl 通过了策略检查但仍是用户输入，必须整体转义后才能放进 shell 命令
+	cmd := fmt.Sprintf(`url=%s && filename=$(basename -- "$url") && wget -O "./$filename" -- "$url" && wps "./$filename"`, shellQuote(req.FileUrl))
+	if ingested != nil {
+		ingested.Attach(resp.ID)
+		audit.Record(r, models.AuditFile, "ingest", resp.ID, models.AuditSuccess,
+			fmt.Sprintf("%s via %s", ingested.Name, sessionProfile.IngestCDR))
+		dir := config2.Config.Ingest.ContainerDir
+		if dir == "" {
+			dir = "/tmp"
+		}
+		if err := copyToContainer(ctx, cli, resp.ID, dir, ingested.Path, ingested.Name); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to copy file into container: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		cmd = "wps " + shellQuote(path.Join(dir, ingested.Name))
+	}
 	execConfig := container.ExecOptions{
 		Cmd:          strslice.StrSlice{"bash", "-c", cmd},
 		AttachStdout: true,
@@ -229,12 +325,102 @@ func startContainer(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// copyToContainer 以 tar 流的方式把宿主机文件放入容器目录
+func copyToContainer(ctx context.Context, cli *client.Client, containerID, dir, src, name string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	// 容器内 neko 用户的 uid/gid
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: info.Size(), Uid: 1000, Gid: 1000, ModTime: info.ModTime()}); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, f); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return cli.CopyToContainer(ctx, containerID, dir, &buf, container.CopyToContainerOptions{})
+}
+
+// exportPolicy 把租户生效的 URL 策略写入容器的 Chromium 托管策略目录
+func exportPolicy(ctx context.Context, cli *client.Client, containerID string, tenantID uint) {
+	dir := config2.Config.Policy.ChromiumPolicyDir
+	if dir == "" {
+		return
+	}
+	p, err := policy.ChromiumFor(tenantID)
+	if err != nil {
+		log.Printf("Failed to export URL policy: %v", err)
+		return
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("Failed to export URL policy: %v", err)
+		return
+	}
+	f, err := os.CreateTemp("", "rbi-policy-*.json")
+	if err != nil {
+		log.Printf("Failed to export URL policy: %v", err)
+		return
+	}
+	defer os.Remove(f.Name())
+	f.Write(data)
+	f.Close()
+	if err := copyToContainer(ctx, cli, containerID, dir, f.Name(), "rbi-url-policy.json"); err != nil {
+		log.Printf("Failed to copy URL policy into container %s: %v", containerID, err)
+	}
+}
+
+// sessionNetwork 启用出口代理时会话容器所在的网络。网络必须是 internal，
+// 否则容器可以绕过代理直连外网，此时拒绝启动会话
+func sessionNetwork(ctx context.Context, cli *client.Client) (string, error) {
+	conf := config2.Config.Egress
+	if conf.Listen == "" {
+		return "", nil
+	}
+	if conf.Network == "" {
+		return "", fmt.Errorf("egress.network is not configured")
+	}
+	n, err := cli.NetworkInspect(ctx, conf.Network, network.InspectOptions{})
+	if err != nil {
+		return "", err
+	}
+	if !n.Internal {
+		return "", fmt.Errorf("network %s is not internal", conf.Network)
+	}
+	return conf.Network, nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
 func stopContainer(w http.ResponseWriter, r *http.Request) {
 	var req StopRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	var info models.ContainerInfo
+	if err := Db.Where("container_id = ?", req.ContainerID).First(&info).Error; err != nil {
+		http.Error(w, "Container not found", http.StatusNotFound)
+		return
+	}
+	// 会话所有者、全局管理员和本租户的租户管理员可以停止
+	if id := auth.Current(r); info.UserID != int64(id.UserID) && !id.ManagesTenant(info.TenantID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
 
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
@@ -265,13 +451,14 @@ func stopContainer(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Database transaction commit failed", http.StatusInternalServerError)
 		return
 	}
+	audit.Record(r, models.AuditSession, "session_stop", req.ContainerID, models.AuditSuccess, "")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Container stopped and removed successfully"))
 }
 
 func randUid(len int) string {
 	randomBytes := make([]byte, len)
-	_, err := rand.Read(randomBytes)
+	_, err := crand.Read(randomBytes)
 	if err != nil {
 		fmt.Println("Failed to generate random UID:", err)
 		return ""
@@ -279,15 +466,6 @@ func randUid(len int) string {
 	return hex.EncodeToString(randomBytes)
 }
 
-func getUid(r *http.Request) string {
-	c, err := r.Cookie(UserId)
-	if err != nil {
-		fmt.Println("Error retrieving UID from cookie:", err)
-		return ""
-	}
-	return c.Value
-}
-
 // 检查并删除过期容器
 func checkAndDeleteExpiredContainers() {
 	var expiredContainers []models.ContainerInfo
@@ -302,12 +480,55 @@ func checkAndDeleteExpiredContainers() {
 		if err := deleteDockerContainer(container.ContainerId); err != nil {
 			log.Printf("Error handling container %s: %v", container.ContainerId, err)
 		} else {
+			audit.Session(container.ContainerId, models.AuditSession, "session_expire", models.AuditSuccess, "ttl reached")
 			// 从数据库中删除容器记录
 			Db.Delete(&container)
 		}
 	}
 }
 
+// 向即将过期的会话推送提醒
+func warnExpiringContainers() {
+	window := config2.Config.ExpiryWarningSeconds
+	if window <= 0 {
+		window = checkInterval
+	}
+	now := time.Now()
+	var expiring []models.ContainerInfo
+	result := Db.Where("expire_at > ? AND expire_at <= ?", now, now.Add(time.Duration(window)*time.Second)).Find(&expiring)
+	if result.Error != nil {
+		log.Printf("Failed to fetch expiring containers: %v", result.Error)
+		return
+	}
+
+	for _, c := range expiring {
+		hub.SendToSession(c.ContainerId, hub.New(hub.TypeExpiryWarning, c.ContainerId, hub.ExpiryWarningData{
+			ExpireAt:         c.ExpireAt,
+			RemainingSeconds: int(c.ExpireAt.Sub(now).Seconds()),
+		}))
+	}
+}
+
+// StopUserContainers 停止用户的全部容器，用户停用时调用
+func StopUserContainers(userID uint) (int, error) {
+	var list []models.ContainerInfo
+	if err := Db.Where("user_id = ?", userID).Find(&list).Error; err != nil {
+		return 0, err
+	}
+	stopped := 0
+	var lastErr error
+	for _, c := range list {
+		if err := deleteDockerContainer(c.ContainerId); err != nil {
+			lastErr = err
+			continue
+		}
+		audit.Session(c.ContainerId, models.AuditSession, "session_stop", models.AuditSuccess, "owner deactivated")
+		Db.Delete(&c)
+		stopped++
+	}
+	return stopped, lastErr
+}
+
 func deleteDockerContainer(containerID string) error {
 	ctx := context.Background()
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
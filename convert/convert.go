@@ -0,0 +1,64 @@
+package convert
+
+import (
+	"context"
+	"path/filepath"
+	"rbi/config"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Converter 文件转换插件
+type Converter interface {
+	Name() string
+	// Accepts 判断是否能处理该文件名
+	Accepts(name string) bool
+	// Convert 转换 src，结果写入 dstDir，返回输出文件路径
+	Convert(ctx context.Context, src, dstDir string) (string, error)
+}
+
+var registry = struct {
+	m map[string]Converter
+	sync.RWMutex
+}{m: make(map[string]Converter)}
+
+// Register 注册转换插件，同名覆盖
+func Register(c Converter) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.m[c.Name()] = c
+}
+
+func Get(name string) (Converter, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	c, ok := registry.m[name]
+	return c, ok
+}
+
+// Names 返回已注册的插件名称
+func Names() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	names := make([]string, 0, len(registry.m))
+	for name := range registry.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WithTimeout 按 convert.timeoutSeconds 限制外部工具的执行时间
+func WithTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := time.Duration(config.Config.Convert.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 2 * time.Minute
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func ext(name string) string {
+	return strings.ToLower(filepath.Ext(name))
+}
@@ -0,0 +1,118 @@
+package convert
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+func init() {
+	Register(stripMacros{})
+}
+
+// 启用宏的格式去掉宏后对应的普通格式
+var macroFreeExt = map[string]string{
+	".docm": ".docx", ".dotm": ".dotx", ".docx": ".docx",
+	".xlsm": ".xlsx", ".xltm": ".xltx", ".xlsx": ".xlsx",
+	".pptm": ".pptx", ".potm": ".potx", ".ppsm": ".ppsx", ".pptx": ".pptx",
+}
+
+// 启用宏的主文档类型替换为普通类型
+var macroContentTypes = strings.NewReplacer(
+	"application/vnd.ms-word.document.macroEnabled.main+xml", "application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml",
+	"application/vnd.ms-word.template.macroEnabledTemplate.main+xml", "application/vnd.openxmlformats-officedocument.wordprocessingml.template.main+xml",
+	"application/vnd.ms-excel.sheet.macroEnabled.main+xml", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml",
+	"application/vnd.ms-excel.template.macroEnabled.main+xml", "application/vnd.openxmlformats-officedocument.spreadsheetml.template.main+xml",
+	"application/vnd.ms-powerpoint.presentation.macroEnabled.main+xml", "application/vnd.openxmlformats-officedocument.presentationml.presentation.main+xml",
+	"application/vnd.ms-powerpoint.template.macroEnabled.main+xml", "application/vnd.openxmlformats-officedocument.presentationml.template.main+xml",
+	"application/vnd.ms-powerpoint.slideshow.macroEnabled.main+xml", "application/vnd.openxmlformats-officedocument.presentationml.slideshow.main+xml",
+)
+
+var (
+	vbaContentType  = regexp.MustCompile(`<(Default|Override)[^>]*ContentType="application/vnd\.ms-office\.vba[^"]*"[^>]*/>`)
+	vbaRelationship = regexp.MustCompile(`<Relationship[^>]*Type="[^"]*/(vbaProject|wordVbaData|vbaProjectSignature[^"]*)"[^>]*/>`)
+)
+
+// stripMacros 删除 OOXML 文档中的 VBA 工程，输出不含宏的同类文档
+type stripMacros struct{}
+
+func (stripMacros) Name() string { return "strip-macros" }
+
+func (stripMacros) Accepts(name string) bool {
+	_, ok := macroFreeExt[ext(name)]
+	return ok
+}
+
+func (stripMacros) Convert(ctx context.Context, src, dstDir string) (string, error) {
+	zr, err := zip.OpenReader(src)
+	if err != nil {
+		return "", fmt.Errorf("open %s: %v", filepath.Base(src), err)
+	}
+	defer zr.Close()
+
+	base := strings.TrimSuffix(filepath.Base(src), filepath.Ext(src))
+	dst := filepath.Join(dstDir, base+macroFreeExt[ext(src)])
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	zw := zip.NewWriter(out)
+	for _, f := range zr.File {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if isVBAPart(f.Name) {
+			continue
+		}
+		if err := copyZipEntry(zw, f); err != nil {
+			return "", err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return dst, out.Close()
+}
+
+func isVBAPart(name string) bool {
+	base := strings.ToLower(filepath.Base(name))
+	return strings.HasPrefix(base, "vbaproject") || base == "vbadata.xml" || strings.HasPrefix(base, "vbaprojectsignature")
+}
+
+// copyZipEntry 复制条目，内容类型和关系文件中去掉宏的引用
+func copyZipEntry(zw *zip.Writer, f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	header := f.FileHeader
+	w, err := zw.CreateHeader(&header)
+	if err != nil {
+		return err
+	}
+
+	if f.Name != "[Content_Types].xml" && !strings.HasSuffix(f.Name, ".rels") {
+		_, err = io.Copy(w, rc)
+		return err
+	}
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	text := string(data)
+	if f.Name == "[Content_Types].xml" {
+		text = macroContentTypes.Replace(vbaContentType.ReplaceAllString(text, ""))
+	} else {
+		text = vbaRelationship.ReplaceAllString(text, "")
+	}
+	_, err = io.WriteString(w, text)
+	return err
+}
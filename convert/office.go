@@ -0,0 +1,43 @@
+package convert
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"rbi/config"
+	"strings"
+)
+
+func init() {
+	Register(officeToPDF{})
+}
+
+// LibreOffice 能打开的文档
+var officeExts = map[string]bool{
+	".doc": true, ".docx": true, ".docm": true, ".rtf": true, ".odt": true, ".wps": true,
+	".xls": true, ".xlsx": true, ".xlsm": true, ".ods": true, ".et": true, ".csv": true,
+	".ppt": true, ".pptx": true, ".pptm": true, ".odp": true, ".dps": true,
+}
+
+// officeToPDF 用 LibreOffice 把文档渲染为 PDF
+type officeToPDF struct{}
+
+func (officeToPDF) Name() string { return "pdf" }
+
+func (officeToPDF) Accepts(name string) bool { return officeExts[ext(name)] }
+
+func (officeToPDF) Convert(ctx context.Context, src, dstDir string) (string, error) {
+	ctx, cancel := WithTimeout(ctx)
+	defer cancel()
+	soffice := config.Config.Convert.SofficePath
+	if soffice == "" {
+		soffice = "soffice"
+	}
+	cmd := exec.CommandContext(ctx, soffice, "--headless", "--convert-to", "pdf", "--outdir", dstDir, src)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("soffice: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	base := strings.TrimSuffix(filepath.Base(src), filepath.Ext(src))
+	return filepath.Join(dstDir, base+".pdf"), nil
+}
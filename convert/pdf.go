@@ -0,0 +1,42 @@
+package convert
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"rbi/config"
+	"strings"
+)
+
+func init() {
+	Register(flattenPDF{})
+}
+
+// flattenPDF 用 Ghostscript 把每页渲染成图片再封装为 PDF，去掉脚本、表单和嵌入对象
+type flattenPDF struct{}
+
+func (flattenPDF) Name() string { return "flatten-pdf" }
+
+func (flattenPDF) Accepts(name string) bool { return ext(name) == ".pdf" }
+
+func (flattenPDF) Convert(ctx context.Context, src, dstDir string) (string, error) {
+	ctx, cancel := WithTimeout(ctx)
+	defer cancel()
+	gs := config.Config.Convert.GhostscriptPath
+	if gs == "" {
+		gs = "gs"
+	}
+	resolution := config.Config.Convert.FlattenDPI
+	if resolution <= 0 {
+		resolution = 150
+	}
+	base := strings.TrimSuffix(filepath.Base(src), filepath.Ext(src))
+	dst := filepath.Join(dstDir, base+".flat.pdf")
+	cmd := exec.CommandContext(ctx, gs, "-dSAFER", "-dBATCH", "-dNOPAUSE", "-q",
+		"-sDEVICE=pdfimage24", fmt.Sprintf("-r%d", resolution), "-o", dst, src)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("gs: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return dst, nil
+}
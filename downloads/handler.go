@@ -0,0 +1,64 @@
+package downloads
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"mime"
+	"net/http"
+	"os"
+	"rbi/audit"
+	"rbi/auth"
+	"rbi/models"
+)
+
+func RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/downloads/list", listDownloads).Methods(http.MethodGet)
+	router.HandleFunc("/downloads/file", downloadFile).Methods(http.MethodGet)
+}
+
+// listDownloads 列出当前用户的下载文件
+func listDownloads(w http.ResponseWriter, r *http.Request) {
+	uid := auth.Current(r).UserID
+	var files []models.DownloadFile
+	if err := Db.Where("user_id = ?", uid).Order("created_at desc").Find(&files).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(files); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// downloadFile 下载已通过检查的文件，只有会话所有者可以下载
+func downloadFile(w http.ResponseWriter, r *http.Request) {
+	uid := auth.Current(r).UserID
+	var file models.DownloadFile
+	if err := Db.Where("id = ? AND user_id = ?", r.URL.Query().Get("id"), uid).First(&file).Error; err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if file.Status != models.DownloadReady {
+		http.Error(w, fmt.Sprintf("File is %s", file.Status), http.StatusForbidden)
+		return
+	}
+
+	f, err := os.Open(file.StoredPath)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	event(&file, "downloaded", "by "+r.RemoteAddr)
+	audit.Record(r, models.AuditFile, "download", file.ContainerId, models.AuditSuccess, fmt.Sprintf("%s (%d bytes) sha256=%s", file.Name, file.Size, file.SHA256))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.Name}))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
@@ -0,0 +1,370 @@
+package downloads
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"rbi/audit"
+	"rbi/config"
+	"rbi/convert"
+	"rbi/hub"
+	"rbi/models"
+	"rbi/profile"
+	"rbi/scan"
+	"rbi/sqlite"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var Db = sqlite.Db
+
+// fileState 上一次轮询看到的文件状态，两次一致才认为写入完成
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+var seen = make(map[string]fileState)
+
+// SessionDir 为新会话创建宿主机下载目录，未开启下载或 profile 禁止下载时返回空
+func SessionDir(p models.SessionProfile) (string, error) {
+	root := config.Config.Downloads.HostDir
+	if root == "" || p.DownloadMode == models.DownloadDisabled {
+		return "", nil
+	}
+	dir := filepath.Join(root, "s_"+newID())
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	// 容器内以 neko 用户写入
+	if err := os.Chmod(dir, 0o777); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// InitWatcher 定时扫描各会话的下载目录
+func InitWatcher() {
+	conf := config.Config.Downloads
+	if conf.HostDir == "" {
+		return
+	}
+	interval := conf.PollSeconds
+	if interval <= 0 {
+		interval = 5
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	go func() {
+		for range ticker.C {
+			poll()
+		}
+	}()
+}
+
+func poll() {
+	root := config.Config.Downloads.HostDir
+	dirs, err := os.ReadDir(root)
+	if err != nil {
+		log.Printf("Failed to read download dir %s: %v", root, err)
+		return
+	}
+
+	present := make(map[string]bool)
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, d.Name())
+		var session models.ContainerInfo
+		if err := Db.Where("download_dir = ?", dir).First(&session).Error; err != nil {
+			// 会话已结束，清理目录
+			log.Printf("Removing download dir %s of finished session", dir)
+			os.RemoveAll(dir)
+			continue
+		}
+
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			log.Printf("Failed to read download dir %s: %v", dir, err)
+			continue
+		}
+		for _, f := range files {
+			if !f.Type().IsRegular() || isPartial(f.Name()) {
+				continue
+			}
+			path := filepath.Join(dir, f.Name())
+			info, err := f.Info()
+			if err != nil {
+				continue
+			}
+			present[path] = true
+			state := fileState{size: info.Size(), modTime: info.ModTime()}
+			if prev, ok := seen[path]; !ok || prev != state {
+				seen[path] = state
+				continue
+			}
+			delete(seen, path)
+			process(session, path)
+		}
+	}
+
+	for path := range seen {
+		if !present[path] {
+			delete(seen, path)
+		}
+	}
+}
+
+// isPartial 浏览器和办公软件写入中的临时文件
+func isPartial(name string) bool {
+	if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "~$") {
+		return true
+	}
+	for _, suffix := range []string{".crdownload", ".part", ".tmp", ".download"} {
+		if strings.HasSuffix(strings.ToLower(name), suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// process 取走文件，依次扫描、转换，最后提供给用户下载
+func process(session models.ContainerInfo, path string) {
+	file := &models.DownloadFile{
+		ID:          newID(),
+		ContainerId: session.ContainerId,
+		UserID:      session.UserID,
+		OrigName:    filepath.Base(path),
+		Name:        filepath.Base(path),
+		Status:      models.DownloadPending,
+	}
+	workDir := filepath.Join(config.Config.Downloads.StoreDir, file.ID)
+	if err := os.MkdirAll(workDir, 0o700); err != nil {
+		log.Printf("Failed to create %s: %v", workDir, err)
+		return
+	}
+	stored := filepath.Join(workDir, "original"+filepath.Ext(path))
+	f, info, err := moveFile(path, stored)
+	if err != nil {
+		log.Printf("Failed to pick up %s: %v", path, err)
+		os.RemoveAll(workDir)
+		return
+	}
+	defer f.Close()
+	file.Size = info.Size()
+	file.StoredPath = stored
+	if err := Db.Create(file).Error; err != nil {
+		log.Printf("Failed to save download record: %v", err)
+		return
+	}
+	event(file, "picked", fmt.Sprintf("%s (%d bytes) from session %s", file.OrigName, file.Size, file.ContainerId))
+
+	if max := config.Config.Downloads.MaxFileBytes; max > 0 && file.Size > max {
+		reject(file, models.DownloadBlocked, fmt.Sprintf("file exceeds %d bytes", max))
+		return
+	}
+	p := profile.ForContainer(session.ContainerId)
+	if p.DownloadMode == models.DownloadDisabled {
+		reject(file, models.DownloadBlocked, "downloads disabled by profile "+p.Name)
+		return
+	}
+
+	result, err := scanFile(f)
+	if err != nil {
+		reject(file, models.DownloadFailed, "scan failed: "+err.Error())
+		return
+	}
+	event(file, "scanned", fmt.Sprintf("engine=%s clean=%t %s", result.Engine, result.Clean, result.Signature))
+	if !result.Clean {
+		file.Signature = result.Signature
+		reject(file, models.DownloadInfected, result.Signature)
+		return
+	}
+
+	if p.DownloadMode == models.DownloadConvert {
+		c, ok := convert.Get(p.DownloadConverter)
+		if !ok || !c.Accepts(file.OrigName) {
+			reject(file, models.DownloadBlocked, fmt.Sprintf("profile %s requires conversion by %q, not supported for this file", p.Name, p.DownloadConverter))
+			return
+		}
+		// 转换器按文件名推断输出名，使用原始文件名
+		named := filepath.Join(workDir, file.OrigName)
+		if err := os.Rename(stored, named); err != nil {
+			reject(file, models.DownloadFailed, err.Error())
+			return
+		}
+		outDir := filepath.Join(workDir, "out")
+		os.MkdirAll(outDir, 0o700)
+		out, err := c.Convert(context.Background(), named, outDir)
+		os.Remove(named)
+		if err != nil {
+			reject(file, models.DownloadFailed, "convert failed: "+err.Error())
+			return
+		}
+		info, err := os.Stat(out)
+		if err != nil {
+			reject(file, models.DownloadFailed, "convert failed: "+err.Error())
+			return
+		}
+		file.Converter = c.Name()
+		file.StoredPath = out
+		file.Name = filepath.Base(out)
+		file.Size = info.Size()
+		event(file, "converted", fmt.Sprintf("%s -> %s by %s", file.OrigName, file.Name, c.Name()))
+	}
+
+	sum, err := hashFile(file.StoredPath)
+	if err != nil {
+		reject(file, models.DownloadFailed, err.Error())
+		return
+	}
+	file.SHA256 = sum
+	file.Status = models.DownloadReady
+	if err := Db.Save(file).Error; err != nil {
+		log.Printf("Failed to update download record %s: %v", file.ID, err)
+		return
+	}
+	event(file, "ready", "sha256="+sum)
+	notify(file)
+}
+
+// reject 删除文件并通知用户
+func reject(file *models.DownloadFile, status, reason string) {
+	os.RemoveAll(filepath.Join(config.Config.Downloads.StoreDir, file.ID))
+	file.Status = status
+	file.StoredPath = ""
+	if err := Db.Save(file).Error; err != nil {
+		log.Printf("Failed to update download record %s: %v", file.ID, err)
+	}
+	event(file, status, reason)
+	notify(file)
+}
+
+func notify(file *models.DownloadFile) {
+	data := hub.DownloadData{FileID: file.ID, Name: file.Name, Size: file.Size, Status: file.Status}
+	if file.Status == models.DownloadReady {
+		data.URL = "/downloads/file?id=" + file.ID
+	}
+	msg := hub.New(hub.TypeDownload, file.ContainerId, data)
+	if hub.SendToSession(file.ContainerId, msg) == 0 {
+		hub.SendToUser(strconv.FormatInt(file.UserID, 10), msg)
+	}
+}
+
+// event 记录下载网关的每一步
+func event(file *models.DownloadFile, step, detail string) {
+	log.Printf("Download %s [%s]: %s", file.ID, step, detail)
+	if err := Db.Create(&models.DownloadEvent{FileID: file.ID, Step: step, Detail: detail}).Error; err != nil {
+		log.Printf("Failed to save download event: %v", err)
+	}
+	// 中间步骤只留在下载事件中，审计记录最终结果
+	outcome := models.AuditDenied
+	switch step {
+	case models.DownloadReady:
+		outcome = models.AuditSuccess
+	case models.DownloadFailed:
+		outcome = models.AuditFailure
+	case models.DownloadInfected, models.DownloadBlocked:
+	default:
+		return
+	}
+	audit.Session(file.ContainerId, models.AuditFile, "download_"+step, outcome, file.OrigName+": "+detail)
+}
+
+// scanFile 扫描已打开的文件，不再按路径打开
+func scanFile(f *os.File) (scan.Result, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return scan.Result{}, err
+	}
+	return scan.FromConfig().Scan(context.Background(), f)
+}
+
+func hashFile(path string) (string, error) {
+	f, _, err := openRegular(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// openRegular 以 O_NOFOLLOW 打开普通文件，大小等信息取自打开的文件描述符。
+// 会话下载目录在容器内可写，文件随时可能被换成指向宿主机文件的符号链接、FIFO 或设备
+func openRegular(path string) (*os.File, os.FileInfo, error) {
+	before, err := os.Lstat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !before.Mode().IsRegular() {
+		return nil, nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	// O_NONBLOCK 避免打开前被换成 FIFO 时阻塞
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() || !os.SameFile(before, info) {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s changed while opening", path)
+	}
+	return f, info, nil
+}
+
+// moveFile 取走会话目录中的普通文件，返回打开的目标文件。rename 不跟随符号链接，
+// 移入私有目录后再按 openRegular 检查；跨文件系统时退化为复制后删除
+func moveFile(src, dst string) (*os.File, os.FileInfo, error) {
+	if info, err := os.Lstat(src); err != nil {
+		return nil, nil, err
+	} else if !info.Mode().IsRegular() {
+		return nil, nil, fmt.Errorf("%s is not a regular file", src)
+	}
+	if err := os.Rename(src, dst); err == nil {
+		f, info, err := openRegular(dst)
+		if err != nil {
+			os.Remove(dst)
+		}
+		return f, info, err
+	}
+	in, _, err := openRegular(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return nil, nil, err
+	}
+	if err := out.Close(); err != nil {
+		return nil, nil, err
+	}
+	if err := os.Remove(src); err != nil {
+		return nil, nil, err
+	}
+	return openRegular(dst)
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("Failed to generate id: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,66 @@
+package egress
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"rbi/auth"
+	"rbi/models"
+	"strconv"
+)
+
+func RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/history", listHistory).Methods(http.MethodGet)
+	router.HandleFunc("/history/recently", recentlyVisited).Methods(http.MethodGet)
+}
+
+func limit(r *http.Request, def int) int {
+	n, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || n <= 0 || n > 1000 {
+		return def
+	}
+	return n
+}
+
+// listHistory 当前用户会话的浏览记录，可按 session 过滤
+func listHistory(w http.ResponseWriter, r *http.Request) {
+	uid := auth.Current(r).UserID
+	query := Db.Where("user_id = ?", uid)
+	if session := r.URL.Query().Get("session"); session != "" {
+		query = query.Where("container_id = ?", session)
+	}
+	var logs []models.BrowsingLog
+	if err := query.Order("created_at desc").Limit(limit(r, 200)).Find(&logs).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(logs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+type recentSite struct {
+	Host      string `json:"host"`
+	Visits    int    `json:"visits"`
+	LastVisit string `json:"lastVisit"`
+}
+
+// recentlyVisited 最近访问过的站点，供 recently 页面使用
+func recentlyVisited(w http.ResponseWriter, r *http.Request) {
+	uid := auth.Current(r).UserID
+	var sites []recentSite
+	err := Db.Model(&models.BrowsingLog{}).
+		Select("host, count(*) as visits, max(created_at) as last_visit").
+		Where("user_id = ? AND allowed = ?", uid, true).
+		Group("host").Order("last_visit desc").Limit(limit(r, 50)).
+		Scan(&sites).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sites); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,238 @@
+package egress
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"rbi/config"
+	"rbi/models"
+	"rbi/policy"
+	"rbi/sqlite"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var Db = sqlite.Db
+
+// 逐跳头，不能转发给上游
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+var transport = &http.Transport{
+	Proxy:                 nil,
+	DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+// Start 启动出口代理
+func Start() {
+	addr := config.Config.Egress.Listen
+	if addr == "" {
+		return
+	}
+	go func() {
+		fmt.Println("Starting egress proxy on", addr)
+		if err := http.ListenAndServe(addr, http.HandlerFunc(serveProxy)); err != nil {
+			log.Println("Failed to start egress proxy:", err)
+		}
+	}()
+}
+
+// Env 容器需要的代理环境变量，未配置时为空。环境变量只是让浏览器走代理，
+// 真正阻止直连的是 Network 指定的 internal 网络
+func Env() []string {
+	conf := config.Config.Egress
+	if conf.Listen == "" || conf.Advertise == "" {
+		return nil
+	}
+	proxyURL := "http://" + conf.Advertise
+	env := []string{
+		"HTTP_PROXY=" + proxyURL, "HTTPS_PROXY=" + proxyURL,
+		"http_proxy=" + proxyURL, "https_proxy=" + proxyURL,
+	}
+	if conf.NoProxy != "" {
+		env = append(env, "NO_PROXY="+conf.NoProxy, "no_proxy="+conf.NoProxy)
+	}
+	return env
+}
+
+func serveProxy(w http.ResponseWriter, r *http.Request) {
+	session, ok := sessionFor(r.RemoteAddr)
+	if !ok {
+		// 只为会话容器提供代理
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	entry := &models.BrowsingLog{ContainerId: session.ContainerId, UserID: session.UserID, Method: r.Method}
+	target := r.URL.String()
+	if r.Method == http.MethodConnect {
+		entry.Host = r.Host
+		target = "https://" + r.Host
+		entry.URL = target
+		// 隧道内容不可见，只允许连到 HTTPS 端口，避免被当作任意 TCP 转发
+		if !connectAllowed(r.Host) {
+			entry.Status = http.StatusForbidden
+			record(entry)
+			http.Error(w, "CONNECT port not allowed", http.StatusForbidden)
+			return
+		}
+	} else {
+		entry.Host = r.URL.Host
+	}
+	entry.URL = target
+
+	d := policy.EvaluateFor(session.TenantID, target)
+	entry.Allowed = d.Allowed
+	if d.Rule != nil {
+		entry.RuleID = d.Rule.ID
+	}
+	if !d.Allowed {
+		entry.Status = http.StatusForbidden
+		record(entry)
+		http.Error(w, "Blocked by URL policy: "+d.Reason, http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		tunnel(w, r, entry)
+		return
+	}
+	forward(w, r, entry)
+}
+
+// connectAllowed CONNECT 目标端口是否在允许列表中
+func connectAllowed(hostport string) bool {
+	_, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	ports := config.Config.Egress.ConnectPorts
+	if len(ports) == 0 {
+		ports = []int{443}
+	}
+	for _, p := range ports {
+		if p == n {
+			return true
+		}
+	}
+	return false
+}
+
+// tunnel 处理 HTTPS 的 CONNECT 隧道
+func tunnel(w http.ResponseWriter, r *http.Request, entry *models.BrowsingLog) {
+	upstream, err := net.DialTimeout("tcp", r.Host, 30*time.Second)
+	if err != nil {
+		entry.Status = http.StatusBadGateway
+		record(entry)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	client, _, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		log.Println("Hijack:", err)
+		return
+	}
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		client.Close()
+		upstream.Close()
+		return
+	}
+	entry.Status = http.StatusOK
+
+	var wg sync.WaitGroup
+	var down int64
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(upstream, client)
+		closeWrite(upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		down, _ = io.Copy(client, upstream)
+		closeWrite(client)
+	}()
+	wg.Wait()
+	client.Close()
+	upstream.Close()
+	entry.Bytes = down
+	record(entry)
+}
+
+// forward 转发普通 HTTP 请求
+func forward(w http.ResponseWriter, r *http.Request, entry *models.BrowsingLog) {
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+	resp, err := transport.RoundTrip(out)
+	if err != nil {
+		entry.Status = http.StatusBadGateway
+		record(entry)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	n, _ := io.Copy(w, resp.Body)
+	entry.Status = resp.StatusCode
+	entry.Bytes = n
+	record(entry)
+}
+
+func closeWrite(c net.Conn) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.CloseWrite()
+	}
+}
+
+func record(entry *models.BrowsingLog) {
+	if err := Db.Create(entry).Error; err != nil {
+		log.Printf("Failed to save browsing log: %v", err)
+	}
+}
+
+// sessionFor 根据来源 IP 找到对应的会话容器
+func sessionFor(remoteAddr string) (models.ContainerInfo, bool) {
+	var session models.ContainerInfo
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		ip = remoteAddr
+	}
+	ip = strings.TrimPrefix(ip, "::ffff:")
+	if err := Db.Where("ip = ?", ip).First(&session).Error; err != nil {
+		return session, false
+	}
+	return session, true
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"github.com/gorilla/mux"
 	"net/http"
+	"rbi/audit"
+	"rbi/auth"
 	"rbi/models"
 	"rbi/sqlite"
 	"strconv"
@@ -14,8 +16,15 @@ var Db = sqlite.Db
 
 // RegisterRoutes 注册路由
 func RegisterRoutes(router *mux.Router) {
-	router.HandleFunc("/graph/update", updateGraph).Methods(http.MethodPost)
-	router.HandleFunc("/graph/get", getGraph).Methods(http.MethodGet)
+	router.Handle("/graph/update", auth.Require(models.PermGraphManage, updateGraph)).Methods(http.MethodPost)
+	router.Handle("/graph/get", auth.Require(models.PermGraphView, getGraph)).Methods(http.MethodGet)
+}
+
+// inScope 图数据跟随自动化脚本按租户隔离
+func inScope(r *http.Request, automationID int) bool {
+	var count int64
+	Db.Model(&models.Automation{}).Scopes(auth.Current(r).Scope).Where("automation_id = ?", automationID).Count(&count)
+	return count > 0
 }
 
 // updateGraph 处理函数，如果没有记录就新建，如果有就删了重新加入一条
@@ -27,6 +36,10 @@ func updateGraph(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "请求体解析失败", http.StatusBadRequest)
 		return
 	}
+	if !inScope(r, graphData.AutomationID) {
+		http.Error(w, "无法找到指定的 Automation", http.StatusNotFound)
+		return
+	}
 
 	// 查询数据库中是否已经存在该 AutomationID 的记录
 	var existingGraph models.GraphData
@@ -44,6 +57,7 @@ func updateGraph(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	audit.Record(r, models.AuditAutomation, "graph_update", strconv.Itoa(graphData.AutomationID), models.AuditSuccess, "")
 	// 返回成功信息
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(fmt.Sprintf("图结构更新成功, AutomationID: %d", graphData.AutomationID)))
@@ -58,6 +72,10 @@ func getGraph(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "无效的 Automation ID", http.StatusBadRequest)
 		return
 	}
+	if !inScope(r, automationID) {
+		http.Error(w, "未找到对应的图数据", http.StatusNotFound)
+		return
+	}
 
 	// 查询与该 AutomationID 相关的图数据
 	var graphData models.GraphData
@@ -0,0 +1,36 @@
+package hub
+
+import "sync"
+
+// HandlerFunc 处理客户端发来的某类消息，返回值非空时作为应答发回该连接
+type HandlerFunc func(c *Client, msg *Message) *Message
+
+var handlers = struct {
+	m map[string]HandlerFunc
+	sync.RWMutex
+}{m: make(map[string]HandlerFunc)}
+
+// Handle 注册某个消息类型的处理函数
+func Handle(typ string, fn HandlerFunc) {
+	handlers.Lock()
+	defer handlers.Unlock()
+	handlers.m[typ] = fn
+}
+
+// Dispatch 按类型分发客户端消息
+func Dispatch(c *Client, msg *Message) *Message {
+	if msg.Version != Version {
+		return Errorf(msg, "unsupported protocol version")
+	}
+	handlers.RLock()
+	fn, ok := handlers.m[msg.Type]
+	handlers.RUnlock()
+	if !ok {
+		return Errorf(msg, "unknown message type")
+	}
+	reply := fn(c, msg)
+	if reply != nil && reply.ID == "" {
+		reply.ID = msg.ID
+	}
+	return reply
+}
@@ -0,0 +1,171 @@
+package hub
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// Version 当前 /appws 消息协议版本
+const Version = 1
+
+// 消息类型
+const (
+	TypeKeepalive          = "keepalive"          // 客户端续期会话，服务端回复新的过期时间
+	TypeExpiryWarning      = "expiryWarning"      // 会话即将过期
+	TypeClipboard          = "clipboard"          // 剪贴板同步请求
+	TypeDownload           = "download"           // 会话内有文件可供下载
+	TypeAutomationProgress = "automationProgress" // 自动化脚本执行进度
+	TypeBroadcast          = "broadcast"          // 管理员广播
+	TypeError              = "error"
+)
+
+// Message /appws 上双向传输的消息
+type Message struct {
+	Version int    `json:"v"`
+	Type    string `json:"type"`
+	// 客户端请求带上 ID 时，应答原样带回
+	ID      string          `json:"id,omitempty"`
+	Session string          `json:"session,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Time    time.Time       `json:"time"`
+}
+
+// New 构造一条服务端消息
+func New(typ, session string, data interface{}) *Message {
+	msg := &Message{Version: Version, Type: typ, Session: session, Time: time.Now()}
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			log.Printf("Failed to encode %s message: %v", typ, err)
+		} else {
+			msg.Data = raw
+		}
+	}
+	return msg
+}
+
+// Errorf 构造一条错误应答
+func Errorf(req *Message, reason string) *Message {
+	msg := New(TypeError, req.Session, map[string]string{"type": req.Type, "error": reason})
+	msg.ID = req.ID
+	return msg
+}
+
+// Client 一条 /appws 连接
+type Client struct {
+	Session string
+	User    string
+	Send    chan []byte
+}
+
+// NewClient 创建客户端，Send 由连接的写协程消费
+func NewClient(session, user string) *Client {
+	return &Client{Session: session, User: user, Send: make(chan []byte, 16)}
+}
+
+// Hub 按会话和用户索引所有连接，用于服务端主动推送
+type Hub struct {
+	sessions map[string]map[*Client]struct{}
+	users    map[string]map[*Client]struct{}
+	sync.RWMutex
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		sessions: make(map[string]map[*Client]struct{}),
+		users:    make(map[string]map[*Client]struct{}),
+	}
+}
+
+// Default 全局 hub
+var Default = NewHub()
+
+func (h *Hub) Register(c *Client) {
+	h.Lock()
+	defer h.Unlock()
+	add(h.sessions, c.Session, c)
+	add(h.users, c.User, c)
+}
+
+func (h *Hub) Unregister(c *Client) {
+	h.Lock()
+	defer h.Unlock()
+	remove(h.sessions, c.Session, c)
+	remove(h.users, c.User, c)
+}
+
+// SendToSession 推送给某个会话的所有连接，返回送达的连接数
+func (h *Hub) SendToSession(session string, msg *Message) int {
+	h.RLock()
+	defer h.RUnlock()
+	return deliver(h.sessions[session], msg)
+}
+
+// SendToUser 推送给某个用户的所有连接
+func (h *Hub) SendToUser(user string, msg *Message) int {
+	h.RLock()
+	defer h.RUnlock()
+	return deliver(h.users[user], msg)
+}
+
+// Broadcast 推送给所有连接。不属于会话的用户级连接只在 users 中，两个索引合并去重后投递
+func (h *Hub) Broadcast(msg *Message) int {
+	h.RLock()
+	defer h.RUnlock()
+	all := make(map[*Client]struct{})
+	for _, index := range []map[string]map[*Client]struct{}{h.sessions, h.users} {
+		for _, clients := range index {
+			for c := range clients {
+				all[c] = struct{}{}
+			}
+		}
+	}
+	return deliver(all, msg)
+}
+
+func SendToSession(session string, msg *Message) int { return Default.SendToSession(session, msg) }
+func SendToUser(user string, msg *Message) int       { return Default.SendToUser(user, msg) }
+func Broadcast(msg *Message) int                     { return Default.Broadcast(msg) }
+
+func add(index map[string]map[*Client]struct{}, key string, c *Client) {
+	if key == "" {
+		return
+	}
+	if index[key] == nil {
+		index[key] = make(map[*Client]struct{})
+	}
+	index[key][c] = struct{}{}
+}
+
+func remove(index map[string]map[*Client]struct{}, key string, c *Client) {
+	if clients, ok := index[key]; ok {
+		delete(clients, c)
+		if len(clients) == 0 {
+			delete(index, key)
+		}
+	}
+}
+
+// deliver 非阻塞投递，写缓冲满的慢连接直接丢弃该消息
+func deliver(clients map[*Client]struct{}, msg *Message) int {
+	if len(clients) == 0 {
+		return 0
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to encode %s message: %v", msg.Type, err)
+		return 0
+	}
+	sent := 0
+	for c := range clients {
+		select {
+		case c.Send <- payload:
+			sent++
+		default:
+			log.Printf("Client of session %s is too slow, %s message dropped", c.Session, msg.Type)
+		}
+	}
+	return sent
+}
@@ -0,0 +1,48 @@
+package hub
+
+import "time"
+
+// KeepaliveData keepalive 应答
+type KeepaliveData struct {
+	ExpireAt time.Time `json:"expireAt"`
+}
+
+// ExpiryWarningData 会话即将过期提醒
+type ExpiryWarningData struct {
+	ExpireAt         time.Time `json:"expireAt"`
+	RemainingSeconds int       `json:"remainingSeconds"`
+}
+
+// ClipboardData 剪贴板同步请求，Direction 为 inbound(本地到会话) 或 outbound(会话到本地)。
+// 被策略拦截时 Status 为 blocked
+type ClipboardData struct {
+	Direction string `json:"direction"`
+	Text      string `json:"text,omitempty"`
+	Status    string `json:"status,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// DownloadData 文件下载通知
+type DownloadData struct {
+	FileID string `json:"fileId"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	URL    string `json:"url,omitempty"`
+	Status string `json:"status"`
+}
+
+// AutomationProgressData 自动化脚本执行进度
+type AutomationProgressData struct {
+	AutomationID int    `json:"automationId"`
+	Step         int    `json:"step"`
+	Total        int    `json:"total"`
+	ActionType   string `json:"actionType"`
+	Status       string `json:"status"` // running / done / failed
+	Error        string `json:"error,omitempty"`
+}
+
+// BroadcastData 管理员广播
+type BroadcastData struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
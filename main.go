@@ -1,33 +1,69 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
 	_ "github.com/mattn/go-sqlite3"
 	"net/http"
+	"os"
+	"rbi/audit"
+	"rbi/auth"
 	"rbi/automation"
+	"rbi/cdr"
 	"rbi/config"
 	"rbi/containers"
+	"rbi/downloads"
+	"rbi/egress"
 	"rbi/graph"
 	"rbi/middleware"
+	"rbi/policy"
+	"rbi/profile"
 	"rbi/proxy"
+	"rbi/tenant"
 	"rbi/user"
 )
 
 func main() {
 	// 读取配置文件
 	config.ReadConfig("config.yml")
+	// rbi verify-audit: 校验审计日志哈希链后退出，有断点时退出码为 1
+	if len(os.Args) > 1 && os.Args[1] == "verify-audit" {
+		verifyAudit()
+		return
+	}
+	// 审计哈希链和 syslog 转发
+	audit.Init()
+	// 默认租户
+	tenant.Seed()
+	// 默认角色、权限和菜单
+	user.Seed()
 	// 初始化 TTL 检查
 	containers.InitTTLCheck()
+	// 下载网关
+	downloads.InitWatcher()
+	// 会话出口代理
+	egress.Start()
 	// 设置路由
 	router := mux.NewRouter()
 	// 使用 CORS 中间件
 	router.Use(middleware.CORS)
+	// 安全响应头
+	router.Use(middleware.SecurityHeaders)
+	// 登录校验
+	router.Use(auth.Middleware)
 	// 注册
 	containers.RegisterRoutes(router)
 	user.RegisterRoutes(router)
+	tenant.RegisterRoutes(router)
+	audit.RegisterRoutes(router)
 	automation.RegisterRoutes(router)
 	graph.RegisterRoutes(router)
+	profile.RegisterRoutes(router)
+	downloads.RegisterRoutes(router)
+	cdr.RegisterRoutes(router)
+	policy.RegisterRoutes(router)
+	egress.RegisterRoutes(router)
 	proxy.RegisterRoutes(router)
 	// 启动服务
 	fmt.Println("Starting server on port 18083")
@@ -35,3 +71,17 @@ func main() {
 		fmt.Println("Failed to start server:", err)
 	}
 }
+
+func verifyAudit() {
+	report, err := audit.Verify()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to verify audit events:", err)
+		os.Exit(2)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	if !report.OK {
+		os.Exit(1)
+	}
+}
@@ -1,12 +1,26 @@
 package middleware
 
-import "net/http"
+import (
+	"net/http"
+	"net/url"
+	"rbi/config"
+	"strings"
+)
 
 func CORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		origin := r.Header.Get("Origin")
+		if origin != "" {
+			w.Header().Add("Vary", "Origin")
+		}
+		if origin != "" && OriginAllowed(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if config.Config.CORS.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		}
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
@@ -14,3 +28,25 @@ func CORS(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// OriginAllowed 判断来源是否在 config.yml 的 cors.allowedOrigins 白名单中
+func OriginAllowed(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return false
+	}
+	origin = strings.ToLower(u.Scheme + "://" + u.Host)
+	for _, allowed := range config.Config.CORS.AllowedOrigins {
+		allowed = strings.ToLower(strings.TrimSuffix(allowed, "/"))
+		if allowed == origin {
+			return true
+		}
+		// https://*.example.com 匹配任意子域
+		if scheme, host, ok := strings.Cut(allowed, "://*."); ok {
+			if u.Scheme == scheme && strings.HasSuffix(strings.ToLower(u.Host), "."+host) {
+				return true
+			}
+		}
+	}
+	return false
+}
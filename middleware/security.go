@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"rbi/config"
+	"strings"
+)
+
+type nonceKey struct{}
+
+// SecurityHeaders 下发 CSP、HSTS、Referrer-Policy 等安全响应头。
+// 每个请求生成一个 nonce 放入 context，代理注入的脚本通过 Nonce 取得同一个值
+func SecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conf := config.Config.Security
+		nonce := newNonce()
+
+		if csp := BuildCSP(nonce); csp != "" {
+			w.Header().Set("Content-Security-Policy", csp)
+		}
+		if conf.HSTS != "" && isHTTPS(r) {
+			w.Header().Set("Strict-Transport-Security", conf.HSTS)
+		}
+		if conf.ReferrerPolicy != "" {
+			w.Header().Set("Referrer-Policy", conf.ReferrerPolicy)
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), nonceKey{}, nonce)))
+	})
+}
+
+// Nonce 返回 SecurityHeaders 为当前请求生成的 nonce，未经过该中间件时为空
+func Nonce(ctx context.Context) string {
+	nonce, _ := ctx.Value(nonceKey{}).(string)
+	return nonce
+}
+
+// BuildCSP 根据配置拼出 Content-Security-Policy
+func BuildCSP(nonce string) string {
+	conf := config.Config.Security
+	var directives []string
+	if csp := strings.TrimSpace(conf.ContentSecurityPolicy); csp != "" {
+		directives = append(directives, strings.TrimSuffix(strings.ReplaceAll(csp, "{nonce}", "'nonce-"+nonce+"'"), ";"))
+	}
+	if len(conf.FrameAncestors) > 0 {
+		directives = append(directives, "frame-ancestors "+strings.Join(conf.FrameAncestors, " "))
+	}
+	return strings.Join(directives, "; ")
+}
+
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("Failed to generate nonce: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
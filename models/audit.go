@@ -0,0 +1,55 @@
+package models
+
+import (
+	"errors"
+	"gorm.io/gorm"
+	"time"
+)
+
+// 审计事件分类
+const (
+	AuditAuth       = "auth"       // 登录、登出、两步验证、API Key
+	AuditUser       = "user"       // 用户、角色、密码
+	AuditTenant     = "tenant"     // 租户和租户成员
+	AuditSession    = "session"    // 会话启动、停止、过期
+	AuditFile       = "file"       // 文件导入和下载
+	AuditClipboard  = "clipboard"  // 剪贴板传输
+	AuditAutomation = "automation" // 自动化脚本
+	AuditPolicy     = "policy"     // URL 策略和会话配置
+)
+
+// 审计事件结果
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+	AuditDenied  = "denied" // 被权限或策略拒绝
+)
+
+var ErrAuditAppendOnly = errors.New("audit events are append-only")
+
+// AuditEvent 审计事件，只追加不修改，写入时按顺序串成哈希链
+type AuditEvent struct {
+	ID        int64     `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"createdAt"`
+	Category  string    `gorm:"index" json:"category"`
+	Action    string    `gorm:"index" json:"action"`
+	// 操作者，未登录的请求(如登录失败)为尝试的用户名
+	ActorID  uint   `gorm:"index" json:"actorId"`
+	Actor    string `gorm:"index" json:"actor"`
+	TenantID uint   `gorm:"index" json:"tenantId"`
+	IP       string `json:"ip"`
+	// 操作对象，如用户名、会话 ID、脚本 ID、文件名
+	Target  string `gorm:"index" json:"target"`
+	Outcome string `gorm:"index" json:"outcome"`
+	Detail  string `gorm:"type:text" json:"detail"`
+	// 哈希链：Hash 覆盖上一条的 Hash 和本条内容，任何修改、删除或插入都会使后续校验失败
+	PrevHash string `json:"prevHash"`
+	Hash     string `gorm:"index" json:"hash"`
+}
+
+func (*AuditEvent) BeforeUpdate(*gorm.DB) error { return ErrAuditAppendOnly }
+func (*AuditEvent) BeforeDelete(*gorm.DB) error { return ErrAuditAppendOnly }
+
+func init() {
+	RegisterModel(&AuditEvent{})
+}
@@ -0,0 +1,88 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// AuthSession 登录会话，只保存令牌的哈希
+type AuthSession struct {
+	ID               int64  `gorm:"primaryKey"`
+	UserID           uint   `gorm:"index"`
+	TokenHash        string `gorm:"uniqueIndex"`
+	RefreshHash      string `gorm:"uniqueIndex"`
+	ExpiresAt        time.Time
+	RefreshExpiresAt time.Time
+	RevokedAt        *time.Time
+	IP               string
+	UserAgent        string `gorm:"type:text"`
+	CreatedAt        time.Time
+}
+
+// 认证日志事件
+const (
+	AuthLoginSuccess = "login_success"
+	AuthLoginFailed  = "login_failed"
+	AuthLoginLocked  = "login_locked"
+	AuthLogout       = "logout"
+	AuthUnlock       = "unlock"
+	AuthTOTPEnabled  = "totp_enabled"
+	AuthTOTPDisabled = "totp_disabled"
+	AuthTOTPRecovery = "totp_recovery" // 使用恢复码登录
+	AuthAPIKeyCreate = "apikey_create"
+	AuthAPIKeyRevoke = "apikey_revoke"
+	AuthUserDisabled = "user_disabled"
+	AuthUserEnabled  = "user_enabled"
+)
+
+// LoginThrottle 按用户名或 IP 统计的登录失败次数，Subject 形如 user:alice、ip:10.0.0.1
+type LoginThrottle struct {
+	Subject     string `gorm:"primaryKey"`
+	Failures    int
+	Lockouts    int // 连续锁定次数，决定下次锁定时长
+	FirstFailAt time.Time
+	LockedUntil time.Time
+	UpdatedAt   time.Time
+}
+
+// AuthLog 登录相关的审计记录
+type AuthLog struct {
+	ID        int64  `gorm:"primaryKey"`
+	Event     string `gorm:"index"`
+	Username  string `gorm:"index"`
+	UserID    uint
+	IP        string `gorm:"index"`
+	UserAgent string `gorm:"type:text"`
+	Reason    string
+	CreatedAt time.Time `gorm:"index"`
+}
+
+// APIKey 用户创建给脚本、CI 使用的密钥，只保存哈希，权限不超过 Scopes 和用户自身权限的交集
+type APIKey struct {
+	ID         int64      `gorm:"primaryKey" json:"id"`
+	UserID     uint       `gorm:"index" json:"userId"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // 密钥开头几位，便于辨认
+	KeyHash    string     `gorm:"uniqueIndex" json:"-"`
+	Scopes     string     `json:"scopes"` // 逗号分隔的权限标识
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	LastUsedIP string     `json:"lastUsedIp"`
+	RevokedAt  *time.Time `json:"revokedAt"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+// ScopeList 拆分 Scopes
+func (k *APIKey) ScopeList() []string {
+	if k.Scopes == "" {
+		return nil
+	}
+	return strings.Split(k.Scopes, ",")
+}
+
+func init() {
+	RegisterModel(&AuthSession{})
+	RegisterModel(&LoginThrottle{})
+	RegisterModel(&AuthLog{})
+	RegisterModel(&APIKey{})
+}
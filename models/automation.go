@@ -1,13 +1,18 @@
 package models
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 type Automation struct {
 	AutomationID int       `gorm:"primaryKey;autoIncrement"`
 	UserID       int       `gorm:"index;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	TenantID     uint      `gorm:"index"`
 	Name         string    `gorm:"type:text"`
 	Description  string    `gorm:"type:text"`
 	CreatedAt    time.Time `gorm:"type:datetime;default:CURRENT_TIMESTAMP"`
+	Archived     bool      `gorm:"index"`                   // 所有者停用时归档，不再列出和执行
 	Actions      []Action  `gorm:"foreignKey:AutomationID"` // 关联的 Actions
 }
 
@@ -16,12 +21,66 @@ type Action struct {
 	AutomationID int    `gorm:"index;foreignKey;references:AutomationID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
 	Sequence     int    `gorm:"not null"` // 动作执行顺序，非空
 	ActionType   string `gorm:"type:text;not null"`
-	Selector     string `gorm:"size:255"` // CSS选择器
-	Value        string `gorm:"size:255"` // 发送的键值
+	Selector     string `gorm:"size:255"` // 选择器，按 SelectorType 解释
+	SelectorType string `gorm:"size:16"`  // css(默认)、xpath、id、search、jspath
+	Value        string `gorm:"size:255"` // 发送的键值、选项值、JS 表达式、上传的文件名、按键名或滚动偏移 "x,y"
 	URL          string `gorm:"size:255"` // 导航URL
+	Attribute    string `gorm:"size:255"` // attribute 动作读取的属性名
+	Variable     string `gorm:"size:64"`  // text、attribute、evaluate 的结果存入的变量，screenshot、pdf 的文件名
+	Duration     int    // sleep 的毫秒数
 }
 
+// 动作类型
+const (
+	ActionNavigate       = "navigate"
+	ActionNavigateBack   = "navigateBack"
+	ActionWaitVisible    = "waitVisible"
+	ActionWaitNotVisible = "waitNotVisible"
+	ActionSleep          = "sleep"
+	ActionClick          = "click"
+	ActionSendKeys       = "sendKeys"
+	ActionKeyPress       = "keyPress"
+	ActionScroll         = "scroll"
+	ActionSelect         = "select"
+	ActionSetValue       = "setValue"
+	ActionUpload         = "upload"
+	ActionEvaluate       = "evaluate"
+	ActionText           = "text"
+	ActionAttribute      = "attribute"
+	ActionScreenshot     = "screenshot"
+	ActionPDF            = "pdf"
+)
+
+// AutomationSecret 租户的脚本密钥，动作中以 {{secret.name}} 引用，值只写不读
+type AutomationSecret struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	TenantID  uint      `gorm:"uniqueIndex:idx_secret_tenant_name" json:"tenantId"`
+	Name      string    `gorm:"uniqueIndex:idx_secret_tenant_name;size:64" json:"name"`
+	Value     string    `json:"-"`       // AES-GCM 加密后的值，密钥为 automation.secretKey
+	Origins   string    `json:"origins"` // 逗号分隔的来源，如 https://login.example.com，只填入这些来源的页面
+	UpdatedBy string    `json:"updatedBy"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// OriginList 拆分 Origins
+func (s *AutomationSecret) OriginList() []string {
+	if s.Origins == "" {
+		return nil
+	}
+	return strings.Split(s.Origins, ",")
+}
+
+// 选择器类型
+const (
+	SelectorCSS    = "css"    // document.querySelector
+	SelectorXPath  = "xpath"  // document.evaluate
+	SelectorID     = "id"     // 元素 id，可带 #
+	SelectorSearch = "search" // DevTools 搜索，匹配文本、CSS 或 XPath
+	SelectorJSPath = "jspath" // 返回元素的 JS 表达式，如 DevTools 中复制的 JS path
+)
+
 func init() {
 	RegisterModel(&Automation{})
 	RegisterModel(&Action{})
+	RegisterModel(&AutomationSecret{})
 }
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// BrowsingLog 会话经出口代理发出的一次请求
+type BrowsingLog struct {
+	ID          int64  `gorm:"primaryKey"`
+	ContainerId string `gorm:"index"`
+	UserID      int64  `gorm:"index"`
+	Method      string
+	Host        string `gorm:"index"`
+	URL         string `gorm:"type:text"`
+	Allowed     bool
+	RuleID      int
+	Status      int
+	Bytes       int64
+	CreatedAt   time.Time `gorm:"index"`
+}
+
+func init() {
+	RegisterModel(&BrowsingLog{})
+}
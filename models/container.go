@@ -7,8 +7,11 @@ type ContainerInfo struct {
 	ContainerId string
 	IP          string
 	Port        string
-	UserID      int64 `gorm:"foreignKey:UserID"`
-	MinPort     int   `gorm:"min_port"`
+	UserID      int64  `gorm:"foreignKey:UserID"`
+	TenantID    uint   `gorm:"index"`
+	MinPort     int    `gorm:"min_port"`
+	ProfileID   int    `gorm:"index"`
+	DownloadDir string // 挂载到容器下载目录的宿主机目录
 	ExpireAt    time.Time
 }
 
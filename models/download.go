@@ -0,0 +1,43 @@
+package models
+
+import "time"
+
+// 下载文件状态
+const (
+	DownloadPending  = "pending"
+	DownloadInfected = "infected"
+	DownloadBlocked  = "blocked"
+	DownloadFailed   = "failed"
+	DownloadReady    = "ready"
+)
+
+// DownloadFile 会话内产生、经过下载网关处理的文件
+type DownloadFile struct {
+	ID          string `gorm:"primaryKey"`
+	ContainerId string `gorm:"index"`
+	UserID      int64  `gorm:"index"`
+	Name        string // 提供给用户的文件名
+	OrigName    string
+	Size        int64
+	SHA256      string
+	Status      string `gorm:"index"`
+	Signature   string // 扫描命中的特征
+	Converter   string
+	StoredPath  string `json:"-"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// DownloadEvent 下载网关处理文件的每一步
+type DownloadEvent struct {
+	ID        int64  `gorm:"primaryKey"`
+	FileID    string `gorm:"index"`
+	Step      string // picked / scanned / converted / ready / downloaded ...
+	Detail    string `gorm:"type:text"`
+	CreatedAt time.Time
+}
+
+func init() {
+	RegisterModel(&DownloadFile{})
+	RegisterModel(&DownloadEvent{})
+}
@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// IngestedFile 导入会话的文件及其经过的 CDR 处理
+type IngestedFile struct {
+	ID          int64  `gorm:"primaryKey"`
+	ContainerId string `gorm:"index"`
+	UserID      int64  `gorm:"index"`
+	TenantID    uint   `gorm:"index"`
+	SourceURL   string `gorm:"type:text"`
+	OrigName    string
+	OrigSHA256  string
+	Name        string // 实际交给 wps 的文件名
+	SHA256      string
+	// 依次执行的处理，JSON 数组
+	Transformations string `gorm:"type:text"`
+	CreatedAt       time.Time
+}
+
+func init() {
+	RegisterModel(&IngestedFile{})
+}
@@ -0,0 +1,44 @@
+package models
+
+import "time"
+
+// 规则动作
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+// 规则匹配方式
+const (
+	PolicyDomain   = "domain"   // example.com，包含子域
+	PolicyWildcard = "wildcard" // *.example.com 或 example.com/docs/*
+	PolicyCategory = "category" // URLCategory 中的分类名
+	PolicyScheme   = "scheme"   // http / https / ftp / file ...
+)
+
+// PolicyRule URL 访问规则，按 Priority 从小到大匹配，第一条命中的规则生效。
+// 租户规则先于全局规则匹配
+type PolicyRule struct {
+	ID          int    `gorm:"primaryKey;autoIncrement"`
+	TenantID    uint   `gorm:"index"` // 0 为全局规则
+	Priority    int    `gorm:"index"`
+	Action      string `gorm:"type:text;not null"`
+	Kind        string `gorm:"type:text;not null"`
+	Pattern     string `gorm:"size:255;not null"`
+	Description string `gorm:"type:text"`
+	Disabled    bool
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// URLCategory 分类列表中的一个域名
+type URLCategory struct {
+	ID       int    `gorm:"primaryKey;autoIncrement"`
+	Category string `gorm:"index;not null"`
+	Domain   string `gorm:"index;not null"`
+}
+
+func init() {
+	RegisterModel(&PolicyRule{})
+	RegisterModel(&URLCategory{})
+}
@@ -0,0 +1,57 @@
+package models
+
+import "time"
+
+// 剪贴板方向策略
+const (
+	ClipboardDisabled = "disabled"
+	ClipboardInbound  = "inbound"  // 只允许本地粘贴到会话
+	ClipboardOutbound = "outbound" // 只允许从会话复制到本地
+	ClipboardBoth     = "both"
+)
+
+// 文件下载策略
+const (
+	DownloadDisabled = "disabled"
+	DownloadAllow    = "allow"   // 扫描通过后提供原文件
+	DownloadConvert  = "convert" // 扫描通过后按 DownloadConverter 转换
+)
+
+// SessionProfile 会话配置，决定隔离会话中数据的流转策略
+type SessionProfile struct {
+	ID        int    `gorm:"primaryKey;autoIncrement"`
+	Name      string `gorm:"unique;not null"`
+	IsDefault bool   // 启动会话未指定 profile 且租户没有默认 profile 时使用
+	TenantID  uint   `gorm:"index"` // 0 为所有租户共享
+	// 剪贴板
+	ClipboardMode     string `gorm:"type:text"`
+	ClipboardMaxBytes int    // 0 表示不限制
+	ClipboardRedact   string `gorm:"type:text"` // 需要打码的正则，每行一条
+	// 文件下载
+	DownloadMode      string `gorm:"type:text"`
+	DownloadConverter string `gorm:"type:text"` // convert 包中注册的插件名
+	// 文件导入前依次执行的 CDR 插件，逗号分隔，如 strip-macros,flatten-pdf
+	IngestCDR string `gorm:"type:text"`
+	// 水印，模板支持 {username} {time} {session} {ip}
+	WatermarkEnabled        bool
+	WatermarkTemplate       string `gorm:"type:text"`
+	WatermarkRefreshSeconds int
+	CreatedAt               time.Time
+	UpdatedAt               time.Time
+}
+
+type ClipboardLog struct {
+	ID          int64  `gorm:"primaryKey"`
+	ContainerId string `gorm:"index"`
+	User        string `gorm:"index"`
+	Direction   string
+	Bytes       int
+	Result      string // allowed / redacted / blocked
+	Reason      string
+	CreatedAt   time.Time
+}
+
+func init() {
+	RegisterModel(&SessionProfile{})
+	RegisterModel(&ClipboardLog{})
+}
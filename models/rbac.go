@@ -0,0 +1,54 @@
+package models
+
+import "time"
+
+// 权限标识
+const (
+	PermContainerView    = "container:view"
+	PermContainerManage  = "container:manage"
+	PermAutomationView   = "automation:view"
+	PermAutomationManage = "automation:manage"
+	PermAutomationRun    = "automation:run"
+	PermGraphView        = "graph:view"
+	PermGraphManage      = "graph:manage"
+	PermUserManage       = "user:manage"
+	PermAuditView        = "audit:view"
+)
+
+// Permission 权限，json 字段与前端 {label, value} 格式一致
+type Permission struct {
+	ID   uint   `gorm:"primaryKey" json:"id"`
+	Code string `gorm:"uniqueIndex;not null" json:"value"`
+	Name string `json:"label"`
+}
+
+// Role 角色，用户通过角色获得权限
+type Role struct {
+	ID          uint         `gorm:"primaryKey" json:"id"`
+	Name        string       `gorm:"uniqueIndex;not null" json:"name"`
+	Explain     string       `json:"explain"`
+	IsDefault   bool         `json:"isDefault"`   // 新注册用户自动获得
+	RequireTOTP bool         `json:"requireTotp"` // 拥有该角色的用户必须启用两步验证
+	Permissions []Permission `gorm:"many2many:role_permissions" json:"permissions"`
+	CreatedAt   time.Time    `json:"create_date"`
+}
+
+// Menu 前端菜单，Permission 为空时登录用户均可见
+type Menu struct {
+	ID         uint `gorm:"primaryKey"`
+	ParentID   uint `gorm:"index"`
+	Name       string
+	Path       string
+	Component  string // LAYOUT 或 views 下的页面路径，如 /container/index
+	Redirect   string
+	Title      string
+	Icon       string
+	Sort       int
+	Permission string
+}
+
+func init() {
+	RegisterModel(&Permission{})
+	RegisterModel(&Role{})
+	RegisterModel(&Menu{})
+}
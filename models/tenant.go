@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// DefaultTenantID 默认租户，自助注册和自动创建的用户归入该租户
+const DefaultTenantID uint = 1
+
+// Tenant 租户，用户、自动化脚本、会话和会话配置按租户隔离
+type Tenant struct {
+	ID      uint   `gorm:"primaryKey" json:"id"`
+	Name    string `gorm:"uniqueIndex;not null" json:"name"`
+	Explain string `json:"explain"`
+	// 配额，0 表示不限制
+	MaxUsers       int `json:"maxUsers"`
+	MaxContainers  int `json:"maxContainers"` // 同时运行的会话数
+	MaxAutomations int `json:"maxAutomations"`
+	// 启动会话未指定 profile 时使用，0 为全局默认 profile
+	DefaultProfileID int `json:"defaultProfileId"`
+	// URL 策略未命中任何规则时的动作，空为沿用全局配置
+	PolicyDefault string    `json:"policyDefault"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+func init() {
+	RegisterModel(&Tenant{})
+}
@@ -3,13 +3,60 @@ package models
 import "time"
 
 type User struct {
-	UserID    uint   `gorm:"primaryKey;autoIncrement"` // 主键，自增
-	Username  string `gorm:"unique"`                   // 用户名唯一
-	Password  string
-	IsAdmin   bool
-	CreatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP"`
+	UserID   uint   `gorm:"primaryKey;autoIncrement"` // 主键，自增
+	Username string `gorm:"unique"`                   // 用户名唯一
+	Password string
+	IsAdmin  bool   // 全局管理员，可以管理所有租户
+	Roles    []Role `gorm:"many2many:user_roles;joinForeignKey:UserID;joinReferences:RoleID"`
+	TenantID uint   `gorm:"index"`
+	// 租户管理员，只能管理本租户内的用户和资源
+	TenantAdmin bool
+	// 账号来源，空或 local 为本地账号，ldap 账号的密码由目录管理
+	Source     string `gorm:"index"`
+	ExternalID string // 目录中的 DN
+	// 管理员重置密码后，下次登录必须先修改密码
+	MustChangePassword bool
+	PasswordChangedAt  *time.Time
+	// 两步验证密钥在绑定时生成，校验过一次验证码后 TOTPEnabled 才为 true
+	TOTPSecret  string `json:"-"`
+	TOTPEnabled bool
+	// 最近一次通过校验的时间步，同一验证码不能重复使用
+	TOTPLastStep int64 `json:"-"`
+	// 停用时间，停用的账号不能登录，已有会话和 API Key 全部失效，可以重新启用
+	DisabledAt *time.Time
+	CreatedAt  time.Time `gorm:"default:CURRENT_TIMESTAMP"`
+}
+
+// Disabled 账号是否已停用
+func (u *User) Disabled() bool {
+	return u.DisabledAt != nil
+}
+
+// 账号来源
+const (
+	UserSourceLocal = "local"
+	UserSourceLDAP  = "ldap"
+	UserSourceOIDC  = "oidc"
+)
+
+// PasswordHistory 用户使用过的密码哈希，用于密码策略的历史检查
+type PasswordHistory struct {
+	ID        int64  `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index"`
+	Hash      string `json:"-"`
+	CreatedAt time.Time
+}
+
+// RecoveryCode 两步验证的恢复码，每个只能使用一次
+type RecoveryCode struct {
+	ID     int64  `gorm:"primaryKey"`
+	UserID uint   `gorm:"index"`
+	Hash   string `json:"-"`
+	UsedAt *time.Time
 }
 
 func init() {
 	RegisterModel(&User{})
+	RegisterModel(&PasswordHistory{})
+	RegisterModel(&RecoveryCode{})
 }
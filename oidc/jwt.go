@@ -0,0 +1,244 @@
+package oidc
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 支持的签名算法
+var algorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"PS256": crypto.SHA256,
+	"PS384": crypto.SHA384,
+	"PS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// ES 算法对应的曲线，RFC 7518 3.4
+var curves = map[string]string{
+	"ES256": "P-256",
+	"ES384": "P-384",
+	"ES512": "P-521",
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verifyJWT 校验 JWS 紧凑格式的签名并解析 payload
+func verifyJWT(ctx context.Context, raw string, keys *keySet) (Claims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("id token: malformed")
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("id token: header: %w", err)
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("id token: header: %w", err)
+	}
+	hash, ok := algorithms[header.Alg]
+	if !ok {
+		// 包括 none 和 HS*，ID Token 必须用提供方的私钥签名
+		return nil, fmt.Errorf("id token: unsupported alg %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("id token: signature: %w", err)
+	}
+
+	key, err := keys.get(ctx, header.Kid, header.Alg)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+	if err := verifySignature(header.Alg, hash, key, digest, sig); err != nil {
+		return nil, err
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("id token: payload: %w", err)
+	}
+	var claims Claims
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	if err := dec.Decode(&claims); err != nil {
+		return nil, fmt.Errorf("id token: payload: %w", err)
+	}
+	return claims, nil
+}
+
+func verifySignature(alg string, hash crypto.Hash, key crypto.PublicKey, digest, sig []byte) error {
+	invalid := errors.New("id token: invalid signature")
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			if rsa.VerifyPKCS1v15(k, hash, digest, sig) != nil {
+				return invalid
+			}
+			return nil
+		case "PS":
+			if rsa.VerifyPSS(k, hash, digest, sig, nil) != nil {
+				return invalid
+			}
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if alg[:2] != "ES" {
+			break
+		}
+		if k.Curve.Params().Name != curves[alg] {
+			return fmt.Errorf("id token: key curve %s does not match alg %s", k.Curve.Params().Name, alg)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return invalid
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return invalid
+		}
+		return nil
+	}
+	return fmt.Errorf("id token: key type does not match alg %s", alg)
+}
+
+// jwk JWKS 中的一个公钥
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// keySet 缓存提供方的 JWKS，遇到未知 kid 时重新拉取，最短间隔 refreshInterval
+type keySet struct {
+	uri     string
+	client  *http.Client
+	mu      sync.Mutex
+	keys    []jwk
+	fetched time.Time
+}
+
+const refreshInterval = time.Minute
+
+func (s *keySet) get(ctx context.Context, kid, alg string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key := s.find(kid, alg); key != nil {
+		return key, nil
+	}
+	if time.Since(s.fetched) < refreshInterval {
+		return nil, fmt.Errorf("id token: no key for kid %q", kid)
+	}
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := getJSON(ctx, s.client, s.uri, &doc); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+	s.keys, s.fetched = doc.Keys, time.Now()
+	if key := s.find(kid, alg); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("id token: no key for kid %q", kid)
+}
+
+// find 按 kid 查找签名公钥，token 未带 kid 时只接受唯一匹配的密钥
+func (s *keySet) find(kid, alg string) crypto.PublicKey {
+	var found []crypto.PublicKey
+	for _, k := range s.keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if k.Alg != "" && k.Alg != alg {
+			continue
+		}
+		if kid != "" && k.Kid != kid {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			found = append(found, key)
+		}
+	}
+	if len(found) != 1 {
+		return nil
+	}
+	return found[0]
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+			return nil, errors.New("jwk: bad exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("jwk: unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("jwk: point not on curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("jwk: unsupported kty %q", k.Kty)
+}
@@ -0,0 +1,277 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Config 客户端配置
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// Discovery .well-known/openid-configuration 中用到的字段
+type Discovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	AuthMethods           []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// Token 授权码换取的令牌
+type Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// Provider 一个 OpenID Connect 提供方
+type Provider struct {
+	conf      Config
+	discovery Discovery
+	client    *http.Client
+	keys      *keySet
+}
+
+// Discover 读取提供方的 discovery 文档，issuer 必须与配置一致
+func Discover(ctx context.Context, conf Config, client *http.Client) (*Provider, error) {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	wellKnown := strings.TrimSuffix(conf.Issuer, "/") + "/.well-known/openid-configuration"
+	var d Discovery
+	if err := getJSON(ctx, client, wellKnown, &d); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if d.Issuer != conf.Issuer {
+		return nil, fmt.Errorf("discovery: issuer %q does not match %q", d.Issuer, conf.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("discovery: missing endpoints")
+	}
+	return &Provider{conf: conf, discovery: d, client: client, keys: &keySet{uri: d.JWKSURI, client: client}}, nil
+}
+
+// AuthCodeURL 授权请求地址，使用 PKCE S256
+func (p *Provider) AuthCodeURL(state, nonce, verifier string) string {
+	scopes := p.conf.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.conf.ClientID},
+		"redirect_uri":          {p.conf.RedirectURL},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {Challenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.discovery.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.discovery.AuthorizationEndpoint + sep + q.Encode()
+}
+
+// Exchange 用授权码和 code_verifier 换取令牌
+func (p *Provider) Exchange(ctx context.Context, code, verifier string) (*Token, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.conf.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	basic := p.conf.ClientSecret != "" && p.supportsBasic()
+	if !basic {
+		form.Set("client_id", p.conf.ClientID)
+		if p.conf.ClientSecret != "" {
+			form.Set("client_secret", p.conf.ClientSecret)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if basic {
+		req.SetBasicAuth(url.QueryEscape(p.conf.ClientID), url.QueryEscape(p.conf.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("token: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token: %s: %s", resp.Status, body)
+	}
+	var t Token
+	if err := json.Unmarshal(body, &t); err != nil {
+		return nil, fmt.Errorf("token: %w", err)
+	}
+	if t.IDToken == "" {
+		return nil, errors.New("token: response has no id_token")
+	}
+	return &t, nil
+}
+
+// client_secret_basic 是规范默认值，提供方未声明时也使用
+func (p *Provider) supportsBasic() bool {
+	if len(p.discovery.AuthMethods) == 0 {
+		return true
+	}
+	for _, m := range p.discovery.AuthMethods {
+		if m == "client_secret_basic" {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify 校验 ID Token 的签名、issuer、audience、有效期和 nonce，返回全部 claims
+func (p *Provider) Verify(ctx context.Context, rawIDToken, nonce string) (Claims, error) {
+	claims, err := verifyJWT(ctx, rawIDToken, p.keys)
+	if err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != p.conf.Issuer {
+		return nil, fmt.Errorf("id token: issuer %q does not match", iss)
+	}
+	aud := claims.Strings("aud")
+	if !contains(aud, p.conf.ClientID) {
+		return nil, errors.New("id token: audience does not include client")
+	}
+	if azp, ok := claims["azp"].(string); ok && len(aud) > 1 && azp != p.conf.ClientID {
+		return nil, errors.New("id token: azp does not match client")
+	}
+	now := time.Now()
+	if exp, ok := claims.Time("exp"); !ok || now.After(exp.Add(clockSkew)) {
+		return nil, errors.New("id token: expired")
+	}
+	if nbf, ok := claims.Time("nbf"); ok && now.Add(clockSkew).Before(nbf) {
+		return nil, errors.New("id token: not yet valid")
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("id token: nonce mismatch")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("id token: missing sub")
+	}
+	return claims, nil
+}
+
+// 与提供方的时钟允许的误差
+const clockSkew = 2 * time.Minute
+
+// Claims ID Token 的 payload
+type Claims map[string]interface{}
+
+// String 取字符串 claim，支持 a.b 形式的嵌套路径
+func (c Claims) String(name string) string {
+	v, _ := c.lookup(name).(string)
+	return v
+}
+
+// Strings 取字符串或字符串数组 claim
+func (c Claims) Strings(name string) []string {
+	switch v := c.lookup(name).(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// Time 取 NumericDate claim
+func (c Claims) Time(name string) (time.Time, bool) {
+	switch v := c[name].(type) {
+	case float64:
+		return time.Unix(int64(v), 0), true
+	case json.Number:
+		n, err := v.Int64()
+		return time.Unix(n, 0), err == nil
+	}
+	return time.Time{}, false
+}
+
+func (c Claims) lookup(name string) interface{} {
+	var cur interface{} = map[string]interface{}(c)
+	for _, part := range strings.Split(name, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		cur = m[part]
+	}
+	return cur
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// RandomString 用于 state、nonce 和 code_verifier
+func RandomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Challenge PKCE S256 code_challenge
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func getJSON(ctx context.Context, client *http.Client, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
@@ -0,0 +1,219 @@
+package oidc_test
+
+import (
+	"context"
+	"crypto/elliptic"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"rbi/oidc"
+	"rbi/oidc/oidctest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const redirectURL = "https://rbi.example.com/oidc/callback"
+
+func newProvider(t *testing.T, iss *oidctest.Issuer) *oidc.Provider {
+	t.Helper()
+	p, err := oidc.Discover(context.Background(), oidc.Config{
+		Issuer:       iss.URL,
+		ClientID:     iss.ClientID,
+		ClientSecret: iss.ClientSecret,
+		RedirectURL:  redirectURL,
+	}, iss.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// authorize 模拟浏览器访问授权地址，返回回调中的 code 和 state
+func authorize(t *testing.T, iss *oidctest.Issuer, authURL string) (code, state string) {
+	t.Helper()
+	client := iss.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: %s", resp.Status)
+	}
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || !strings.HasPrefix(loc.String(), redirectURL) {
+		t.Fatalf("authorize redirected to %q", resp.Header.Get("Location"))
+	}
+	return loc.Query().Get("code"), loc.Query().Get("state")
+}
+
+// login 走完授权码流程，返回校验 ID Token 的结果
+func login(t *testing.T, iss *oidctest.Issuer) (oidc.Claims, error) {
+	t.Helper()
+	p := newProvider(t, iss)
+	state, nonce, verifier := oidc.RandomString(), oidc.RandomString(), oidc.RandomString()
+	code, gotState := authorize(t, iss, p.AuthCodeURL(state, nonce, verifier))
+	if gotState != state {
+		t.Fatalf("state %q, want %q", gotState, state)
+	}
+	token, err := p.Exchange(context.Background(), code, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.Verify(context.Background(), token.IDToken, nonce)
+}
+
+func TestDiscoverIssuerMismatch(t *testing.T) {
+	iss := oidctest.NewIssuer("rbi", "secret")
+	defer iss.Close()
+	_, err := oidc.Discover(context.Background(), oidc.Config{Issuer: iss.URL + "/other", ClientID: "rbi"}, iss.Client())
+	if err == nil {
+		t.Fatal("discovery of another issuer must fail")
+	}
+}
+
+func TestLogin(t *testing.T) {
+	for _, tc := range []struct {
+		alg string
+		ec  elliptic.Curve
+	}{{alg: "RS256"}, {alg: "PS256"}, {alg: "ES256", ec: elliptic.P256()}, {alg: "ES384", ec: elliptic.P384()}, {alg: "ES512", ec: elliptic.P521()}} {
+		t.Run(tc.alg, func(t *testing.T) {
+			iss := oidctest.NewIssuer("rbi", "secret")
+			defer iss.Close()
+			iss.Alg = tc.alg
+			if tc.ec != nil {
+				iss.Key = oidctest.NewECKey(tc.ec)
+			}
+			claims, err := login(t, iss)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.String("sub") != "user-1" || claims.String("preferred_username") != "sso-user" {
+				t.Fatalf("claims: %v", claims)
+			}
+		})
+	}
+}
+
+func TestPKCE(t *testing.T) {
+	iss := oidctest.NewIssuer("rbi", "secret")
+	defer iss.Close()
+	p := newProvider(t, iss)
+	verifier := oidc.RandomString()
+	code, _ := authorize(t, iss, p.AuthCodeURL("s", "n", verifier))
+	if _, err := p.Exchange(context.Background(), code, oidc.RandomString()); err == nil {
+		t.Fatal("exchange with another code_verifier must fail")
+	}
+	// 授权码只能使用一次
+	if _, err := p.Exchange(context.Background(), code, verifier); err == nil {
+		t.Fatal("authorization code reused")
+	}
+
+	u, _ := url.Parse(p.AuthCodeURL("s", "n", verifier))
+	if u.Query().Get("code_challenge") != oidc.Challenge(verifier) || u.Query().Get("code_challenge_method") != "S256" {
+		t.Fatalf("authorization request without S256 challenge: %s", u)
+	}
+}
+
+func TestStateAndNonce(t *testing.T) {
+	iss := oidctest.NewIssuer("rbi", "secret")
+	defer iss.Close()
+	p := newProvider(t, iss)
+	verifier := oidc.RandomString()
+	code, state := authorize(t, iss, p.AuthCodeURL("state-1", "nonce-1", verifier))
+	if state != "state-1" {
+		t.Fatalf("state %q not returned unchanged", state)
+	}
+	token, err := p.Exchange(context.Background(), code, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Verify(context.Background(), token.IDToken, "nonce-2"); err == nil || !strings.Contains(err.Error(), "nonce") {
+		t.Fatalf("nonce mismatch: got %v", err)
+	}
+	if _, err := p.Verify(context.Background(), token.IDToken, "nonce-1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClaimChecks(t *testing.T) {
+	for name, tc := range map[string]struct {
+		ttl    time.Duration
+		claims map[string]interface{}
+		want   string
+	}{
+		"expired":      {ttl: -time.Hour, want: "expired"},
+		"no exp":       {claims: map[string]interface{}{"exp": nil}, want: "expired"},
+		"not yet":      {claims: map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()}, want: "not yet valid"},
+		"issuer":       {claims: map[string]interface{}{"iss": "https://evil.example.com"}, want: "issuer"},
+		"audience":     {claims: map[string]interface{}{"aud": "other"}, want: "audience"},
+		"azp":          {claims: map[string]interface{}{"aud": []string{"rbi", "other"}, "azp": "other"}, want: "azp"},
+		"missing sub":  {claims: map[string]interface{}{"sub": nil}, want: "sub"},
+		"within skew":  {ttl: -time.Minute},
+		"multiple aud": {claims: map[string]interface{}{"aud": []string{"other", "rbi"}, "azp": "rbi"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			iss := oidctest.NewIssuer("rbi", "secret")
+			defer iss.Close()
+			if tc.ttl != 0 {
+				iss.TTL = tc.ttl
+			}
+			iss.Claims = tc.claims
+			_, err := login(t, iss)
+			switch {
+			case tc.want == "" && err != nil:
+				t.Fatal(err)
+			case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+				t.Fatalf("got %v, want error containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestBadSignature(t *testing.T) {
+	iss := oidctest.NewIssuer("rbi", "secret")
+	defer iss.Close()
+	p := newProvider(t, iss)
+	valid := iss.IDToken("n")
+	parts := strings.Split(valid, ".")
+
+	forged := oidctest.NewIssuer("rbi", "secret")
+	defer forged.Close()
+	forged.URL = iss.URL
+
+	// 篡改 payload
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	tampered := strings.Replace(string(payload), "sso-user", "admin", 1)
+	// alg 为 none 或 HS256 时用公钥当 HMAC 密钥的攻击
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"test"}`))
+	hs := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","kid":"test"}`))
+
+	for name, token := range map[string]string{
+		"tampered payload": parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(tampered)) + "." + parts[2],
+		"other key":        forged.IDToken("n"),
+		"truncated":        parts[0] + "." + parts[1] + "." + parts[2][:len(parts[2])-4],
+		"alg none":         none + "." + parts[1] + ".",
+		"alg HS256":        hs + "." + parts[1] + "." + parts[2],
+		"malformed":        parts[0] + "." + parts[1],
+	} {
+		if _, err := p.Verify(context.Background(), token, "n"); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	if _, err := p.Verify(context.Background(), valid, "n"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCurveMustMatchAlg(t *testing.T) {
+	// P-256 密钥声明为 ES384，签名本身可以通过校验，但曲线和算法不符必须拒绝
+	iss := oidctest.NewIssuer("rbi", "secret")
+	defer iss.Close()
+	iss.Alg = "ES384"
+	iss.Key = oidctest.NewECKey(elliptic.P256())
+	if _, err := login(t, iss); err == nil || !strings.Contains(err.Error(), "curve") {
+		t.Fatalf("got %v, want curve mismatch", err)
+	}
+}
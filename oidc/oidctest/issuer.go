@@ -0,0 +1,232 @@
+// Package oidctest 测试用的进程内 OpenID Connect 提供方，提供 discovery、授权、token 和 JWKS 端点
+package oidctest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Issuer 授权端点直接按请求签发授权码并跳回 redirect_uri，token 端点校验 PKCE 后签发 ID Token
+type Issuer struct {
+	*httptest.Server
+	ClientID     string
+	ClientSecret string
+	// 签名密钥和算法，Kid 为空时 JWKS 和 token 头都不带 kid
+	Key crypto.Signer
+	Alg string
+	Kid string
+	// 合并到 ID Token 中的 claim，值为 nil 时删除该 claim
+	Claims map[string]interface{}
+	// ID Token 的有效期，为负时签发已过期的令牌
+	TTL time.Duration
+
+	mu    sync.Mutex
+	codes map[string]authRequest
+}
+
+type authRequest struct {
+	redirectURI string
+	nonce       string
+	challenge   string
+}
+
+// NewIssuer 启动提供方，默认使用 RS256
+func NewIssuer(clientID, clientSecret string) *Issuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	i := &Issuer{ClientID: clientID, ClientSecret: clientSecret, Key: key, Alg: "RS256", Kid: "test", TTL: time.Hour,
+		codes: map[string]authRequest{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", i.discovery)
+	mux.HandleFunc("/authorize", i.authorize)
+	mux.HandleFunc("/token", i.token)
+	mux.HandleFunc("/jwks", i.jwks)
+	i.Server = httptest.NewServer(mux)
+	return i
+}
+
+func (i *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                i.URL,
+		"authorization_endpoint":                i.URL + "/authorize",
+		"token_endpoint":                        i.URL + "/token",
+		"jwks_uri":                              i.URL + "/jwks",
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic"},
+	})
+}
+
+func (i *Issuer) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != i.ClientID || q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" ||
+		q.Get("code_challenge") == "" || q.Get("redirect_uri") == "" {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+	code := randomString()
+	i.mu.Lock()
+	i.codes[code] = authRequest{redirectURI: q.Get("redirect_uri"), nonce: q.Get("nonce"), challenge: q.Get("code_challenge")}
+	i.mu.Unlock()
+	u, _ := url.Parse(q.Get("redirect_uri"))
+	back := u.Query()
+	back.Set("code", code)
+	back.Set("state", q.Get("state"))
+	u.RawQuery = back.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func (i *Issuer) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ParseForm() != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	} else {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	}
+	if id != i.ClientID || secret != i.ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	code := r.PostForm.Get("code")
+	i.mu.Lock()
+	req, ok := i.codes[code]
+	delete(i.codes, code)
+	i.mu.Unlock()
+	if r.PostForm.Get("grant_type") != "authorization_code" || !ok || r.PostForm.Get("redirect_uri") != req.redirectURI {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != req.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     i.IDToken(req.nonce),
+	})
+}
+
+func (i *Issuer) jwks(w http.ResponseWriter, r *http.Request) {
+	key := map[string]string{"use": "sig", "alg": i.Alg}
+	if i.Kid != "" {
+		key["kid"] = i.Kid
+	}
+	switch pub := i.Key.Public().(type) {
+	case *rsa.PublicKey:
+		key["kty"] = "RSA"
+		key["n"] = b64(pub.N.Bytes())
+		key["e"] = b64(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		key["kty"] = "EC"
+		key["crv"] = pub.Curve.Params().Name
+		key["x"] = b64(pub.X.FillBytes(make([]byte, size)))
+		key["y"] = b64(pub.Y.FillBytes(make([]byte, size)))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": []interface{}{key}})
+}
+
+// IDToken 按当前配置签发 ID Token
+func (i *Issuer) IDToken(nonce string) string {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":                i.URL,
+		"sub":                "user-1",
+		"aud":                i.ClientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(i.TTL).Unix(),
+		"nonce":              nonce,
+		"preferred_username": "sso-user",
+	}
+	for k, v := range i.Claims {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	return i.Sign(claims)
+}
+
+// Sign 用 Key 和 Alg 签名任意 payload
+func (i *Issuer) Sign(claims map[string]interface{}) string {
+	header := map[string]string{"alg": i.Alg, "typ": "JWT"}
+	if i.Kid != "" {
+		header["kid"] = i.Kid
+	}
+	h, _ := json.Marshal(header)
+	p, _ := json.Marshal(claims)
+	signing := b64(h) + "." + b64(p)
+	return signing + "." + b64(i.signature([]byte(signing)))
+}
+
+func (i *Issuer) signature(signing []byte) []byte {
+	hash := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[i.Alg[2:]]
+	h := hash.New()
+	h.Write(signing)
+	digest := h.Sum(nil)
+	var sig []byte
+	var err error
+	switch key := i.Key.(type) {
+	case *rsa.PrivateKey:
+		if i.Alg[:2] == "PS" {
+			sig, err = rsa.SignPSS(rand.Reader, key, hash, digest, nil)
+		} else {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
+		}
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest)
+		if err == nil {
+			size := (key.Curve.Params().BitSize + 7) / 8
+			sig = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+		}
+	}
+	if err != nil {
+		panic(err)
+	}
+	return sig
+}
+
+// NewECKey 生成 ES* 使用的密钥
+func NewECKey(curve elliptic.Curve) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return b64(b)
+}
@@ -0,0 +1,136 @@
+package policy
+
+import (
+	"fmt"
+	"rbi/config"
+	"rbi/models"
+	"sort"
+	"strings"
+)
+
+// ChromiumPolicy Chromium 托管策略中的 URL 过滤部分
+type ChromiumPolicy struct {
+	URLBlocklist []string `json:"URLBlocklist,omitempty"`
+	URLAllowlist []string `json:"URLAllowlist,omitempty"`
+}
+
+// Chromium 把全局规则导出为 Chromium 的 URL 过滤格式。
+// Chromium 按最具体的匹配而不是优先级裁决，无法表达的通配规则会被跳过
+func Chromium() (ChromiumPolicy, error) {
+	return ChromiumFor(0)
+}
+
+// ChromiumFor 导出租户生效的规则，规则之间的先后顺序无法在 Chromium 中表达，以出口代理的判定为准
+func ChromiumFor(tenantID uint) (ChromiumPolicy, error) {
+	var p ChromiumPolicy
+	set, err := load()
+	if err != nil {
+		return p, err
+	}
+	for _, r := range set.rules {
+		if !applies(&r, tenantID) {
+			continue
+		}
+		for _, filter := range set.chromiumFilters(r) {
+			if r.Action == models.PolicyAllow {
+				p.URLAllowlist = append(p.URLAllowlist, filter)
+			} else {
+				p.URLBlocklist = append(p.URLBlocklist, filter)
+			}
+		}
+	}
+	if set.defaultAction(tenantID) == models.PolicyDeny {
+		p.URLBlocklist = append(p.URLBlocklist, "*")
+	}
+	return p, nil
+}
+
+func (s *ruleSet) chromiumFilters(r models.PolicyRule) []string {
+	switch r.Kind {
+	case models.PolicyScheme:
+		return []string{r.Pattern + "://*"}
+	case models.PolicyDomain:
+		return []string{normalizeDomain(r.Pattern)}
+	case models.PolicyCategory:
+		return sortedDomains(s.categories[r.Pattern])
+	case models.PolicyWildcard:
+		// Chromium 的过滤本身包含子域且按路径前缀匹配，只支持开头的 *. 和结尾的 *
+		pattern := strings.TrimSuffix(strings.TrimPrefix(r.Pattern, "*."), "*")
+		if strings.ContainsAny(pattern, "*?") {
+			return nil
+		}
+		return []string{pattern}
+	}
+	return nil
+}
+
+// PAC 生成代理自动配置脚本，拒绝的地址指向 pacBlockProxy
+func PAC() (string, error) {
+	set, err := load()
+	if err != nil {
+		return "", err
+	}
+	block := config.Config.Policy.PacBlockProxy
+	if block == "" {
+		block = "PROXY 127.0.0.1:9"
+	}
+	allow := "DIRECT"
+
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\thost = host.toLowerCase();\n")
+	for _, r := range set.rules {
+		cond := set.pacCondition(r)
+		// PAC 供会话外的浏览器使用，只导出全局规则
+		if cond == "" || !applies(&r, 0) {
+			continue
+		}
+		result := allow
+		if r.Action == models.PolicyDeny {
+			result = block
+		}
+		fmt.Fprintf(&b, "\t// rule #%d %s %s %s\n", r.ID, r.Action, r.Kind, r.Pattern)
+		fmt.Fprintf(&b, "\tif (%s) return %q;\n", cond, result)
+	}
+	if defaultAction() == models.PolicyDeny {
+		fmt.Fprintf(&b, "\treturn %q;\n", block)
+	} else {
+		fmt.Fprintf(&b, "\treturn %q;\n", allow)
+	}
+	b.WriteString("}\n")
+	return b.String(), nil
+}
+
+func (s *ruleSet) pacCondition(r models.PolicyRule) string {
+	switch r.Kind {
+	case models.PolicyScheme:
+		return fmt.Sprintf("url.substring(0, %d).toLowerCase() == %q", len(r.Pattern)+1, r.Pattern+":")
+	case models.PolicyDomain:
+		return pacDomain(normalizeDomain(r.Pattern))
+	case models.PolicyCategory:
+		var conds []string
+		for _, d := range sortedDomains(s.categories[r.Pattern]) {
+			conds = append(conds, pacDomain(d))
+		}
+		return strings.Join(conds, " || ")
+	case models.PolicyWildcard:
+		if strings.Contains(r.Pattern, "/") {
+			return fmt.Sprintf("shExpMatch(url, %q)", "*://"+r.Pattern)
+		}
+		return fmt.Sprintf("shExpMatch(host, %q)", r.Pattern)
+	}
+	return ""
+}
+
+func pacDomain(domain string) string {
+	return fmt.Sprintf("(host == %q || dnsDomainIs(host, %q))", domain, "."+domain)
+}
+
+func sortedDomains(domains map[string]bool) []string {
+	list := make([]string, 0, len(domains))
+	for d := range domains {
+		list = append(list, d)
+	}
+	sort.Strings(list)
+	return list
+}
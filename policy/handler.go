@@ -0,0 +1,211 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"net/http"
+	"rbi/audit"
+	"rbi/auth"
+	"rbi/models"
+	"strconv"
+	"strings"
+)
+
+func RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/policy/rules", listRules).Methods(http.MethodGet)
+	router.HandleFunc("/policy/rules/save", saveRule).Methods(http.MethodPost)
+	router.HandleFunc("/policy/rules/delete", deleteRule).Methods(http.MethodPost)
+	router.HandleFunc("/policy/categories", listCategories).Methods(http.MethodGet)
+	router.Handle("/policy/categories/save", auth.RequireAdmin(saveCategory)).Methods(http.MethodPost)
+	router.Handle("/policy/categories/delete", auth.RequireAdmin(deleteCategory)).Methods(http.MethodPost)
+	router.HandleFunc("/policy/check", checkURL).Methods(http.MethodGet)
+	router.HandleFunc("/policy/pac", exportPAC).Methods(http.MethodGet)
+	router.HandleFunc("/policy/chromium", exportChromium).Methods(http.MethodGet)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// WriteDenied 以 403 返回被拒绝的 URL 及命中的规则
+func WriteDenied(w http.ResponseWriter, err *DeniedError) {
+	writeJSON(w, http.StatusForbidden, map[string]interface{}{
+		"error": err.Error(),
+		"url":   err.Decision.URL,
+		"rule":  err.Decision.Rule,
+	})
+}
+
+// listRules 全局管理员看到全部规则，其他人看到全局规则和本租户规则
+func listRules(w http.ResponseWriter, r *http.Request) {
+	var rules []models.PolicyRule
+	query := Db.Order("tenant_id desc, priority asc, id asc")
+	if id := auth.Current(r); !id.IsAdmin {
+		query = query.Where("tenant_id IN ?", []uint{0, id.TenantID})
+	}
+	if err := query.Find(&rules).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, rules)
+}
+
+// canEdit 全局规则只有全局管理员可以修改，租户规则由该租户的管理员修改
+func canEdit(id *auth.Identity, tenantID uint) bool {
+	if tenantID == 0 {
+		return id.IsAdmin
+	}
+	return id.ManagesTenant(tenantID)
+}
+
+// saveRule ID 为 0 时新建，否则整体更新。非全局管理员新建的规则属于自己的租户
+func saveRule(w http.ResponseWriter, r *http.Request) {
+	var rule models.PolicyRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id := auth.Current(r)
+	if !id.IsAdmin {
+		rule.TenantID = id.TenantID
+	}
+	if rule.ID != 0 {
+		var old models.PolicyRule
+		if err := Db.First(&old, rule.ID).Error; err != nil || !canEdit(id, old.TenantID) {
+			http.Error(w, "Rule not found", http.StatusNotFound)
+			return
+		}
+	}
+	if !canEdit(id, rule.TenantID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := Validate(&rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := Db.Save(&rule).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	Invalidate()
+	audit.Record(r, models.AuditPolicy, "rule_save", strconv.Itoa(rule.ID), models.AuditSuccess,
+		fmt.Sprintf("tenant=%d %s %s %s priority=%d disabled=%t", rule.TenantID, rule.Action, rule.Kind, rule.Pattern, rule.Priority, rule.Disabled))
+	writeJSON(w, http.StatusOK, rule)
+}
+
+func deleteRule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil || id <= 0 {
+		http.Error(w, "Invalid rule id", http.StatusBadRequest)
+		return
+	}
+	var rule models.PolicyRule
+	if err := Db.First(&rule, id).Error; err != nil || !canEdit(auth.Current(r), rule.TenantID) {
+		http.Error(w, "Rule not found", http.StatusNotFound)
+		return
+	}
+	if err := Db.Delete(&rule).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	Invalidate()
+	audit.Record(r, models.AuditPolicy, "rule_delete", strconv.Itoa(id), models.AuditSuccess,
+		fmt.Sprintf("tenant=%d %s %s %s", rule.TenantID, rule.Action, rule.Kind, rule.Pattern))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("Rule %d deleted", id)))
+}
+
+// listCategories 返回 分类 -> 域名列表
+func listCategories(w http.ResponseWriter, r *http.Request) {
+	var entries []models.URLCategory
+	if err := Db.Order("category, domain").Find(&entries).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	categories := make(map[string][]string)
+	for _, e := range entries {
+		categories[e.Category] = append(categories[e.Category], e.Domain)
+	}
+	writeJSON(w, http.StatusOK, categories)
+}
+
+type categoryRequest struct {
+	Category string   `json:"category"`
+	Domains  []string `json:"domains"`
+}
+
+// saveCategory 用请求中的域名替换整个分类
+func saveCategory(w http.ResponseWriter, r *http.Request) {
+	var req categoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Category == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	err := Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("category = ?", req.Category).Delete(&models.URLCategory{}).Error; err != nil {
+			return err
+		}
+		for _, d := range req.Domains {
+			if d = normalizeDomain(d); d == "" {
+				continue
+			}
+			if err := tx.Create(&models.URLCategory{Category: req.Category, Domain: d}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	Invalidate()
+	audit.Record(r, models.AuditPolicy, "category_save", req.Category, models.AuditSuccess, strings.Join(req.Domains, ","))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("Category %s saved", req.Category)))
+}
+
+func deleteCategory(w http.ResponseWriter, r *http.Request) {
+	category := r.URL.Query().Get("category")
+	if category == "" {
+		http.Error(w, "Missing 'category' parameter", http.StatusBadRequest)
+		return
+	}
+	if err := Db.Where("category = ?", category).Delete(&models.URLCategory{}).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	Invalidate()
+	audit.Record(r, models.AuditPolicy, "category_delete", category, models.AuditSuccess, "")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("Category %s deleted", category)))
+}
+
+// checkURL 查看某个 URL 的判定结果
+func checkURL(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, EvaluateFor(auth.Current(r).TenantID, r.URL.Query().Get("url")))
+}
+
+func exportPAC(w http.ResponseWriter, r *http.Request) {
+	pac, err := PAC()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Write([]byte(pac))
+}
+
+func exportChromium(w http.ResponseWriter, r *http.Request) {
+	p, err := Chromium()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
@@ -0,0 +1,257 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"rbi/config"
+	"rbi/models"
+	"rbi/sqlite"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var Db = sqlite.Db
+
+// Decision 一次策略判定的结果，Rule 为空表示使用默认动作
+type Decision struct {
+	URL     string             `json:"url"`
+	Allowed bool               `json:"allowed"`
+	Rule    *models.PolicyRule `json:"rule,omitempty"`
+	Reason  string             `json:"reason"`
+}
+
+// DeniedError URL 被策略拒绝
+type DeniedError struct {
+	Decision Decision
+}
+
+func (e *DeniedError) Error() string {
+	return e.Decision.Reason
+}
+
+// ruleSet 缓存的规则和分类，规则变更后重新加载
+type ruleSet struct {
+	rules      []models.PolicyRule        // 租户规则在前，全局规则在后，判定时全局的拒绝规则最先检查
+	categories map[string]map[string]bool // 分类 -> 域名
+	wildcards  map[int]*regexp.Regexp
+	defaults   map[uint]string // 租户覆盖的默认动作
+}
+
+// applies 规则是否对租户生效，tenantID 为 0 时只看全局规则
+func applies(r *models.PolicyRule, tenantID uint) bool {
+	return r.TenantID == 0 || r.TenantID == tenantID
+}
+
+var cache struct {
+	set *ruleSet
+	sync.RWMutex
+}
+
+// Invalidate 规则或分类修改后清空缓存
+func Invalidate() {
+	cache.Lock()
+	cache.set = nil
+	cache.Unlock()
+}
+
+func load() (*ruleSet, error) {
+	cache.RLock()
+	set := cache.set
+	cache.RUnlock()
+	if set != nil {
+		return set, nil
+	}
+
+	set = &ruleSet{categories: make(map[string]map[string]bool), wildcards: make(map[int]*regexp.Regexp), defaults: make(map[uint]string)}
+	if err := Db.Where("disabled = ?", false).Order("tenant_id desc, priority asc, id asc").Find(&set.rules).Error; err != nil {
+		return nil, err
+	}
+	var tenants []models.Tenant
+	if err := Db.Where("policy_default <> ''").Find(&tenants).Error; err != nil {
+		return nil, err
+	}
+	for _, t := range tenants {
+		set.defaults[t.ID] = t.PolicyDefault
+	}
+	var entries []models.URLCategory
+	if err := Db.Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if set.categories[e.Category] == nil {
+			set.categories[e.Category] = make(map[string]bool)
+		}
+		set.categories[e.Category][normalizeDomain(e.Domain)] = true
+	}
+	for _, r := range set.rules {
+		if r.Kind == models.PolicyWildcard {
+			set.wildcards[r.ID] = compileWildcard(r.Pattern)
+		}
+	}
+
+	cache.Lock()
+	cache.set = set
+	cache.Unlock()
+	return set, nil
+}
+
+// Evaluate 按全局规则判定 URL 是否允许访问
+func Evaluate(rawURL string) Decision {
+	return EvaluateFor(0, rawURL)
+}
+
+// EvaluateFor 按租户规则和全局规则判定 URL 是否允许访问。
+// 全局拒绝规则最先生效，租户的允许规则不能放行运维禁止的地址
+func EvaluateFor(tenantID uint, rawURL string) Decision {
+	d := Decision{URL: rawURL}
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || u.Scheme == "" {
+		d.Reason = fmt.Sprintf("invalid URL %q", rawURL)
+		return d
+	}
+	set, err := load()
+	if err != nil {
+		// 规则无法加载时拒绝，避免放行本应拦截的地址
+		d.Reason = "failed to load URL policy: " + err.Error()
+		return d
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	host := normalizeDomain(u.Hostname())
+	match := func(r *models.PolicyRule) Decision {
+		d.Allowed = r.Action == models.PolicyAllow
+		d.Rule = r
+		d.Reason = fmt.Sprintf("%s by rule #%d (%s %s)", r.Action, r.ID, r.Kind, r.Pattern)
+		return d
+	}
+	for i := range set.rules {
+		r := &set.rules[i]
+		if r.TenantID == 0 && r.Action == models.PolicyDeny && set.matches(r, scheme, host, u) {
+			return match(r)
+		}
+	}
+	for i := range set.rules {
+		r := &set.rules[i]
+		if applies(r, tenantID) && set.matches(r, scheme, host, u) {
+			return match(r)
+		}
+	}
+
+	action := set.defaultAction(tenantID)
+	d.Allowed = action == models.PolicyAllow
+	d.Reason = action + " by default policy"
+	return d
+}
+
+// Check 被拒绝时返回 *DeniedError
+func Check(rawURL string) error {
+	return CheckFor(0, rawURL)
+}
+
+// CheckFor 按租户策略检查，被拒绝时返回 *DeniedError
+func CheckFor(tenantID uint, rawURL string) error {
+	d := EvaluateFor(tenantID, rawURL)
+	if d.Allowed {
+		return nil
+	}
+	d.Reason = fmt.Sprintf("URL %s %s", rawURL, d.Reason)
+	return &DeniedError{Decision: d}
+}
+
+func (s *ruleSet) matches(r *models.PolicyRule, scheme, host string, u *url.URL) bool {
+	switch r.Kind {
+	case models.PolicyScheme:
+		return strings.EqualFold(r.Pattern, scheme)
+	case models.PolicyDomain:
+		return domainMatch(host, normalizeDomain(r.Pattern))
+	case models.PolicyWildcard:
+		re := s.wildcards[r.ID]
+		if re == nil {
+			return false
+		}
+		if strings.Contains(r.Pattern, "/") {
+			return re.MatchString(host + u.EscapedPath())
+		}
+		return re.MatchString(host)
+	case models.PolicyCategory:
+		domains := s.categories[r.Pattern]
+		for d := host; d != ""; d = parentDomain(d) {
+			if domains[d] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Validate 检查规则字段
+func Validate(r *models.PolicyRule) error {
+	if r.Action != models.PolicyAllow && r.Action != models.PolicyDeny {
+		return fmt.Errorf("action must be %s or %s", models.PolicyAllow, models.PolicyDeny)
+	}
+	r.Pattern = strings.TrimSpace(r.Pattern)
+	if r.Pattern == "" {
+		return fmt.Errorf("pattern is required")
+	}
+	switch r.Kind {
+	case models.PolicyDomain, models.PolicyCategory:
+	case models.PolicyScheme:
+		r.Pattern = strings.TrimSuffix(strings.ToLower(r.Pattern), "://")
+	case models.PolicyWildcard:
+		r.Pattern = strings.ToLower(r.Pattern)
+	default:
+		return fmt.Errorf("unknown rule kind %q", r.Kind)
+	}
+	return nil
+}
+
+// defaultAction 租户设置了默认动作时优先使用
+func (s *ruleSet) defaultAction(tenantID uint) string {
+	if action, ok := s.defaults[tenantID]; ok && tenantID != 0 {
+		return action
+	}
+	return defaultAction()
+}
+
+func defaultAction() string {
+	if config.Config.Policy.DefaultAction == models.PolicyDeny {
+		return models.PolicyDeny
+	}
+	return models.PolicyAllow
+}
+
+func domainMatch(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+func parentDomain(host string) string {
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+	_, parent, _ := strings.Cut(host, ".")
+	return parent
+}
+
+func normalizeDomain(d string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.ToLower(strings.TrimSpace(d)), "."), ".")
+}
+
+// compileWildcard * 匹配任意字符，? 匹配单个字符
+func compileWildcard(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
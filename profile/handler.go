@@ -0,0 +1,250 @@
+package profile
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"net/http"
+	"rbi/audit"
+	"rbi/auth"
+	"rbi/convert"
+	"rbi/models"
+	"rbi/sqlite"
+	"rbi/tenant"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+func RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/profile/list", listProfiles).Methods(http.MethodGet)
+	router.HandleFunc("/profile/save", saveProfile).Methods(http.MethodPost)
+	router.HandleFunc("/profile/delete", deleteProfile).Methods(http.MethodPost)
+}
+
+var Db = sqlite.Db
+
+// builtin 数据库中没有默认 profile 时使用
+var builtin = models.SessionProfile{
+	Name:          "default",
+	ClipboardMode: models.ClipboardBoth,
+	DownloadMode:  models.DownloadAllow,
+}
+
+// Resolve 按 id 或名称查找共享的 profile，ref 为空时返回默认 profile
+func Resolve(ref string) (models.SessionProfile, error) {
+	return ResolveFor(0, ref)
+}
+
+// ResolveFor 在租户可用的 profile 中查找，ref 为空时依次使用租户默认 profile 和全局默认 profile
+func ResolveFor(tenantID uint, ref string) (models.SessionProfile, error) {
+	var p models.SessionProfile
+	if ref == "" && tenantID != 0 {
+		if t, err := tenant.Get(tenantID); err == nil && t.DefaultProfileID != 0 {
+			ref = strconv.Itoa(t.DefaultProfileID)
+		}
+	}
+	if ref == "" {
+		if err := Db.Where("is_default = ? AND tenant_id = 0", true).First(&p).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return builtin, nil
+			}
+			return p, err
+		}
+		return p, nil
+	}
+	query := Db.Where("name = ?", ref)
+	if id, err := strconv.Atoi(ref); err == nil {
+		query = Db.Where("id = ?", id)
+	}
+	if err := query.Where("tenant_id IN ?", []uint{0, tenantID}).First(&p).Error; err != nil {
+		return p, fmt.Errorf("profile %s not found", ref)
+	}
+	return p, nil
+}
+
+// ForContainer 返回会话启动时使用的 profile
+func ForContainer(containerID string) models.SessionProfile {
+	var c models.ContainerInfo
+	if err := Db.Where("container_id = ?", containerID).First(&c).Error; err != nil {
+		p, _ := Resolve("")
+		return p
+	}
+	if c.ProfileID == 0 {
+		p, _ := ResolveFor(c.TenantID, "")
+		return p
+	}
+	p, err := ResolveFor(c.TenantID, strconv.Itoa(c.ProfileID))
+	if err != nil {
+		p, _ = ResolveFor(c.TenantID, "")
+	}
+	return p
+}
+
+// RedactPatterns 解析 ClipboardRedact 中的正则，每行一条
+func RedactPatterns(p models.SessionProfile) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	for _, line := range strings.Split(p.ClipboardRedact, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		re, err := regexp.Compile(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact pattern %q: %v", line, err)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+func validate(p *models.SessionProfile) error {
+	if strings.TrimSpace(p.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	switch p.ClipboardMode {
+	case "":
+		p.ClipboardMode = models.ClipboardBoth
+	case models.ClipboardDisabled, models.ClipboardInbound, models.ClipboardOutbound, models.ClipboardBoth:
+	default:
+		return fmt.Errorf("unknown clipboard mode %q", p.ClipboardMode)
+	}
+	if p.ClipboardMaxBytes < 0 {
+		return fmt.Errorf("clipboard max bytes must not be negative")
+	}
+	switch p.DownloadMode {
+	case "":
+		p.DownloadMode = models.DownloadAllow
+	case models.DownloadDisabled, models.DownloadAllow:
+	case models.DownloadConvert:
+		if _, ok := convert.Get(p.DownloadConverter); !ok {
+			return fmt.Errorf("unknown converter %q, available: %s", p.DownloadConverter, strings.Join(convert.Names(), ", "))
+		}
+	default:
+		return fmt.Errorf("unknown download mode %q", p.DownloadMode)
+	}
+	if p.WatermarkRefreshSeconds < 0 {
+		return fmt.Errorf("watermark refresh seconds must not be negative")
+	}
+	for _, name := range CDRSteps(*p) {
+		if _, ok := convert.Get(name); !ok {
+			return fmt.Errorf("unknown CDR converter %q, available: %s", name, strings.Join(convert.Names(), ", "))
+		}
+	}
+	_, err := RedactPatterns(*p)
+	return err
+}
+
+// CDRSteps 解析 IngestCDR 中的插件列表
+func CDRSteps(p models.SessionProfile) []string {
+	var steps []string
+	for _, name := range strings.Split(p.IngestCDR, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			steps = append(steps, name)
+		}
+	}
+	return steps
+}
+
+// listProfiles 全局管理员看到全部 profile，其他人看到共享的和本租户的
+func listProfiles(w http.ResponseWriter, r *http.Request) {
+	var profiles []models.SessionProfile
+	query := Db
+	if id := auth.Current(r); !id.IsAdmin {
+		query = query.Where("tenant_id IN ?", []uint{0, id.TenantID})
+	}
+	if err := query.Find(&profiles).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(profiles); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// canEdit 共享 profile 只有全局管理员可以修改，租户 profile 由该租户的管理员修改
+func canEdit(id *auth.Identity, tenantID uint) bool {
+	if tenantID == 0 {
+		return id.IsAdmin
+	}
+	return id.ManagesTenant(tenantID)
+}
+
+// saveProfile ID 为 0 时新建，否则整体更新。租户管理员保存的 profile 属于自己的租户
+func saveProfile(w http.ResponseWriter, r *http.Request) {
+	var p models.SessionProfile
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id := auth.Current(r)
+	if !id.IsAdmin {
+		p.TenantID = id.TenantID
+	}
+	if p.ID != 0 {
+		var old models.SessionProfile
+		if err := Db.First(&old, p.ID).Error; err != nil || !canEdit(id, old.TenantID) {
+			http.Error(w, "Profile not found", http.StatusNotFound)
+			return
+		}
+	}
+	if !canEdit(id, p.TenantID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	// 租户的默认 profile 在租户上设置
+	if p.TenantID != 0 {
+		p.IsDefault = false
+	}
+	if err := validate(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err := Db.Transaction(func(tx *gorm.DB) error {
+		// 只能有一个默认 profile
+		if p.IsDefault {
+			if err := tx.Model(&models.SessionProfile{}).Where("id <> ?", p.ID).Update("is_default", false).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Save(&p).Error
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	audit.Record(r, models.AuditPolicy, "profile_save", p.Name, models.AuditSuccess,
+		fmt.Sprintf("id=%d tenant=%d clipboard=%s download=%s cdr=%s watermark=%t", p.ID, p.TenantID, p.ClipboardMode, p.DownloadMode, p.IngestCDR, p.WatermarkEnabled))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+func deleteProfile(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil || id <= 0 {
+		http.Error(w, "Invalid profile id", http.StatusBadRequest)
+		return
+	}
+	var p models.SessionProfile
+	if err := Db.First(&p, id).Error; err != nil || !canEdit(auth.Current(r), p.TenantID) {
+		http.Error(w, "Profile not found", http.StatusNotFound)
+		return
+	}
+	err = Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&p).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.Tenant{}).Where("default_profile_id = ?", id).Update("default_profile_id", 0).Error
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit.Record(r, models.AuditPolicy, "profile_delete", p.Name, models.AuditSuccess, fmt.Sprintf("id=%d tenant=%d", p.ID, p.TenantID))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("Profile %d deleted", id)))
+}
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"net/url"
+	"rbi/audit"
+	"rbi/auth"
+	"rbi/hub"
+	"rbi/models"
+	"rbi/profile"
+	"regexp"
+)
+
+const (
+	directionInbound  = "inbound"  // 用户 -> 会话
+	directionOutbound = "outbound" // 会话 -> 用户
+	redactedText      = "[REDACTED]"
+)
+
+// neko 剪贴板事件，v2 双向都是 control/clipboard，v3 区分 set/updated
+var clipboardEvents = map[string]string{
+	"control/clipboard": "",
+	"clipboard/set":     directionInbound,
+	"clipboard/updated": directionOutbound,
+}
+
+// clipboardPolicy 由会话 profile 生成的剪贴板策略
+type clipboardPolicy struct {
+	mode     string
+	maxBytes int
+	redact   []*regexp.Regexp
+	session  string
+	user     string
+}
+
+func newClipboardPolicy(containerID, user string) *clipboardPolicy {
+	p := profile.ForContainer(containerID)
+	patterns, err := profile.RedactPatterns(p)
+	if err != nil {
+		log.Printf("Profile %s: %v", p.Name, err)
+	}
+	return &clipboardPolicy{mode: p.ClipboardMode, maxBytes: p.ClipboardMaxBytes, redact: patterns, session: containerID, user: user}
+}
+
+func (p *clipboardPolicy) allows(direction string) bool {
+	switch p.mode {
+	case models.ClipboardDisabled:
+		return false
+	case models.ClipboardInbound, models.ClipboardOutbound:
+		return p.mode == direction
+	default:
+		return true
+	}
+}
+
+// filter 检查一条 neko 消息，返回需要转发的内容，nil 表示丢弃
+func (p *clipboardPolicy) filter(direction string, message []byte) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(message, &fields); err != nil {
+		return message
+	}
+	var event string
+	if err := json.Unmarshal(fields["event"], &event); err != nil {
+		return message
+	}
+	expected, ok := clipboardEvents[event]
+	if !ok || (expected != "" && expected != direction) {
+		return message
+	}
+
+	text, setText := clipboardText(fields)
+	size := len(text)
+	if !p.allows(direction) {
+		p.record(direction, size, "blocked", "clipboard "+direction+" not allowed by profile")
+		return nil
+	}
+	if p.maxBytes > 0 && size > p.maxBytes {
+		p.record(direction, size, "blocked", "clipboard exceeds size limit")
+		return nil
+	}
+
+	redacted := text
+	for _, re := range p.redact {
+		redacted = re.ReplaceAllString(redacted, redactedText)
+	}
+	if redacted == text {
+		p.record(direction, size, "allowed", "")
+		return message
+	}
+	out, err := setText(redacted)
+	if err != nil {
+		p.record(direction, size, "blocked", "failed to redact clipboard")
+		return nil
+	}
+	p.record(direction, size, "redacted", "")
+	return out
+}
+
+// record 记录每次剪贴板传输，被拦截时通知会话页面
+func (p *clipboardPolicy) record(direction string, size int, result, reason string) {
+	log.Printf("Clipboard %s: user=%s session=%s bytes=%d result=%s %s", direction, p.user, p.session, size, result, reason)
+	entry := &models.ClipboardLog{
+		ContainerId: p.session,
+		User:        p.user,
+		Direction:   direction,
+		Bytes:       size,
+		Result:      result,
+		Reason:      reason,
+	}
+	if err := Db.Create(entry).Error; err != nil {
+		log.Printf("Failed to save clipboard log: %v", err)
+	}
+	outcome := models.AuditSuccess
+	if result == "blocked" {
+		outcome = models.AuditDenied
+	}
+	audit.Session(p.session, models.AuditClipboard, "clipboard_"+direction, outcome, fmt.Sprintf("%d bytes %s %s", size, result, reason))
+	if result == "blocked" {
+		hub.SendToSession(p.session, hub.New(hub.TypeClipboard, p.session, hub.ClipboardData{
+			Direction: direction,
+			Status:    result,
+			Reason:    reason,
+		}))
+	}
+}
+
+// clipboardText 取出剪贴板文本，并返回写回新文本的函数；兼容 v2 的 text 和 v3 的 payload.text
+func clipboardText(fields map[string]json.RawMessage) (string, func(string) ([]byte, error)) {
+	var text string
+	if raw, ok := fields["text"]; ok {
+		json.Unmarshal(raw, &text)
+		return text, func(s string) ([]byte, error) {
+			fields["text"], _ = json.Marshal(s)
+			return json.Marshal(fields)
+		}
+	}
+	var payload map[string]json.RawMessage
+	json.Unmarshal(fields["payload"], &payload)
+	json.Unmarshal(payload["text"], &text)
+	return text, func(s string) ([]byte, error) {
+		payload["text"], _ = json.Marshal(s)
+		// 富文本无法可靠打码，直接去掉
+		delete(payload, "html")
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		fields["payload"] = raw
+		return json.Marshal(fields)
+	}
+}
+
+// neko 的 WebSocket 与 /appws 使用同样的来源校验
+var nekoUpgrader = websocket.Upgrader{
+	CheckOrigin: checkOrigin,
+}
+
+// relayNekoWs 代理 neko 的 WebSocket，逐条检查剪贴板消息
+func relayNekoWs(w http.ResponseWriter, r *http.Request, target *url.URL, containerID, user string) {
+	upstreamURL := *target
+	upstreamURL.Scheme = "ws"
+	header := http.Header{}
+	for _, key := range []string{"Cookie", "User-Agent", "Accept-Language"} {
+		if v := r.Header.Get(key); v != "" {
+			header.Set(key, v)
+		}
+	}
+	auth.StripCredentials(header)
+	dialer := websocket.Dialer{
+		Subprotocols:     websocket.Subprotocols(r),
+		HandshakeTimeout: writeWait,
+	}
+	upstream, resp, err := dialer.Dial(upstreamURL.String(), header)
+	if err != nil {
+		log.Printf("Dial neko websocket %s: %v", upstreamURL.String(), err)
+		http.Error(w, "Failed to connect session", http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	var respHeader http.Header
+	if p := resp.Header.Get("Sec-Websocket-Protocol"); p != "" {
+		respHeader = http.Header{"Sec-Websocket-Protocol": {p}}
+	}
+	client, err := nekoUpgrader.Upgrade(w, r, respHeader)
+	if err != nil {
+		log.Println("Upgrade:", err)
+		return
+	}
+	defer client.Close()
+
+	policy := newClipboardPolicy(containerID, user)
+	errc := make(chan error, 2)
+	go pumpNeko(client, upstream, directionInbound, policy, errc)
+	go pumpNeko(upstream, client, directionOutbound, policy, errc)
+	<-errc
+}
+
+func pumpNeko(src, dst *websocket.Conn, direction string, policy *clipboardPolicy, errc chan<- error) {
+	for {
+		messageType, message, err := src.ReadMessage()
+		if err != nil {
+			if ce, ok := err.(*websocket.CloseError); ok {
+				dst.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(ce.Code, ce.Text))
+			}
+			errc <- err
+			return
+		}
+		if messageType == websocket.TextMessage {
+			if message = policy.filter(direction, message); message == nil {
+				continue
+			}
+		}
+		if err := dst.WriteMessage(messageType, message); err != nil {
+			errc <- err
+			return
+		}
+	}
+}
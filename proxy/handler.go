@@ -1,32 +1,26 @@
 package proxy
 
 import (
-	"bytes"
-	"compress/flate"
-	"compress/gzip"
-	"encoding/json"
 	"fmt"
-	"github.com/andybalholm/brotli"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
-	"io"
-	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"rbi/auth"
 	"rbi/config"
+	"rbi/middleware"
 	"rbi/models"
 	"rbi/sqlite"
-	"regexp"
 	"strings"
 	"sync"
-	"time"
 )
 
 func RegisterRoutes(router *mux.Router) {
 	MapInfo.M = make(map[string]string, 0)
 	ttl = config.Config.TTLMinutes
 	router.HandleFunc("/appws", serveWs)
+	router.Handle("/appws/broadcast", auth.RequireAdmin(broadcast)).Methods(http.MethodPost)
 	router.PathPrefix("/").HandlerFunc(dynamicProxy)
 }
 
@@ -47,6 +41,17 @@ func dynamicProxy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	containerID := parts[1]
+	id := auth.Current(r)
+	// 公开路径的其他方法会落到这里，此时没有登录身份
+	if id == nil {
+		auth.Unauthorized(w)
+		return
+	}
+	// 只能访问自己的容器
+	if !id.IsAdmin && !ownsContainer(containerID, id.Key()) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
 
 	var ip string
 	if v, ok := MapInfo.M[containerID]; ok {
@@ -73,21 +78,44 @@ func dynamicProxy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	rewriteCtx := &RewriteContext{
+		ContainerID: containerID,
+		Nonce:       middleware.Nonce(r.Context()),
+		ClientIP:    auth.ClientIP(r),
+		Username:    id.Username,
+	}
+	if len(containerID) == len("0f27e486215643f62403a9f7d97a620b12f24667a93131db3838aff6f520c0de") {
+		rewriteCtx.Prefix = "/" + containerID + "/"
+	}
+
+	// neko 的 WebSocket 单独中转，以便执行剪贴板策略
+	if rewriteCtx.Prefix != "" && websocket.IsWebSocketUpgrade(r) {
+		wsURL := *targetURL
+		wsURL.Path = "/" + strings.Join(parts[2:], "/")
+		wsURL.RawQuery = r.URL.RawQuery
+		relayNekoWs(w, r, &wsURL, containerID, id.Username)
+		return
+	}
+
 	proxy := httputil.NewSingleHostReverseProxy(targetURL)
 	proxy.Director = func(req *http.Request) {
 		pathToProxy := "/" + strings.Join(parts[2:], "/")
 
 		fmt.Println(target)
-		req.Header = r.Header
+		// 登录令牌不转发给容器
+		req.Header = r.Header.Clone()
+		auth.StripCredentials(req.Header)
 		req.URL.Scheme = targetURL.Scheme
 		req.URL.Host = targetURL.Host
-		if len(containerID) == len("0f27e486215643f62403a9f7d97a620b12f24667a93131db3838aff6f520c0de") {
+		if rewriteCtx.Prefix != "" {
 			req.URL.Path = pathToProxy
 		}
 
 		req.Host = targetURL.Host
 	}
-	proxy.ModifyResponse = modifyResponse
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		return modifyResponse(resp, rewriteCtx)
+	}
 	proxy.ServeHTTP(w, r)
 }
 
@@ -100,145 +128,3 @@ func getContainerIP(containerID string) (string, error) {
 	}
 	return dbRes.IP, nil
 }
-
-func modifyResponse(resp *http.Response) error {
-	if strings.Contains(resp.Header.Get("Content-Type"), "text/html") {
-		//判断内容的content-encoding并解压
-		var reader io.Reader
-		switch resp.Header.Get("Content-Encoding") {
-		case "gzip":
-			gzipReader, err := gzip.NewReader(resp.Body)
-			if err != nil {
-				return err
-			}
-			defer gzipReader.Close()
-			reader = gzipReader
-		case "br":
-			brotliReader := brotli.NewReader(resp.Body)
-			defer resp.Body.Close() // 确保响应体在完成后关闭
-			reader = brotliReader
-		case "deflate":
-			reader = flate.NewReader(resp.Body)
-			defer resp.Body.Close()
-		default:
-			reader = resp.Body // 没有或不支持的编码类型，直接读取
-		}
-
-		// 读取解压后的body
-		decodedBody, err := io.ReadAll(reader)
-		if err != nil {
-			return err
-		}
-		err = resp.Body.Close()
-		if err != nil {
-			return err
-		}
-		injectedScript := fmt.Sprintf(`
-		<script>
-		var pathParts = window.location.pathname.split('/');
-		var containerID;
-		if (pathParts.length > 1) {
-			if (pathParts[1].length == "0f27e486215643f62403a9f7d97a620b12f24667a93131db3838aff6f520c0de".length){
-				containerID = pathParts[1]; 
-				var ws = new WebSocket("ws://" + window.location.host + "/appws");
-				ws.onopen = function() {
-					console.log("WebSocket connected");
-					setInterval(function() {
-						ws.send(JSON.stringify({ action: "updateTTL", containerID: containerID }));
-					}, 60000);
-				};
-				ws.onmessage = function(evt) {
-					console.log("Server response: " + evt.data);
-				};
-				ws.onerror = function(err) {
-				   console.error('WebSocket encountered error: ', err.message, 'Closing socket');
-				   ws.close();
-				};
-			}
-			else
-				console.error("Container ID not found in URL");
-		} else {
-			console.error("Container ID not found in URL");
-		}
-		</script>
-		`)
-		if strings.Contains(resp.Header.Get("Content-Type"), "text/html") {
-			decodedBody = injectScriptIntoHtml(decodedBody, injectedScript)
-		}
-		resp.Body = io.NopCloser(bytes.NewReader(decodedBody))
-		resp.Header.Del("Content-Encoding")
-		resp.Header.Del("Content-Length")
-	}
-	return nil
-}
-func injectScriptIntoHtml(bodyBytes []byte, INJECT_FILE string) []byte {
-	re := regexp.MustCompile(`(<html.*?[^>]*>)`)
-	bodyBytes = re.ReplaceAllFunc(bodyBytes, func(i []byte) []byte {
-		return []byte(string(i) + INJECT_FILE)
-	})
-	return bodyBytes
-}
-
-// ws服务
-func serveWs(w http.ResponseWriter, r *http.Request) {
-	ws, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println("Upgrade:", err)
-		return
-	}
-	defer ws.Close()
-
-	for {
-		_, message, err := ws.ReadMessage()
-		if err != nil {
-			log.Println("Read:", err)
-			break
-		}
-		log.Printf("recv: %s", message)
-
-		// 解析消息
-		var msg struct {
-			Action      string `json:"action"`
-			ContainerID string `json:"containerID"`
-		}
-		err = json.Unmarshal(message, &msg)
-		if err != nil {
-			log.Println("Error parsing message:", err)
-			continue
-		}
-
-		if msg.Action == "updateTTL" {
-			log.Println("Updating TTL for container", msg.ContainerID)
-			// 更新容器的 TTL
-			updateContainerTTL(msg.ContainerID)
-		}
-
-		if err := ws.WriteMessage(websocket.TextMessage, []byte("TTL updated for "+msg.ContainerID)); err != nil {
-			log.Println("Write:", err)
-			break
-		}
-	}
-}
-
-// Define an upgrader to upgrade HTTP connections to WebSocket
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Adjust this function if needed for origin checks
-	},
-}
-
-// 更新容器ttl
-func updateContainerTTL(containerID string) {
-	result := Db.Model(&models.ContainerInfo{}).Where("container_id = ?", containerID).Update("expire_at", time.Now().Add(time.Duration(ttl)*time.Minute))
-	if result.Error != nil {
-		log.Printf("Failed to update container TTL: %v", result.Error)
-		return
-	}
-
-	if result.RowsAffected == 0 {
-		log.Printf("Container %s not found", containerID)
-		return
-	}
-	log.Printf("Container %s TTL updated successfully", containerID)
-	return
-}
@@ -0,0 +1,366 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"golang.org/x/net/html"
+	"io"
+	"log"
+	"net/http"
+	"rbi/config"
+	"rbi/middleware"
+	"strings"
+	"sync"
+)
+
+// RewriteContext 单个响应改写时各插件共享的信息
+type RewriteContext struct {
+	ContainerID string
+	// 容器路径前缀，如 /{container_id}/，没有剥离前缀时为空
+	Prefix string
+	// 本次响应的 CSP nonce
+	Nonce string
+	// 访问者信息，用于水印
+	Username string
+	ClientIP string
+}
+
+// Node 改写管线中流动的单个 token
+type Node struct {
+	Token html.Token
+	// 原始字节，Token 未修改时原样输出
+	Raw []byte
+	// Token 被修改过，输出时重新序列化
+	Dirty bool
+	// 写在 token 前后的附加内容
+	Before []byte
+	After  []byte
+}
+
+// Transform 改写插件，按顺序作用于每一个 token
+type Transform interface {
+	Apply(n *Node)
+}
+
+// TransformFunc 将普通函数适配为 Transform
+type TransformFunc func(n *Node)
+
+func (f TransformFunc) Apply(n *Node) { f(n) }
+
+// TransformFactory 根据响应上下文创建插件实例，插件可以在实例内保存状态
+type TransformFactory func(ctx *RewriteContext) Transform
+
+var transformRegistry = struct {
+	m map[string]TransformFactory
+	sync.RWMutex
+}{m: make(map[string]TransformFactory)}
+
+// RegisterTransform 注册改写插件，名称即 config.yml 中 rewrite.transforms 的取值
+func RegisterTransform(name string, factory TransformFactory) {
+	transformRegistry.Lock()
+	defer transformRegistry.Unlock()
+	transformRegistry.m[name] = factory
+}
+
+func init() {
+	RegisterTransform("inject", newInjectTransform)
+	RegisterTransform("base", newBaseTransform)
+	RegisterTransform("links", newLinksTransform)
+}
+
+// buildPipeline 按配置顺序实例化改写插件
+func buildPipeline(ctx *RewriteContext) []Transform {
+	transformRegistry.RLock()
+	defer transformRegistry.RUnlock()
+	pipeline := make([]Transform, 0, len(config.Config.Rewrite.Transforms))
+	for _, name := range config.Config.Rewrite.Transforms {
+		factory, ok := transformRegistry.m[name]
+		if !ok {
+			log.Printf("Unknown rewrite transform %q, skipped", name)
+			continue
+		}
+		pipeline = append(pipeline, factory(ctx))
+	}
+	return pipeline
+}
+
+// rewriteHTML 逐 token 读取 src，经过 pipeline 后写入 dst
+func rewriteHTML(dst io.Writer, src io.Reader, pipeline []Transform) error {
+	z := html.NewTokenizer(src)
+	for {
+		if z.Next() == html.ErrorToken {
+			if z.Err() == io.EOF {
+				return nil
+			}
+			return z.Err()
+		}
+		n := &Node{Raw: append([]byte(nil), z.Raw()...)}
+		n.Token = z.Token()
+		for _, t := range pipeline {
+			t.Apply(n)
+		}
+
+		out := n.Raw
+		if n.Dirty {
+			out = []byte(n.Token.String())
+		}
+		for _, b := range [][]byte{n.Before, out, n.After} {
+			if len(b) == 0 {
+				continue
+			}
+			if _, err := dst.Write(b); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// modifyResponse 流式改写 HTML 响应，并按原编码重新压缩
+func modifyResponse(resp *http.Response, ctx *RewriteContext) error {
+	if ctx.Nonce == "" {
+		ctx.Nonce = newNonce()
+	}
+	// 改写和透传的响应都以本站 CSP 为准：上游的 CSP 不认识注入脚本的 nonce，一律去掉。
+	// nonce 只加在网关自己注入的脚本上，上游页面中的脚本(包括被注入的内联脚本)不带 nonce
+	if middleware.BuildCSP(ctx.Nonce) != "" {
+		resp.Header.Del("Content-Security-Policy")
+		resp.Header.Del("Content-Security-Policy-Report-Only")
+	}
+	if !strings.Contains(resp.Header.Get("Content-Type"), "text/html") {
+		return nil
+	}
+	if resp.ContentLength == 0 || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified ||
+		(resp.Request != nil && resp.Request.Method == http.MethodHead) {
+		return nil
+	}
+	limit := config.Config.Rewrite.MaxBodyBytes
+	if limit > 0 && resp.ContentLength > limit {
+		// 超过大小上限，原样透传
+		return nil
+	}
+
+	encoding := resp.Header.Get("Content-Encoding")
+	if !supportedEncoding(encoding) {
+		return nil
+	}
+	if limit > 0 && resp.ContentLength < 0 {
+		// 长度未知(chunked)时先读入至多 limit 字节再决定，超过上限则连同已读部分原样透传
+		head, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+		if err != nil {
+			return err
+		}
+		resp.Body = prefixedBody{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+		if int64(len(head)) > limit {
+			return nil
+		}
+	}
+	decoded, err := newDecoder(encoding, resp.Body)
+	if err != nil {
+		return err
+	}
+
+	pipeline := buildPipeline(ctx)
+
+	body := resp.Body
+	pr, pw := io.Pipe()
+	go func() {
+		encoder := newEncoder(encoding, pw)
+		err := rewriteHTML(encoder, decoded, pipeline)
+		if closeErr := encoder.Close(); err == nil {
+			err = closeErr
+		}
+		decoded.Close()
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+
+	resp.Body = pr
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	return nil
+}
+
+func supportedEncoding(encoding string) bool {
+	switch encoding {
+	case "", "identity", "gzip", "br", "deflate":
+		return true
+	}
+	return false
+}
+
+// newDecoder 根据 content-encoding 解压响应体
+func newDecoder(encoding string, body io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewReader(body)
+	case "br":
+		return io.NopCloser(brotli.NewReader(body)), nil
+	case "deflate":
+		return flate.NewReader(body), nil
+	default:
+		return io.NopCloser(body), nil
+	}
+}
+
+// newEncoder 按原 content-encoding 重新压缩
+func newEncoder(encoding string, w io.Writer) io.WriteCloser {
+	switch encoding {
+	case "gzip":
+		return gzip.NewWriter(w)
+	case "br":
+		return brotli.NewWriter(w)
+	case "deflate":
+		fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+		return fw
+	default:
+		return nopWriteCloser{w}
+	}
+}
+
+// prefixedBody 预读的部分加上剩余的响应体，关闭时关闭原响应体
+type prefixedBody struct {
+	io.Reader
+	io.Closer
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func newNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("Failed to generate nonce: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func isStartTag(n *Node, name string) bool {
+	return (n.Token.Type == html.StartTagToken || n.Token.Type == html.SelfClosingTagToken) && n.Token.Data == name
+}
+
+// 注入的 /appws 客户端脚本：定时发送 keepalive，并展示服务端推送的提醒
+const keepaliveScript = `
+		<script nonce="%s">
+		(function() {
+			var session = %s;
+			var interval = %d;
+			var proto = window.location.protocol === "https:" ? "wss://" : "ws://";
+			var ws = new WebSocket(proto + window.location.host + "/appws?session=" + encodeURIComponent(session));
+			function send(type, data) {
+				ws.send(JSON.stringify({ v: 1, type: type, session: session, data: data }));
+			}
+			function toast(text) {
+				var el = document.createElement("div");
+				el.textContent = text;
+				el.style.cssText = "position:fixed;top:12px;right:12px;z-index:2147483647;padding:8px 12px;background:rgba(0,0,0,.75);color:#fff;font:14px sans-serif;border-radius:4px";
+				document.body.appendChild(el);
+				setTimeout(function() { el.remove(); }, 8000);
+			}
+			ws.onopen = function() {
+				send("keepalive");
+				setInterval(function() { send("keepalive"); }, interval);
+			};
+			ws.onmessage = function(evt) {
+				var msg;
+				try { msg = JSON.parse(evt.data); } catch (e) { return; }
+				window.dispatchEvent(new CustomEvent("rbi:message", { detail: msg }));
+				var data = msg.data || {};
+				switch (msg.type) {
+				case "expiryWarning":
+					toast("Session expires in " + data.remainingSeconds + "s");
+					break;
+				case "broadcast":
+					toast(data.message);
+					break;
+				case "download":
+					toast("File ready: " + data.name);
+					break;
+				case "error":
+					console.error("appws:", data.type, data.error);
+					break;
+				}
+			};
+			ws.onerror = function(err) {
+				console.error('WebSocket encountered error: ', err.message, 'Closing socket');
+				ws.close();
+			};
+		})();
+		</script>
+		`
+
+// newInjectTransform 在第一个 <html>/<head>/<body> 开始标签之后注入 /appws 客户端脚本，仅作用于容器页面
+func newInjectTransform(ctx *RewriteContext) Transform {
+	injected := false
+	return TransformFunc(func(n *Node) {
+		if injected || ctx.Prefix == "" {
+			return
+		}
+		if isStartTag(n, "html") || isStartTag(n, "head") || isStartTag(n, "body") {
+			session, _ := json.Marshal(ctx.ContainerID)
+			interval := config.Config.WsUpdateIntervalSeconds
+			if interval <= 0 {
+				interval = 60
+			}
+			n.After = append(n.After, fmt.Sprintf(keepaliveScript, html.EscapeString(ctx.Nonce), session, interval*1000)...)
+			injected = true
+		}
+	})
+}
+
+// newBaseTransform 在 <head> 之后插入指向容器前缀的 <base href>
+func newBaseTransform(ctx *RewriteContext) Transform {
+	inserted := false
+	return TransformFunc(func(n *Node) {
+		if inserted || ctx.Prefix == "" || !isStartTag(n, "head") {
+			return
+		}
+		n.After = append(n.After, fmt.Sprintf(`<base href="%s">`, html.EscapeString(ctx.Prefix))...)
+		inserted = true
+	})
+}
+
+// 需要改写的链接属性
+var linkAttrs = map[string]bool{
+	"href":       true,
+	"src":        true,
+	"action":     true,
+	"formaction": true,
+	"poster":     true,
+}
+
+// newLinksTransform 将根路径链接(/xxx)改写到容器前缀下，避免请求落到代理根路径
+func newLinksTransform(ctx *RewriteContext) Transform {
+	return TransformFunc(func(n *Node) {
+		if ctx.Prefix == "" {
+			return
+		}
+		if n.Token.Type != html.StartTagToken && n.Token.Type != html.SelfClosingTagToken {
+			return
+		}
+		for i, a := range n.Token.Attr {
+			if a.Namespace != "" || !linkAttrs[a.Key] {
+				continue
+			}
+			if rewritten, ok := prefixLink(ctx.Prefix, a.Val); ok {
+				n.Token.Attr[i].Val = rewritten
+				n.Dirty = true
+			}
+		}
+	})
+}
+
+func prefixLink(prefix, link string) (string, bool) {
+	if !strings.HasPrefix(link, "/") || strings.HasPrefix(link, "//") || strings.HasPrefix(link, prefix) {
+		return link, false
+	}
+	return prefix + strings.TrimPrefix(link, "/"), true
+}
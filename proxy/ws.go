@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"net/url"
+	"rbi/auth"
+	"rbi/hub"
+	"rbi/middleware"
+	"rbi/models"
+	"strings"
+	"time"
+)
+
+const (
+	// 写超时
+	writeWait = 10 * time.Second
+	// 超过该时间没有收到 pong 或消息即断开
+	pongWait = 60 * time.Second
+	// ping 间隔，必须小于 pongWait
+	pingPeriod = pongWait * 9 / 10
+	// 单条消息最大字节数
+	maxMessageSize = 4096
+)
+
+func init() {
+	hub.Handle(hub.TypeKeepalive, keepalive)
+}
+
+// Define an upgrader to upgrade HTTP connections to WebSocket
+var upgrader = websocket.Upgrader{
+	CheckOrigin: checkOrigin,
+}
+
+// checkOrigin 只允许同源或 cors.allowedOrigins 中的页面建立连接
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return middleware.OriginAllowed(origin)
+}
+
+// ws服务，/appws?session={container_id}，不带 session 时只接收用户级推送
+func serveWs(w http.ResponseWriter, r *http.Request) {
+	// 连接绑定到登录用户，只能操作自己的容器
+	id := auth.Current(r)
+	owner := id.Key()
+	session := r.URL.Query().Get("session")
+	if session != "" && !ownsContainer(session, owner) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("Upgrade:", err)
+		return
+	}
+	defer ws.Close()
+
+	client := hub.NewClient(session, owner)
+	hub.Default.Register(client)
+	defer hub.Default.Unregister(client)
+
+	done := make(chan struct{})
+	defer close(done)
+	go writePump(ws, client.Send, done)
+
+	ws.SetReadLimit(maxMessageSize)
+	ws.SetReadDeadline(time.Now().Add(pongWait))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			log.Println("Read:", err)
+			break
+		}
+		ws.SetReadDeadline(time.Now().Add(pongWait))
+
+		// 解析消息
+		var msg hub.Message
+		if err := json.Unmarshal(message, &msg); err != nil {
+			log.Println("Error parsing message:", err)
+			continue
+		}
+
+		var reply []byte
+		if msg.Version == 0 {
+			reply = legacyMessage(client, message)
+		} else if resp := hub.Dispatch(client, &msg); resp != nil {
+			reply, _ = json.Marshal(resp)
+		}
+		if reply == nil {
+			continue
+		}
+
+		select {
+		case client.Send <- reply:
+		default:
+			log.Println("Write: send buffer full, dropping client")
+			return
+		}
+	}
+}
+
+// legacyMessage 兼容旧版脚本的 {"action":"updateTTL","containerID":"..."}
+func legacyMessage(client *hub.Client, message []byte) []byte {
+	var msg struct {
+		Action      string `json:"action"`
+		ContainerID string `json:"containerID"`
+	}
+	if err := json.Unmarshal(message, &msg); err != nil || msg.Action != "updateTTL" {
+		return nil
+	}
+	if _, ok := updateContainerTTL(msg.ContainerID, client.User); !ok {
+		return []byte("TTL not updated for " + msg.ContainerID)
+	}
+	return []byte("TTL updated for " + msg.ContainerID)
+}
+
+// keepalive 续期会话，连接绑定了会话时只能续期该会话
+func keepalive(c *hub.Client, msg *hub.Message) *hub.Message {
+	session := msg.Session
+	if c.Session != "" {
+		session = c.Session
+	}
+	expireAt, ok := updateContainerTTL(session, c.User)
+	if !ok {
+		return hub.Errorf(msg, "session not found")
+	}
+	return hub.New(hub.TypeKeepalive, session, hub.KeepaliveData{ExpireAt: expireAt})
+}
+
+// writePump 负责所有写操作并定时发送 ping，gorilla 连接不支持并发写
+func writePump(ws *websocket.Conn, send <-chan []byte, done <-chan struct{}) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case message := <-send:
+			ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := ws.WriteMessage(websocket.TextMessage, message); err != nil {
+				log.Println("Write:", err)
+				ws.Close()
+				return
+			}
+		case <-ticker.C:
+			ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				log.Println("Ping:", err)
+				ws.Close()
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+type broadcastRequest struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+// broadcast 全局管理员向所有在线连接推送消息，路由由 auth.RequireAdmin 保护
+func broadcast(w http.ResponseWriter, r *http.Request) {
+	var req broadcastRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Message == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Level == "" {
+		req.Level = "info"
+	}
+	delivered := hub.Broadcast(hub.New(hub.TypeBroadcast, "", hub.BroadcastData{Level: req.Level, Message: req.Message}))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{
+		"delivered": delivered,
+	})
+}
+
+func ownsContainer(containerID, owner string) bool {
+	var count int64
+	err := Db.Model(&models.ContainerInfo{}).
+		Where("container_id = ? AND user_id = ?", containerID, owner).
+		Count(&count).Error
+	return err == nil && count > 0
+}
+
+// 更新容器ttl，只更新属于 owner 的容器
+func updateContainerTTL(containerID, owner string) (time.Time, bool) {
+	expireAt := time.Now().Add(time.Duration(ttl) * time.Minute)
+	result := Db.Model(&models.ContainerInfo{}).
+		Where("container_id = ? AND user_id = ?", containerID, owner).
+		Update("expire_at", expireAt)
+	if result.Error != nil {
+		log.Printf("Failed to update container TTL: %v", result.Error)
+		return time.Time{}, false
+	}
+
+	if result.RowsAffected == 0 {
+		log.Printf("Container %s not found for this session", containerID)
+		return time.Time{}, false
+	}
+	log.Printf("Container %s TTL updated successfully", containerID)
+	return expireAt, true
+}
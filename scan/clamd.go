@@ -0,0 +1,86 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// 单个 INSTREAM 数据块大小，需小于 clamd 的 StreamMaxLength
+const clamdChunkSize = 64 * 1024
+
+// Clamd 通过 clamd 的 INSTREAM 命令扫描
+type Clamd struct {
+	Network string // tcp 或 unix，默认 tcp
+	Addr    string
+	Timeout time.Duration
+}
+
+func (c *Clamd) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	network := c.Network
+	if network == "" {
+		network = "tcp"
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, c.Addr)
+	if err != nil {
+		return Result{}, fmt.Errorf("connect clamd: %v", err)
+	}
+	defer conn.Close()
+	if c.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return Result{}, err
+	}
+	buf := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, werr := conn.Write(append(size, buf[:n]...)); werr != nil {
+				return Result{}, werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	// 长度为 0 的块表示结束
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return Result{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return Result{}, err
+	}
+	return parseClamdReply(string(bytes.TrimRight([]byte(reply), "\x00\n")))
+}
+
+// parseClamdReply 解析 "stream: OK" / "stream: Eicar-Test-Signature FOUND"
+func parseClamdReply(reply string) (Result, error) {
+	_, status, ok := strings.Cut(reply, ": ")
+	if !ok {
+		return Result{}, fmt.Errorf("unexpected clamd reply %q", reply)
+	}
+	switch {
+	case status == "OK":
+		return Result{Clean: true, Engine: "clamd"}, nil
+	case strings.HasSuffix(status, " FOUND"):
+		return Result{Signature: strings.TrimSuffix(status, " FOUND"), Engine: "clamd"}, nil
+	default:
+		return Result{}, fmt.Errorf("clamd: %s", status)
+	}
+}
@@ -0,0 +1,67 @@
+package scan
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+)
+
+// eicar 标准测试文件特征，用于验证扫描链路
+var eicar = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+
+// Local 本地扫描器，在没有部署 clamd 时替代使用。
+// 识别 EICAR 测试文件和 SHA-256 黑名单，结果与 clamd 的特征命名保持一致
+type Local struct {
+	deny map[string]bool
+}
+
+func NewLocal(denySHA256 []string) *Local {
+	l := &Local{deny: make(map[string]bool)}
+	for _, h := range denySHA256 {
+		l.deny[strings.ToLower(strings.TrimSpace(h))] = true
+	}
+	return l
+}
+
+func (l *Local) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	h := sha256.New()
+	// 特征可能跨越两次读取，保留上一块的尾部
+	tail := make([]byte, 0, len(eicar))
+	buf := make([]byte, 32*1024)
+	found := false
+	for {
+		if err := ctx.Err(); err != nil {
+			return Result{}, err
+		}
+		n, err := r.Read(buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			window := append(tail, buf[:n]...)
+			if !found && bytes.Contains(window, eicar) {
+				found = true
+			}
+			if len(window) > len(eicar) {
+				window = window[len(window)-len(eicar):]
+			}
+			tail = append(tail[:0], window...)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Result{}, err
+		}
+	}
+
+	if found {
+		return Result{Signature: "Eicar-Test-Signature", Engine: "local"}, nil
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if l.deny[sum] {
+		return Result{Signature: "Sha256-Denylist." + sum[:12], Engine: "local"}, nil
+	}
+	return Result{Clean: true, Engine: "local"}, nil
+}
@@ -0,0 +1,35 @@
+package scan
+
+import (
+	"context"
+	"io"
+	"rbi/config"
+	"time"
+)
+
+// Result 扫描结果，Signature 为命中的特征名称
+type Result struct {
+	Clean     bool   `json:"clean"`
+	Signature string `json:"signature,omitempty"`
+	Engine    string `json:"engine"`
+}
+
+// Scanner 文件扫描器
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (Result, error)
+}
+
+// FromConfig 根据 config.yml 的 scanner 配置创建扫描器
+func FromConfig() Scanner {
+	conf := config.Config.Scanner
+	switch conf.Engine {
+	case "clamd":
+		timeout := time.Duration(conf.TimeoutSeconds) * time.Second
+		if timeout <= 0 {
+			timeout = 30 * time.Second
+		}
+		return &Clamd{Network: conf.ClamdNetwork, Addr: conf.ClamdAddr, Timeout: timeout}
+	default:
+		return NewLocal(conf.DenySHA256)
+	}
+}
@@ -0,0 +1,296 @@
+package tenant
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+	"rbi/audit"
+	"rbi/auth"
+	"rbi/models"
+	"rbi/policy"
+	"rbi/sqlite"
+	"strconv"
+	"strings"
+)
+
+func RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/tenant/list", listTenants).Methods(http.MethodGet)
+	router.HandleFunc("/tenant/usage", tenantUsage).Methods(http.MethodGet)
+	router.Handle("/tenant/save", auth.RequireAdmin(saveTenant)).Methods(http.MethodPost)
+	router.Handle("/tenant/delete", auth.RequireAdmin(deleteTenant)).Methods(http.MethodPost)
+	router.Handle("/tenant/assign", auth.RequireAdmin(assignUser)).Methods(http.MethodPost)
+}
+
+var Db = sqlite.Db
+
+// 配额类型
+const (
+	QuotaUsers       = "users"
+	QuotaContainers  = "containers"
+	QuotaAutomations = "automations"
+)
+
+var ErrQuotaExceeded = errors.New("tenant quota exceeded")
+
+// Seed 创建默认租户，并把升级前没有租户的数据归入默认租户
+func Seed() {
+	def := models.Tenant{ID: models.DefaultTenantID, Name: "default", Explain: "默认租户"}
+	if err := Db.Where("id = ?", def.ID).FirstOrCreate(&def).Error; err != nil {
+		log.Fatalf("Failed to seed default tenant: %v", err)
+	}
+	for _, m := range []interface{}{&models.User{}, &models.Automation{}, &models.ContainerInfo{}} {
+		if err := Db.Model(m).Where("tenant_id = 0").Update("tenant_id", models.DefaultTenantID).Error; err != nil {
+			log.Fatalf("Failed to backfill tenant: %v", err)
+		}
+	}
+}
+
+// Get 按 ID 查找租户
+func Get(tenantID uint) (*models.Tenant, error) {
+	var t models.Tenant
+	err := Db.First(&t, tenantID).Error
+	return &t, err
+}
+
+// Usage 租户当前的用量
+type Usage struct {
+	Users       int64 `json:"users"`
+	Containers  int64 `json:"containers"`
+	Automations int64 `json:"automations"`
+}
+
+func usageOf(tenantID uint) (Usage, error) {
+	var u Usage
+	err := Db.Model(&models.User{}).Where("tenant_id = ? AND disabled_at IS NULL", tenantID).Count(&u.Users).Error
+	if err == nil {
+		err = Db.Model(&models.ContainerInfo{}).Where("tenant_id = ?", tenantID).Count(&u.Containers).Error
+	}
+	if err == nil {
+		err = Db.Model(&models.Automation{}).Where("tenant_id = ? AND archived = ?", tenantID, false).Count(&u.Automations).Error
+	}
+	return u, err
+}
+
+// CheckQuota 再新增一个 kind 类型的资源是否超出租户配额，超出时返回 ErrQuotaExceeded
+func CheckQuota(tenantID uint, kind string) error {
+	t, err := Get(tenantID)
+	if err != nil {
+		return fmt.Errorf("tenant %d not found", tenantID)
+	}
+	u, err := usageOf(tenantID)
+	if err != nil {
+		return err
+	}
+	var limit int
+	var used int64
+	switch kind {
+	case QuotaUsers:
+		limit, used = t.MaxUsers, u.Users
+	case QuotaContainers:
+		limit, used = t.MaxContainers, u.Containers
+	case QuotaAutomations:
+		limit, used = t.MaxAutomations, u.Automations
+	default:
+		return fmt.Errorf("unknown quota %q", kind)
+	}
+	if limit > 0 && used >= int64(limit) {
+		return fmt.Errorf("%w: %s %d/%d", ErrQuotaExceeded, kind, used, limit)
+	}
+	return nil
+}
+
+// WriteQuotaError 配额错误返回 403，其它错误返回 500
+func WriteQuotaError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, ErrQuotaExceeded) {
+		status = http.StatusForbidden
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// listTenants 全局管理员看到全部租户，其他人只看到自己的租户
+func listTenants(w http.ResponseWriter, r *http.Request) {
+	var tenants []models.Tenant
+	query := Db.Order("id asc")
+	if id := auth.Current(r); !id.IsAdmin {
+		query = query.Where("id = ?", id.TenantID)
+	}
+	if err := query.Find(&tenants).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, tenants)
+}
+
+// tenantUsage 租户的配额和用量，不带 id 时为自己的租户
+func tenantUsage(w http.ResponseWriter, r *http.Request) {
+	id := auth.Current(r)
+	tenantID := id.TenantID
+	if s := r.URL.Query().Get("id"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid tenant id", http.StatusBadRequest)
+			return
+		}
+		tenantID = uint(n)
+	}
+	if !id.InTenant(tenantID) {
+		http.Error(w, "Tenant not found", http.StatusNotFound)
+		return
+	}
+	t, err := Get(tenantID)
+	if err != nil {
+		http.Error(w, "Tenant not found", http.StatusNotFound)
+		return
+	}
+	u, err := usageOf(tenantID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"tenant": t, "usage": u})
+}
+
+func validate(t *models.Tenant) error {
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if t.MaxUsers < 0 || t.MaxContainers < 0 || t.MaxAutomations < 0 {
+		return fmt.Errorf("quotas must not be negative")
+	}
+	switch t.PolicyDefault {
+	case "", models.PolicyAllow, models.PolicyDeny:
+	default:
+		return fmt.Errorf("policyDefault must be empty, %s or %s", models.PolicyAllow, models.PolicyDeny)
+	}
+	if t.DefaultProfileID != 0 {
+		var p models.SessionProfile
+		if err := Db.First(&p, t.DefaultProfileID).Error; err != nil || (p.TenantID != 0 && p.TenantID != t.ID) {
+			return fmt.Errorf("profile %d not found", t.DefaultProfileID)
+		}
+	}
+	return nil
+}
+
+// saveTenant ID 为 0 时新建，否则整体更新
+func saveTenant(w http.ResponseWriter, r *http.Request) {
+	var t models.Tenant
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validate(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if t.ID != 0 {
+		old, err := Get(t.ID)
+		if err != nil {
+			http.Error(w, "Tenant not found", http.StatusNotFound)
+			return
+		}
+		t.CreatedAt = old.CreatedAt
+	}
+	if err := Db.Save(&t).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	policy.Invalidate()
+	audit.Record(r, models.AuditTenant, "tenant_save", t.Name, models.AuditSuccess,
+		fmt.Sprintf("id=%d maxUsers=%d maxContainers=%d maxAutomations=%d policyDefault=%s", t.ID, t.MaxUsers, t.MaxContainers, t.MaxAutomations, t.PolicyDefault))
+	writeJSON(w, http.StatusOK, t)
+}
+
+// deleteTenant 只能删除没有用户和脚本的租户，租户自己的 profile 和 URL 规则一并删除
+func deleteTenant(w http.ResponseWriter, r *http.Request) {
+	tenantID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil || tenantID <= 0 {
+		http.Error(w, "Invalid tenant id", http.StatusBadRequest)
+		return
+	}
+	if uint(tenantID) == models.DefaultTenantID {
+		http.Error(w, "The default tenant cannot be deleted", http.StatusBadRequest)
+		return
+	}
+	var users, scripts int64
+	Db.Model(&models.User{}).Where("tenant_id = ?", tenantID).Count(&users)
+	Db.Model(&models.Automation{}).Where("tenant_id = ?", tenantID).Count(&scripts)
+	if users > 0 || scripts > 0 {
+		http.Error(w, fmt.Sprintf("Tenant still has %d users and %d automations", users, scripts), http.StatusConflict)
+		return
+	}
+	err = Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("tenant_id = ?", tenantID).Delete(&models.SessionProfile{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("tenant_id = ?", tenantID).Delete(&models.PolicyRule{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&models.Tenant{}, tenantID).Error
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	policy.Invalidate()
+	audit.Record(r, models.AuditTenant, "tenant_delete", strconv.Itoa(tenantID), models.AuditSuccess, "")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("Tenant %d deleted", tenantID)))
+}
+
+type assignRequest struct {
+	UserID      uint `json:"userId"`
+	TenantID    uint `json:"tenantId"`
+	TenantAdmin bool `json:"tenantAdmin"`
+}
+
+// assignUser 把用户移到另一个租户或调整租户管理员，用户的脚本和会话随之移动
+func assignUser(w http.ResponseWriter, r *http.Request) {
+	var req assignRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == 0 || req.TenantID == 0 {
+		http.Error(w, "userId and tenantId are required", http.StatusBadRequest)
+		return
+	}
+	var user models.User
+	if err := Db.First(&user, req.UserID).Error; err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if _, err := Get(req.TenantID); err != nil {
+		http.Error(w, "Tenant not found", http.StatusNotFound)
+		return
+	}
+	if user.TenantID != req.TenantID && !user.Disabled() {
+		if err := CheckQuota(req.TenantID, QuotaUsers); err != nil {
+			WriteQuotaError(w, err)
+			return
+		}
+	}
+	err := Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Updates(map[string]interface{}{"tenant_id": req.TenantID, "tenant_admin": req.TenantAdmin}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Automation{}).Where("user_id = ?", user.UserID).Update("tenant_id", req.TenantID).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.ContainerInfo{}).Where("user_id = ?", user.UserID).Update("tenant_id", req.TenantID).Error
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit.Record(r, models.AuditTenant, "tenant_assign", user.Username, models.AuditSuccess,
+		fmt.Sprintf("tenant %d -> %d tenantAdmin=%t", user.TenantID, req.TenantID, req.TenantAdmin))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"userId": user.UserID, "tenantId": req.TenantID, "tenantAdmin": req.TenantAdmin})
+}
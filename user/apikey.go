@@ -0,0 +1,163 @@
+package user
+
+import (
+	"encoding/json"
+	"net/http"
+	"rbi/auth"
+	"rbi/config"
+	"rbi/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type apiKeyRequest struct {
+	ID            int64    `json:"id"`
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expiresInDays"` // 0 为配置允许的最长期限
+}
+
+// interactiveOnly API Key 不能用来管理 API Key
+func interactiveOnly(w http.ResponseWriter, r *http.Request) bool {
+	if auth.Current(r).APIKeyID != 0 {
+		writeResult(w, http.StatusForbidden, "API keys cannot manage API keys", nil)
+		return false
+	}
+	return true
+}
+
+// listAPIKeys 当前用户的 API Key，有用户管理权限时可用 userId 查看他人
+func listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	id := auth.Current(r)
+	userID := id.UserID
+	if s := r.URL.Query().Get("userId"); s != "" && id.Can(models.PermUserManage) {
+		uid, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			writeResult(w, http.StatusBadRequest, "Invalid userId", nil)
+			return
+		}
+		user, err := findUser(id, uint(uid), "")
+		if err != nil {
+			writeResult(w, http.StatusNotFound, "User not found", nil)
+			return
+		}
+		userID = user.UserID
+	}
+	var keys []models.APIKey
+	if err := Db.Where("user_id = ?", userID).Order("id desc").Find(&keys).Error; err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	writeResult(w, http.StatusOK, "ok", keys)
+}
+
+// createAPIKey 创建 API Key，scope 不能超出用户自身的权限，明文只返回这一次
+func createAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !interactiveOnly(w, r) {
+		return
+	}
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" || len(req.Scopes) == 0 {
+		writeResult(w, http.StatusBadRequest, "name and scopes are required", nil)
+		return
+	}
+	scopes, unknown := auth.NormalizeScopes(req.Scopes)
+	if len(unknown) > 0 {
+		writeResult(w, http.StatusBadRequest, "Unknown scope: "+strings.Join(unknown, ","), nil)
+		return
+	}
+	user, err := currentUser(r)
+	if err != nil {
+		writeResult(w, http.StatusNotFound, "User not found", nil)
+		return
+	}
+	granted, err := auth.UserPermissionCodes(user)
+	if err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	for _, scope := range scopes {
+		if !contains(granted, scope) {
+			writeResult(w, http.StatusForbidden, "Scope exceeds your permissions: "+scope, nil)
+			return
+		}
+	}
+
+	maxDays := config.Config.Auth.APIKeyMaxDays
+	days := req.ExpiresInDays
+	if days <= 0 {
+		days = maxDays
+	}
+	if maxDays > 0 && days > maxDays {
+		writeResult(w, http.StatusBadRequest, "expiresInDays exceeds "+strconv.Itoa(maxDays), nil)
+		return
+	}
+	raw := auth.NewAPIKey()
+	key := models.APIKey{
+		UserID:  user.UserID,
+		Name:    strings.TrimSpace(req.Name),
+		Prefix:  raw[:len(auth.APIKeyPrefix)+6],
+		KeyHash: auth.HashToken(raw),
+		Scopes:  strings.Join(scopes, ","),
+	}
+	if days > 0 {
+		expires := time.Now().AddDate(0, 0, days)
+		key.ExpiresAt = &expires
+	}
+	if err := Db.Create(&key).Error; err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	authLog(r, models.AuthAPIKeyCreate, user.Username, user.UserID, key.Name+" "+key.Scopes)
+	writeResult(w, http.StatusOK, "Store the key now, it will not be shown again", map[string]interface{}{
+		"key":    raw,
+		"apiKey": key,
+	})
+}
+
+// revokeAPIKey 作废 API Key，本人或有用户管理权限的人可操作
+func revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !interactiveOnly(w, r) {
+		return
+	}
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == 0 {
+		writeResult(w, http.StatusBadRequest, "id is required", nil)
+		return
+	}
+	id := auth.Current(r)
+	var key models.APIKey
+	if err := Db.First(&key, req.ID).Error; err != nil || (key.UserID != id.UserID && !canManage(id, key.UserID)) {
+		writeResult(w, http.StatusNotFound, "API key not found", nil)
+		return
+	}
+	if key.RevokedAt == nil {
+		now := time.Now()
+		key.RevokedAt = &now
+		if err := Db.Model(&key).Update("revoked_at", now).Error; err != nil {
+			writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+			return
+		}
+		authLog(r, models.AuthAPIKeyRevoke, id.Username, key.UserID, key.Name)
+	}
+	writeResult(w, http.StatusOK, "API key revoked", key)
+}
+
+// canManage 有用户管理权限且目标用户在管理范围内
+func canManage(id *auth.Identity, userID uint) bool {
+	if !id.Can(models.PermUserManage) {
+		return false
+	}
+	_, err := findUser(id, userID, "")
+	return err == nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
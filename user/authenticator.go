@@ -0,0 +1,93 @@
+package user
+
+import (
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"rbi/config"
+	"rbi/models"
+)
+
+var (
+	// ErrUnknownUser 后端中没有该用户，继续尝试下一个后端
+	ErrUnknownUser = errors.New("unknown user")
+	// ErrInvalidCredentials 用户存在但密码错误，不再尝试其它后端
+	ErrInvalidCredentials = errors.New("wrong password")
+	// ErrDisabled 密码正确但账号已停用
+	ErrDisabled = errors.New("account disabled")
+)
+
+// Authenticator 登录后端，成功时返回本地 models.User，必要时由后端创建
+type Authenticator interface {
+	Name() string
+	Authenticate(username, password string) (*models.User, error)
+}
+
+var authenticatorFactories = map[string]func() Authenticator{
+	models.UserSourceLocal: func() Authenticator { return localAuthenticator{} },
+	models.UserSourceLDAP:  func() Authenticator { return newLDAPAuthenticator(config.Config.Auth.LDAP) },
+}
+
+// authenticators 按 auth.backends 的顺序实例化登录后端，未配置时只用本地账号
+func authenticators() []Authenticator {
+	names := config.Config.Auth.Backends
+	if len(names) == 0 {
+		names = []string{models.UserSourceLocal}
+	}
+	list := make([]Authenticator, 0, len(names))
+	for _, name := range names {
+		factory, ok := authenticatorFactories[name]
+		if !ok {
+			log.Printf("Unknown auth backend %q, skipped", name)
+			continue
+		}
+		list = append(list, factory())
+	}
+	return list
+}
+
+// authenticate 依次尝试各后端，直到某个后端认识该用户
+func authenticate(username, password string) (*models.User, error) {
+	for _, a := range authenticators() {
+		user, err := a.Authenticate(username, password)
+		if errors.Is(err, ErrUnknownUser) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Auth backend %s: %s: %v", a.Name(), username, err)
+		} else if user.Disabled() {
+			return user, ErrDisabled
+		}
+		return user, err
+	}
+	// 所有后端都不认识该用户时同样执行一次 bcrypt，避免通过响应时间枚举用户名
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+	return nil, ErrUnknownUser
+}
+
+// 用户不存在时用于比较的哈希
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+
+// localAuthenticator 本地 bcrypt 账号
+type localAuthenticator struct{}
+
+func (localAuthenticator) Name() string { return models.UserSourceLocal }
+
+func (localAuthenticator) Authenticate(username, password string) (*models.User, error) {
+	var user models.User
+	if err := Db.Where("username = ?", username).First(&user).Error; err != nil {
+		return nil, ErrUnknownUser
+	}
+	if !isLocal(&user) {
+		return nil, ErrUnknownUser
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		return &user, ErrInvalidCredentials
+	}
+	return &user, nil
+}
+
+// isLocal 账号密码是否由本地管理
+func isLocal(user *models.User) bool {
+	return user.Source == "" || user.Source == models.UserSourceLocal
+}
@@ -0,0 +1,190 @@
+package user
+
+import (
+	"encoding/json"
+	"errors"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+	"rbi/auth"
+	"rbi/containers"
+	"rbi/models"
+	"rbi/tenant"
+	"strings"
+	"time"
+)
+
+type deactivateRequest struct {
+	UserID   uint   `json:"userId"`
+	Username string `json:"username"`
+	// 接收该用户自动化脚本的用户名，为空时按 Archive 处理
+	TransferTo string `json:"transferTo"`
+	// 不转移时是否归档脚本，归档的脚本不再列出和执行，重新启用账号后恢复
+	Archive bool `json:"archive"`
+}
+
+// findUser 查找调用者可以管理的用户：全局管理员不受限制，其他人只能管理本租户内的非全局管理员
+func findUser(id *auth.Identity, userID uint, username string) (*models.User, error) {
+	var user models.User
+	query := Db.Where("user_id = ?", userID)
+	if userID == 0 {
+		query = Db.Where("username = ?", username)
+	}
+	if !id.IsAdmin {
+		query = query.Scopes(id.Scope).Where("is_admin = ?", false)
+	}
+	err := query.First(&user).Error
+	return &user, err
+}
+
+// checkManageable 不能停用或启用自己和权限高于自己的账号：全局管理员和租户管理员只能由全局管理员处理，
+// 其他账号的角色权限不能超过调用者
+func checkManageable(id *auth.Identity, user *models.User) error {
+	if user.UserID == id.UserID {
+		return errors.New("You cannot change the status of your own account")
+	}
+	if id.IsAdmin {
+		return nil
+	}
+	if user.IsAdmin || user.TenantAdmin {
+		return errors.New("Only global admins can change the status of admin accounts")
+	}
+	var withRoles models.User
+	if err := Db.Preload("Roles.Permissions").First(&withRoles, user.UserID).Error; err != nil {
+		return err
+	}
+	if err := checkAssignable(id, withRoles.Roles); err != nil {
+		return errors.New("User has permissions you do not have")
+	}
+	return nil
+}
+
+// deactivateUser 停用账号：作废会话和 API Key，停止容器，转移或归档自动化脚本
+func deactivateUser(w http.ResponseWriter, r *http.Request) {
+	var req deactivateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.UserID == 0 && req.Username == "") {
+		writeResult(w, http.StatusBadRequest, "userId or username is required", nil)
+		return
+	}
+	id := auth.Current(r)
+	user, err := findUser(id, req.UserID, req.Username)
+	if err != nil {
+		writeResult(w, http.StatusNotFound, "User not found", nil)
+		return
+	}
+	if err := checkManageable(id, user); err != nil {
+		writeResult(w, http.StatusForbidden, err.Error(), nil)
+		return
+	}
+	if user.Disabled() {
+		writeResult(w, http.StatusConflict, "User is already deactivated", nil)
+		return
+	}
+	if user.IsAdmin {
+		var admins int64
+		Db.Model(&models.User{}).Where("is_admin = ? AND disabled_at IS NULL AND user_id <> ?", true, user.UserID).Count(&admins)
+		if admins == 0 {
+			writeResult(w, http.StatusBadRequest, "Cannot deactivate the last active admin", nil)
+			return
+		}
+	}
+	var target *models.User
+	if req.TransferTo != "" {
+		// 脚本只能转给同一租户的用户
+		target, err = findUser(id, 0, req.TransferTo)
+		if err != nil || target.Disabled() || target.UserID == user.UserID || target.TenantID != user.TenantID {
+			writeResult(w, http.StatusBadRequest, "Invalid transferTo user", nil)
+			return
+		}
+	}
+
+	now := time.Now()
+	var moved int64
+	err = Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Update("disabled_at", now).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.APIKey{}).Where("user_id = ? AND revoked_at IS NULL", user.UserID).
+			Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		scripts := tx.Model(&models.Automation{}).Where("user_id = ?", user.UserID)
+		var result *gorm.DB
+		switch {
+		case target != nil:
+			result = scripts.Update("user_id", target.UserID)
+		case req.Archive:
+			result = scripts.Update("archived", true)
+		default:
+			return nil
+		}
+		moved = result.RowsAffected
+		return result.Error
+	})
+	if err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	if err := auth.RevokeUser(user.UserID); err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	stopped, err := containers.StopUserContainers(user.UserID)
+	if err != nil {
+		log.Printf("Failed to stop containers of user %d: %v", user.UserID, err)
+	}
+
+	reason := []string{"by " + id.Username}
+	switch {
+	case target != nil:
+		reason = append(reason, "scripts transferred to "+target.Username)
+	case req.Archive:
+		reason = append(reason, "scripts archived")
+	}
+	authLog(r, models.AuthUserDisabled, user.Username, user.UserID, strings.Join(reason, ", "))
+	writeResult(w, http.StatusOK, "User deactivated", map[string]interface{}{
+		"userId":            user.UserID,
+		"username":          user.Username,
+		"scripts":           moved,
+		"stoppedContainers": stopped,
+	})
+}
+
+// reactivateUser 重新启用账号并恢复归档的脚本，已作废的会话和 API Key 不恢复
+func reactivateUser(w http.ResponseWriter, r *http.Request) {
+	var req deactivateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.UserID == 0 && req.Username == "") {
+		writeResult(w, http.StatusBadRequest, "userId or username is required", nil)
+		return
+	}
+	user, err := findUser(auth.Current(r), req.UserID, req.Username)
+	if err != nil {
+		writeResult(w, http.StatusNotFound, "User not found", nil)
+		return
+	}
+	if err := checkManageable(auth.Current(r), user); err != nil {
+		writeResult(w, http.StatusForbidden, err.Error(), nil)
+		return
+	}
+	if !user.Disabled() {
+		writeResult(w, http.StatusConflict, "User is not deactivated", nil)
+		return
+	}
+	if err := tenant.CheckQuota(user.TenantID, tenant.QuotaUsers); err != nil {
+		tenant.WriteQuotaError(w, err)
+		return
+	}
+	err = Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Update("disabled_at", nil).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.Automation{}).Where("user_id = ? AND archived = ?", user.UserID, true).
+			Update("archived", false).Error
+	})
+	if err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	authLog(r, models.AuthUserEnabled, user.Username, user.UserID, "by "+auth.Current(r).Username)
+	writeResult(w, http.StatusOK, "User reactivated", map[string]interface{}{"userId": user.UserID, "username": user.Username})
+}
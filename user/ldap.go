@@ -0,0 +1,183 @@
+package user
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"gorm.io/gorm"
+	"net"
+	"rbi/config"
+	"rbi/models"
+	"rbi/tenant"
+	"strings"
+	"time"
+)
+
+// ldapConn 用到的 *ldap.Conn 方法，便于替换为其它实现
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// ldapAuthenticator 先用服务账号查找用户 DN，再以用户 DN 和密码 bind 校验
+type ldapAuthenticator struct {
+	conf config.LDAPConf
+	dial func() (ldapConn, error)
+}
+
+func newLDAPAuthenticator(conf config.LDAPConf) *ldapAuthenticator {
+	a := &ldapAuthenticator{conf: conf}
+	a.dial = a.dialURL
+	return a
+}
+
+func (a *ldapAuthenticator) Name() string { return models.UserSourceLDAP }
+
+func (a *ldapAuthenticator) timeout() time.Duration {
+	if a.conf.TimeoutSeconds > 0 {
+		return time.Duration(a.conf.TimeoutSeconds) * time.Second
+	}
+	return 10 * time.Second
+}
+
+func (a *ldapAuthenticator) dialURL() (ldapConn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: a.conf.InsecureSkipVerify}
+	conn, err := ldap.DialURL(a.conf.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: a.timeout()}),
+		ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(a.timeout())
+	if a.conf.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// ldapEntry 目录中查到的用户
+type ldapEntry struct {
+	DN     string
+	Groups []string
+}
+
+func (a *ldapAuthenticator) Authenticate(username, password string) (*models.User, error) {
+	// 空密码的 bind 在多数目录上是匿名 bind，会直接成功
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	conn, err := a.dial()
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Close()
+
+	entry, err := a.find(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("bind %s: %w", entry.DN, err)
+	}
+	return a.provision(username, entry)
+}
+
+func (a *ldapAuthenticator) find(conn ldapConn, username string) (*ldapEntry, error) {
+	if a.conf.BindDN != "" {
+		if err := conn.Bind(a.conf.BindDN, a.conf.BindPassword); err != nil {
+			return nil, fmt.Errorf("service bind: %w", err)
+		}
+	}
+	filter := a.conf.UserFilter
+	if filter == "" {
+		filter = "(uid={username})"
+	}
+	filter = strings.ReplaceAll(filter, "{username}", ldap.EscapeFilter(username))
+	groupAttr := a.conf.GroupAttribute
+	if groupAttr == "" {
+		groupAttr = "memberOf"
+	}
+	req := ldap.NewSearchRequest(a.conf.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(a.timeout().Seconds()), false, filter, []string{"dn", groupAttr}, nil)
+	result, err := conn.Search(req)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return nil, fmt.Errorf("filter matches more than one entry for %s", username)
+		}
+		return nil, fmt.Errorf("search: %w", err)
+	}
+	switch len(result.Entries) {
+	case 0:
+		return nil, ErrUnknownUser
+	case 1:
+	default:
+		return nil, fmt.Errorf("filter matches more than one entry for %s", username)
+	}
+	e := result.Entries[0]
+	return &ldapEntry{DN: e.DN, Groups: e.GetAttributeValues(groupAttr)}, nil
+}
+
+// provision 找到或创建本地用户，并按组映射同步角色
+func (a *ldapAuthenticator) provision(username string, entry *ldapEntry) (*models.User, error) {
+	var user models.User
+	err := Db.Where("username = ?", username).First(&user).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		if !a.conf.Provision {
+			return nil, ErrUnknownUser
+		}
+		if err := tenant.CheckQuota(models.DefaultTenantID, tenant.QuotaUsers); err != nil {
+			return nil, err
+		}
+		// 自动创建的账号进入默认租户，由全局管理员再分配
+		user = models.User{Username: username, Source: models.UserSourceLDAP, ExternalID: entry.DN, TenantID: models.DefaultTenantID}
+	case err != nil:
+		return nil, err
+	case isLocal(&user):
+		// 不接管同名的本地账号
+		return nil, ErrUnknownUser
+	}
+	user.ExternalID = entry.DN
+
+	roles, err := a.roles(entry.Groups)
+	if err != nil {
+		return nil, err
+	}
+	err = Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Roles").Save(&user).Error; err != nil {
+			return err
+		}
+		return tx.Model(&user).Association("Roles").Replace(roles)
+	})
+	if err != nil {
+		return nil, err
+	}
+	user.Roles = roles
+	return &user, nil
+}
+
+// roles 组 DN 映射到的角色，没有任何映射时使用默认角色
+func (a *ldapAuthenticator) roles(groups []string) ([]models.Role, error) {
+	var names []string
+	for _, group := range groups {
+		for dn, mapped := range a.conf.GroupRoles {
+			if strings.EqualFold(dn, group) {
+				names = append(names, mapped...)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return defaultRoles(), nil
+	}
+	var roles []models.Role
+	err := Db.Where("name IN ?", names).Find(&roles).Error
+	return roles, err
+}
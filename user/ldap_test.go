@@ -0,0 +1,216 @@
+package user
+
+import (
+	"errors"
+	"github.com/go-ldap/ldap/v3"
+	"rbi/config"
+	"rbi/models"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fakeDirectory 进程内的 LDAP 目录，按 (uid=...) 匹配用户，密码按 DN 保存
+type fakeDirectory struct {
+	entries   []*ldap.Entry
+	passwords map[string]string
+	// 服务账号 bind 返回的错误
+	serviceErr error
+	binds      []string
+	filters    []string
+}
+
+func (d *fakeDirectory) add(dn, uid, password string, groups ...string) {
+	d.entries = append(d.entries, ldap.NewEntry(dn, map[string][]string{"uid": {uid}, "memberOf": groups}))
+	if d.passwords == nil {
+		d.passwords = map[string]string{}
+	}
+	d.passwords[dn] = password
+}
+
+func (d *fakeDirectory) dial() (ldapConn, error) { return d, nil }
+
+func (d *fakeDirectory) Bind(dn, password string) error {
+	d.binds = append(d.binds, dn)
+	if dn == testServiceDN {
+		return d.serviceErr
+	}
+	if want, ok := d.passwords[dn]; !ok || want != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	return nil
+}
+
+// Search 和真实目录一样只认转义后的值，超过 SizeLimit 时返回 SizeLimitExceeded
+func (d *fakeDirectory) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	d.filters = append(d.filters, req.Filter)
+	result := &ldap.SearchResult{}
+	for _, e := range d.entries {
+		if strings.Contains(req.Filter, "(uid="+ldap.EscapeFilter(e.GetAttributeValue("uid"))+")") {
+			result.Entries = append(result.Entries, e)
+		}
+	}
+	if req.SizeLimit > 0 && len(result.Entries) > req.SizeLimit {
+		result.Entries = result.Entries[:req.SizeLimit]
+		return result, ldap.NewError(ldap.LDAPResultSizeLimitExceeded, errors.New("size limit exceeded"))
+	}
+	return result, nil
+}
+
+func (d *fakeDirectory) Close() error { return nil }
+
+const testServiceDN = "cn=readonly,dc=example,dc=com"
+
+func newTestLDAP(d *fakeDirectory) *ldapAuthenticator {
+	a := newLDAPAuthenticator(config.LDAPConf{
+		BindDN:       testServiceDN,
+		BindPassword: "secret",
+		BaseDN:       "dc=example,dc=com",
+		UserFilter:   "(&(objectClass=person)(uid={username}))",
+		GroupRoles: map[string][]string{
+			"cn=rbi-admins,ou=groups,dc=example,dc=com": {roleAdmin},
+		},
+		Provision: true,
+	})
+	a.dial = d.dial
+	return a
+}
+
+func roleNames(roles []models.Role) []string {
+	var names []string
+	for _, r := range roles {
+		names = append(names, r.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestLDAPBindFailure(t *testing.T) {
+	d := &fakeDirectory{}
+	d.add("uid=ldap-alice,ou=people,dc=example,dc=com", "ldap-alice", "right")
+	a := newTestLDAP(d)
+
+	if _, err := a.Authenticate("ldap-alice", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("wrong password: got %v, want ErrInvalidCredentials", err)
+	}
+	if _, err := a.Authenticate("ldap-alice", ""); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("empty password: got %v, want ErrInvalidCredentials", err)
+	}
+	if len(d.binds) != 2 {
+		t.Fatalf("empty password must not reach the directory, binds: %v", d.binds)
+	}
+
+	d.serviceErr = ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	_, err := a.Authenticate("ldap-alice", "right")
+	if err == nil || errors.Is(err, ErrInvalidCredentials) || !strings.Contains(err.Error(), "service bind") {
+		t.Fatalf("service bind failure: got %v", err)
+	}
+}
+
+func TestLDAPSearchEntries(t *testing.T) {
+	d := &fakeDirectory{}
+	d.add("uid=ldap-dup,ou=a,dc=example,dc=com", "ldap-dup", "pw")
+	d.add("uid=ldap-dup,ou=b,dc=example,dc=com", "ldap-dup", "pw")
+	a := newTestLDAP(d)
+
+	if _, err := a.Authenticate("ldap-nobody", "pw"); !errors.Is(err, ErrUnknownUser) {
+		t.Fatalf("zero entries: got %v, want ErrUnknownUser", err)
+	}
+	_, err := a.Authenticate("ldap-dup", "pw")
+	if err == nil || !strings.Contains(err.Error(), "more than one entry") {
+		t.Fatalf("multiple entries: got %v", err)
+	}
+	for _, dn := range d.binds {
+		if dn != testServiceDN {
+			t.Fatalf("ambiguous user must not be bound, binds: %v", d.binds)
+		}
+	}
+}
+
+func TestLDAPGroupRoles(t *testing.T) {
+	d := &fakeDirectory{}
+	// 组 DN 大小写不敏感
+	d.add("uid=ldap-admin,ou=people,dc=example,dc=com", "ldap-admin", "pw", "CN=RBI-Admins,OU=Groups,DC=example,DC=com")
+	d.add("uid=ldap-plain,ou=people,dc=example,dc=com", "ldap-plain", "pw", "cn=other,ou=groups,dc=example,dc=com")
+	a := newTestLDAP(d)
+
+	u, err := a.Authenticate("ldap-admin", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := roleNames(u.Roles); len(got) != 1 || got[0] != roleAdmin {
+		t.Fatalf("mapped roles: got %v, want [%s]", got, roleAdmin)
+	}
+	if u.Source != models.UserSourceLDAP || u.TenantID != models.DefaultTenantID {
+		t.Fatalf("provisioned user: source=%q tenant=%d", u.Source, u.TenantID)
+	}
+
+	u, err = a.Authenticate("ldap-plain", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := roleNames(u.Roles), roleNames(defaultRoles()); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("unmapped groups: got %v, want default roles %v", got, want)
+	}
+
+	// 组变化后重新登录，角色整体替换
+	d.entries[0] = ldap.NewEntry(d.entries[0].DN, map[string][]string{"uid": {"ldap-admin"}})
+	u, err = a.Authenticate("ldap-admin", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored models.User
+	Db.Preload("Roles").First(&stored, u.UserID)
+	if got := roleNames(stored.Roles); strings.Join(got, ",") != strings.Join(roleNames(defaultRoles()), ",") {
+		t.Fatalf("roles after leaving group: got %v", got)
+	}
+}
+
+func TestLDAPProvision(t *testing.T) {
+	d := &fakeDirectory{}
+	d.add("uid=ldap-new,ou=people,dc=example,dc=com", "ldap-new", "pw")
+	d.add("uid=ldap-local,ou=people,dc=example,dc=com", "ldap-local", "pw")
+	a := newTestLDAP(d)
+
+	a.conf.Provision = false
+	if _, err := a.Authenticate("ldap-new", "pw"); !errors.Is(err, ErrUnknownUser) {
+		t.Fatalf("provision disabled: got %v, want ErrUnknownUser", err)
+	}
+
+	// 不接管同名的本地账号
+	Db.Create(&models.User{Username: "ldap-local", Source: models.UserSourceLocal, TenantID: models.DefaultTenantID})
+	a.conf.Provision = true
+	if _, err := a.Authenticate("ldap-local", "pw"); !errors.Is(err, ErrUnknownUser) {
+		t.Fatalf("local account: got %v, want ErrUnknownUser", err)
+	}
+}
+
+func TestLDAPEscaping(t *testing.T) {
+	d := &fakeDirectory{}
+	// DN 中带转义逗号，bind 和保存时必须原样使用目录返回的 DN
+	dn := `cn=Smith\, John,ou=people,dc=example,dc=com`
+	d.add(dn, "ldap-smith", "pw")
+	d.add("uid=ldap-x1,ou=people,dc=example,dc=com", "ldap-x1", "pw")
+	d.add("uid=ldap-x2,ou=people,dc=example,dc=com", "ldap-x2", "pw")
+	a := newTestLDAP(d)
+
+	u, err := a.Authenticate("ldap-smith", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.binds[len(d.binds)-1] != dn || u.ExternalID != dn {
+		t.Fatalf("bind DN %q, ExternalID %q, want %q", d.binds[len(d.binds)-1], u.ExternalID, dn)
+	}
+
+	// 登录名中的过滤器特殊字符必须转义，不能匹配到其他用户
+	for _, name := range []string{"*", "ldap-x*", "ldap-x1)(uid=*", `ldap-x1\`} {
+		d.filters = nil
+		if _, err := a.Authenticate(name, "pw"); !errors.Is(err, ErrUnknownUser) {
+			t.Fatalf("username %q: got %v, want ErrUnknownUser", name, err)
+		}
+		want := "(&(objectClass=person)(uid=" + ldap.EscapeFilter(name) + "))"
+		if len(d.filters) != 1 || d.filters[0] != want {
+			t.Fatalf("username %q: filter %v, want %s", name, d.filters, want)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package user
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"rbi/audit"
+	"rbi/auth"
+	"rbi/config"
+	"rbi/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func userKey(username string) string { return "user:" + strings.ToLower(username) }
+func ipKey(ip string) string         { return "ip:" + ip }
+
+// lockedUntil 用户名或 IP 任一处于锁定中时返回解锁时间
+func lockedUntil(username, ip string) (time.Time, bool) {
+	var throttles []models.LoginThrottle
+	Db.Where("subject IN ? AND locked_until > ?", []string{userKey(username), ipKey(ip)}, time.Now()).Find(&throttles)
+	var until time.Time
+	for _, t := range throttles {
+		if t.LockedUntil.After(until) {
+			until = t.LockedUntil
+		}
+	}
+	return until, !until.IsZero()
+}
+
+// recordFailure 累加失败次数，超过阈值后锁定，锁定时长随连续锁定次数指数增长
+func recordFailure(key string, max int) {
+	if max <= 0 {
+		return
+	}
+	conf := config.Config.Lockout
+	now := time.Now()
+	t := models.LoginThrottle{Subject: key}
+	Db.FirstOrInit(&t, models.LoginThrottle{Subject: key})
+	window := time.Duration(conf.WindowMinutes) * time.Minute
+	if t.Failures == 0 || (window > 0 && now.Sub(t.FirstFailAt) > window) {
+		t.Failures = 0
+		t.FirstFailAt = now
+	}
+	t.Failures++
+	if t.Failures >= max {
+		t.LockedUntil = now.Add(lockDuration(t.Lockouts))
+		t.Lockouts++
+		t.Failures = 0
+	}
+	if err := Db.Save(&t).Error; err != nil {
+		log.Printf("Failed to save login throttle %s: %v", key, err)
+	}
+}
+
+func lockDuration(lockouts int) time.Duration {
+	conf := config.Config.Lockout
+	d := time.Duration(conf.BaseLockSeconds) * time.Second
+	if d <= 0 {
+		d = time.Minute
+	}
+	limit := time.Duration(conf.MaxLockMinutes) * time.Minute
+	for i := 0; i < lockouts && (limit <= 0 || d < limit); i++ {
+		d *= 2
+	}
+	if limit > 0 && d > limit {
+		d = limit
+	}
+	return d
+}
+
+// loginFailed 同时计入用户名和 IP
+func loginFailed(username, ip string) {
+	recordFailure(userKey(username), config.Config.Lockout.MaxAttempts)
+	recordFailure(ipKey(ip), config.Config.Lockout.IPMaxAttempts)
+}
+
+// loginSucceeded 清除该用户名的失败记录，IP 计数按窗口自然过期
+func loginSucceeded(username string) {
+	Db.Delete(&models.LoginThrottle{}, "subject = ?", userKey(username))
+}
+
+// authLog 写入认证日志，同时记入审计事件
+func authLog(r *http.Request, event, username string, userID uint, reason string) {
+	entry := &models.AuthLog{
+		Event:     event,
+		Username:  username,
+		UserID:    userID,
+		IP:        auth.ClientIP(r),
+		UserAgent: r.UserAgent(),
+		Reason:    reason,
+	}
+	if err := Db.Create(entry).Error; err != nil {
+		log.Printf("Failed to save auth log: %v", err)
+	}
+	category, outcome := models.AuditAuth, models.AuditSuccess
+	switch event {
+	case models.AuthLoginFailed:
+		outcome = models.AuditFailure
+	case models.AuthLoginLocked:
+		outcome = models.AuditDenied
+	case models.AuthUserDisabled, models.AuthUserEnabled:
+		category = models.AuditUser
+	}
+	audit.RecordAs(r, userID, username, category, event, username, outcome, reason)
+}
+
+type unlockRequest struct {
+	Username string `json:"username"`
+	IP       string `json:"ip"`
+}
+
+// unlockLogin 管理员解除用户名或 IP 的锁定
+func unlockLogin(w http.ResponseWriter, r *http.Request) {
+	var req unlockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Username == "" && req.IP == "") {
+		writeResult(w, http.StatusBadRequest, "username or ip is required", nil)
+		return
+	}
+	var keys []string
+	if req.Username != "" {
+		keys = append(keys, userKey(req.Username))
+	}
+	if req.IP != "" {
+		keys = append(keys, ipKey(req.IP))
+	}
+	if err := Db.Delete(&models.LoginThrottle{}, "subject IN ?", keys).Error; err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	authLog(r, models.AuthUnlock, req.Username, 0, "by "+auth.Current(r).Username+" "+strings.Join(keys, ","))
+	writeResult(w, http.StatusOK, "Unlocked", nil)
+}
+
+// listLockouts 当前处于锁定中的用户名和 IP
+func listLockouts(w http.ResponseWriter, r *http.Request) {
+	var throttles []models.LoginThrottle
+	if err := Db.Where("locked_until > ?", time.Now()).Order("locked_until desc").Find(&throttles).Error; err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	writeResult(w, http.StatusOK, "ok", throttles)
+}
+
+// listAuthLogs 认证日志，可按 username、event 过滤；非全局管理员只能看到本租户用户的日志
+func listAuthLogs(w http.ResponseWriter, r *http.Request) {
+	query := Db.Order("id desc")
+	if id := auth.Current(r); !id.IsAdmin {
+		query = query.Where("user_id IN (?)", Db.Model(&models.User{}).Select("user_id").Where("tenant_id = ?", id.TenantID))
+	}
+	if username := r.URL.Query().Get("username"); username != "" {
+		query = query.Where("username = ?", username)
+	}
+	if event := r.URL.Query().Get("event"); event != "" {
+		query = query.Where("event = ?", event)
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 200
+	}
+	var logs []models.AuthLog
+	if err := query.Limit(limit).Find(&logs).Error; err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	writeResult(w, http.StatusOK, "ok", logs)
+}
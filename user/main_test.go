@@ -0,0 +1,16 @@
+package user
+
+import (
+	"os"
+	"rbi/tenant"
+	"testing"
+)
+
+// 测试使用包目录下临时创建的 rbi.db，结束后删除
+func TestMain(m *testing.M) {
+	tenant.Seed()
+	Seed()
+	code := m.Run()
+	os.Remove("rbi.db")
+	os.Exit(code)
+}
@@ -0,0 +1,325 @@
+package user
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+	"net/url"
+	"rbi/auth"
+	"rbi/config"
+	"rbi/models"
+	"rbi/oidc"
+	"rbi/tenant"
+	"sync"
+	"time"
+)
+
+const (
+	// 发起登录到回调之间允许的时间
+	oidcLoginTTL = 10 * time.Minute
+	// 回调签发的 ticket 由前端换取令牌的有效期
+	oidcTicketTTL = time.Minute
+	// 保存 state 的 cookie，回调时必须与查询参数一致，防止把别人的授权码注入当前浏览器
+	oidcStateCookie = "rbi_oidc_state"
+)
+
+// oidcLogin 一次进行中的授权请求
+type oidcLogin struct {
+	nonce    string
+	verifier string
+	expires  time.Time
+}
+
+// oidcTicket 回调完成后等待前端换取的登录结果，令牌不出现在跳转地址中。
+// 启用了两步验证的账号只保存 challenge，由 /login/totp 完成登录
+type oidcTicket struct {
+	result    loginResult
+	challenge string
+	expires   time.Time
+}
+
+var oidcState = struct {
+	sync.Mutex
+	provider *oidc.Provider
+	logins   map[string]oidcLogin
+	tickets  map[string]oidcTicket
+}{logins: map[string]oidcLogin{}, tickets: map[string]oidcTicket{}}
+
+// oidcProvider 首次使用时读取 discovery 文档，失败时下次请求重试
+func oidcProvider(ctx context.Context) (*oidc.Provider, error) {
+	oidcState.Lock()
+	defer oidcState.Unlock()
+	if oidcState.provider != nil {
+		return oidcState.provider, nil
+	}
+	conf := config.Config.Auth.OIDC
+	provider, err := oidc.Discover(ctx, oidc.Config{
+		Issuer:       conf.Issuer,
+		ClientID:     conf.ClientID,
+		ClientSecret: conf.ClientSecret,
+		RedirectURL:  conf.RedirectURL,
+		Scopes:       conf.Scopes,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	oidcState.provider = provider
+	return provider, nil
+}
+
+// expireOIDC 清理过期的授权请求和 ticket，调用方持有锁
+func expireOIDC(now time.Time) {
+	for k, v := range oidcState.logins {
+		if now.After(v.expires) {
+			delete(oidcState.logins, k)
+		}
+	}
+	for k, v := range oidcState.tickets {
+		if now.After(v.expires) {
+			delete(oidcState.tickets, k)
+		}
+	}
+}
+
+// oidcStart 生成 state、nonce 和 PKCE verifier 后跳转到提供方
+func oidcStart(w http.ResponseWriter, r *http.Request) {
+	if !config.Config.Auth.OIDC.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	provider, err := oidcProvider(r.Context())
+	if err != nil {
+		log.Printf("OIDC discovery: %v", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	state := oidc.RandomString()
+	login := oidcLogin{nonce: oidc.RandomString(), verifier: oidc.RandomString(), expires: time.Now().Add(oidcLoginTTL)}
+	oidcState.Lock()
+	expireOIDC(time.Now())
+	oidcState.logins[state] = login
+	oidcState.Unlock()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   config.Config.Auth.CookieSecure,
+		// 提供方跳转回来是跨站的顶层 GET，Strict 时不会带上
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, provider.AuthCodeURL(state, login.nonce, login.verifier), http.StatusFound)
+}
+
+// oidcCallback 用授权码换取并校验 ID Token，建立会话后带 ticket 跳回前端
+func oidcCallback(w http.ResponseWriter, r *http.Request) {
+	conf := config.Config.Auth.OIDC
+	if !conf.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	state := q.Get("state")
+	// state 必须是本浏览器发起的登录
+	cookie, err := r.Cookie(oidcStateCookie)
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/", MaxAge: -1, HttpOnly: true,
+		Secure: config.Config.Auth.CookieSecure, SameSite: http.SameSiteLaxMode})
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		http.Error(w, "Invalid or expired login state", http.StatusBadRequest)
+		return
+	}
+	oidcState.Lock()
+	login, ok := oidcState.logins[state]
+	delete(oidcState.logins, state)
+	oidcState.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		http.Error(w, "Invalid or expired login state", http.StatusBadRequest)
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		authLog(r, models.AuthLoginFailed, "", 0, "oidc: "+e+" "+q.Get("error_description"))
+		oidcRedirect(w, r, url.Values{"error": {e}})
+		return
+	}
+
+	provider, err := oidcProvider(r.Context())
+	if err != nil {
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	token, err := provider.Exchange(r.Context(), q.Get("code"), login.verifier)
+	if err != nil {
+		log.Printf("OIDC exchange: %v", err)
+		authLog(r, models.AuthLoginFailed, "", 0, "oidc: "+err.Error())
+		oidcRedirect(w, r, url.Values{"error": {"exchange_failed"}})
+		return
+	}
+	claims, err := provider.Verify(r.Context(), token.IDToken, login.nonce)
+	if err != nil {
+		log.Printf("OIDC verify: %v", err)
+		authLog(r, models.AuthLoginFailed, "", 0, "oidc: "+err.Error())
+		oidcRedirect(w, r, url.Values{"error": {"invalid_id_token"}})
+		return
+	}
+
+	user, err := oidcProvision(claims)
+	if err == nil && user.Disabled() {
+		err = ErrDisabled
+	}
+	if err != nil {
+		authLog(r, models.AuthLoginFailed, claims.String(usernameClaim()), 0, "oidc: "+err.Error())
+		oidcRedirect(w, r, url.Values{"error": {"access_denied"}})
+		return
+	}
+	// 绑定了两步验证的账号和密码登录一样要再输入验证码
+	if user.TOTPEnabled {
+		ticket := oidc.RandomString()
+		oidcState.Lock()
+		oidcState.tickets[ticket] = oidcTicket{challenge: newTOTPChallenge(user), expires: time.Now().Add(oidcTicketTTL)}
+		oidcState.Unlock()
+		oidcRedirect(w, r, url.Values{"ticket": {ticket}})
+		return
+	}
+	tokens, err := auth.Issue(user, r)
+	if err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	authLog(r, models.AuthLoginSuccess, user.Username, user.UserID, "oidc")
+
+	ticket := oidc.RandomString()
+	oidcState.Lock()
+	oidcState.tickets[ticket] = oidcTicket{
+		result:  loginResult{Tokens: tokens, UserID: user.UserID, Username: user.Username, IsAdmin: user.IsAdmin},
+		expires: time.Now().Add(oidcTicketTTL),
+	}
+	oidcState.Unlock()
+	oidcRedirect(w, r, url.Values{"ticket": {ticket}})
+}
+
+// oidcRedirect 跳回前端登录页
+func oidcRedirect(w http.ResponseWriter, r *http.Request, params url.Values) {
+	target := config.Config.Auth.OIDC.PostLoginRedirect
+	if target == "" {
+		target = "/login"
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		http.Error(w, "Invalid postLoginRedirect", http.StatusInternalServerError)
+		return
+	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// oidcExchange 前端用一次性 ticket 换取登录令牌
+func oidcExchange(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Ticket string `json:"ticket"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Ticket == "" {
+		writeResult(w, http.StatusBadRequest, "Missing ticket", nil)
+		return
+	}
+	oidcState.Lock()
+	ticket, ok := oidcState.tickets[req.Ticket]
+	delete(oidcState.tickets, req.Ticket)
+	oidcState.Unlock()
+	if !ok || time.Now().After(ticket.expires) {
+		writeResult(w, http.StatusUnauthorized, "Invalid or expired ticket", nil)
+		return
+	}
+	if ticket.challenge != "" {
+		writeResult(w, http.StatusAccepted, "Verification code required", map[string]interface{}{
+			"totpRequired": true,
+			"challenge":    ticket.challenge,
+		})
+		return
+	}
+	auth.SetCookie(w, ticket.result.Tokens)
+	writeResult(w, http.StatusOK, "Login successful", ticket.result)
+}
+
+func usernameClaim() string {
+	if c := config.Config.Auth.OIDC.UsernameClaim; c != "" {
+		return c
+	}
+	return "preferred_username"
+}
+
+// oidcProvision 按 iss|sub 找到或创建本地用户，并按 claim 映射同步角色
+func oidcProvision(claims oidc.Claims) (*models.User, error) {
+	conf := config.Config.Auth.OIDC
+	externalID := claims.String("iss") + "|" + claims.String("sub")
+	username := claims.String(usernameClaim())
+	if username == "" {
+		return nil, errors.New("missing claim " + usernameClaim())
+	}
+
+	var user models.User
+	err := Db.Where("source = ? AND external_id = ?", models.UserSourceOIDC, externalID).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = Db.Where("username = ?", username).First(&user).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			if !conf.Provision {
+				return nil, ErrUnknownUser
+			}
+			if err := tenant.CheckQuota(models.DefaultTenantID, tenant.QuotaUsers); err != nil {
+				return nil, err
+			}
+			// 自动创建的账号进入默认租户，由全局管理员再分配
+			user = models.User{Username: username, Source: models.UserSourceOIDC, TenantID: models.DefaultTenantID}
+			err = nil
+		case err == nil:
+			// 不接管同名的本地、LDAP 或其它身份的账号
+			return nil, errors.New("username " + username + " is taken by another account")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	user.ExternalID = externalID
+
+	roles, err := oidcRoles(claims)
+	if err != nil {
+		return nil, err
+	}
+	err = Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Roles").Save(&user).Error; err != nil {
+			return err
+		}
+		return tx.Model(&user).Association("Roles").Replace(roles)
+	})
+	if err != nil {
+		return nil, err
+	}
+	user.Roles = roles
+	return &user, nil
+}
+
+// oidcRoles claim 值映射到的角色，没有任何映射时使用默认角色
+func oidcRoles(claims oidc.Claims) ([]models.Role, error) {
+	conf := config.Config.Auth.OIDC
+	var names []string
+	if conf.RolesClaim != "" {
+		for _, value := range claims.Strings(conf.RolesClaim) {
+			names = append(names, conf.ClaimRoles[value]...)
+		}
+	}
+	if len(names) == 0 {
+		return defaultRoles(), nil
+	}
+	var roles []models.Role
+	err := Db.Where("name IN ?", names).Find(&roles).Error
+	return roles, err
+}
@@ -0,0 +1,251 @@
+package user
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"rbi/auth"
+	"rbi/config"
+	"rbi/models"
+	"rbi/oidc/oidctest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testCallback = "http://rbi.test/oidc/callback"
+
+// setupOIDC 启动测试提供方并指向它，每个测试重新读取 discovery
+func setupOIDC(t *testing.T, username string) *oidctest.Issuer {
+	t.Helper()
+	iss := oidctest.NewIssuer("rbi", "secret")
+	iss.Claims = map[string]interface{}{"sub": username, "preferred_username": username}
+	old := config.Config.Auth.OIDC
+	config.Config.Auth.OIDC = config.OIDCConf{Enabled: true, Issuer: iss.URL, ClientID: iss.ClientID, ClientSecret: iss.ClientSecret,
+		RedirectURL: testCallback, Provision: true, PostLoginRedirect: "/login", RolesClaim: "groups",
+		ClaimRoles: map[string][]string{"mfa": {"oidc-mfa"}}}
+	oidcState.Lock()
+	oidcState.provider = nil
+	oidcState.Unlock()
+	t.Cleanup(func() {
+		iss.Close()
+		config.Config.Auth.OIDC = old
+		oidcState.Lock()
+		oidcState.provider = nil
+		oidcState.Unlock()
+	})
+	return iss
+}
+
+// startOIDC 发起登录，返回 state cookie 和提供方跳回的回调地址
+func startOIDC(t *testing.T, iss *oidctest.Issuer) (*http.Cookie, string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	oidcStart(w, httptest.NewRequest(http.MethodGet, "/oidc/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("start: %d %s", w.Code, w.Body)
+	}
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == oidcStateCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("state cookie: %+v", cookie)
+	}
+
+	client := iss.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback := resp.Header.Get("Location")
+	if !strings.HasPrefix(callback, testCallback) {
+		t.Fatalf("authorize redirected to %q", callback)
+	}
+	if u, _ := url.Parse(callback); u.Query().Get("state") != cookie.Value {
+		t.Fatalf("state %q does not match cookie %q", u.Query().Get("state"), cookie.Value)
+	}
+	return cookie, callback
+}
+
+// callback 带上 cookie 访问回调，成功时返回 ticket
+func callback(t *testing.T, callbackURL string, cookie *http.Cookie) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, callbackURL, nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	oidcCallback(w, r)
+	if w.Code != http.StatusFound {
+		return w, ""
+	}
+	u, _ := url.Parse(w.Header().Get("Location"))
+	return w, u.Query().Get("ticket")
+}
+
+type exchangeResponse struct {
+	Code   int `json:"code"`
+	Result struct {
+		Token        string `json:"token"`
+		TOTPRequired bool   `json:"totpRequired"`
+		Challenge    string `json:"challenge"`
+	} `json:"result"`
+}
+
+func exchange(t *testing.T, ticket string) exchangeResponse {
+	t.Helper()
+	w := httptest.NewRecorder()
+	oidcExchange(w, httptest.NewRequest(http.MethodPost, "/oidc/exchange", strings.NewReader(`{"ticket":"`+ticket+`"}`)))
+	var resp exchangeResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestOIDCLogin(t *testing.T) {
+	iss := setupOIDC(t, "oidc-alice")
+	cookie, cb := startOIDC(t, iss)
+	w, ticket := callback(t, cb, cookie)
+	if ticket == "" {
+		t.Fatalf("callback: %d %s %s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+	resp := exchange(t, ticket)
+	if resp.Code != http.StatusOK || resp.Result.Token == "" {
+		t.Fatalf("exchange: %+v", resp)
+	}
+	// ticket 只能换取一次
+	if resp := exchange(t, ticket); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("ticket reused: %+v", resp)
+	}
+	var user models.User
+	if err := Db.Where("username = ?", "oidc-alice").First(&user).Error; err != nil || user.Source != models.UserSourceOIDC {
+		t.Fatalf("provisioned user: %+v %v", user, err)
+	}
+}
+
+func TestOIDCStateCookie(t *testing.T) {
+	iss := setupOIDC(t, "oidc-bob")
+
+	// 没有 cookie，例如攻击者把自己的回调地址发给受害者
+	_, cb := startOIDC(t, iss)
+	if w, _ := callback(t, cb, nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("callback without cookie: %d", w.Code)
+	}
+
+	// 浏览器中的 cookie 属于另一次登录
+	victim, _ := startOIDC(t, iss)
+	_, attacker := startOIDC(t, iss)
+	if w, _ := callback(t, attacker, victim); w.Code != http.StatusBadRequest {
+		t.Fatalf("callback with another login's cookie: %d", w.Code)
+	}
+
+	// 回调消费掉 state，不能重放
+	cookie, cb := startOIDC(t, iss)
+	if _, ticket := callback(t, cb, cookie); ticket == "" {
+		t.Fatal("login failed")
+	}
+	if w, _ := callback(t, cb, cookie); w.Code != http.StatusBadRequest {
+		t.Fatalf("replayed callback: %d", w.Code)
+	}
+}
+
+func TestOIDCNonceAndPKCE(t *testing.T) {
+	iss := setupOIDC(t, "oidc-carol")
+	cookie, cb := startOIDC(t, iss)
+	// 授权码换到的 ID Token 带着另一次请求的 nonce
+	iss.Claims["nonce"] = "other"
+	if w, _ := callback(t, cb, cookie); !strings.Contains(w.Header().Get("Location"), "error=invalid_id_token") {
+		t.Fatalf("nonce mismatch: %d %s", w.Code, w.Header().Get("Location"))
+	}
+	delete(iss.Claims, "nonce")
+
+	// 服务端保存的 verifier 与授权请求的 challenge 不符时提供方拒绝换取
+	cookie, cb = startOIDC(t, iss)
+	state, _ := url.Parse(cb)
+	oidcState.Lock()
+	login := oidcState.logins[state.Query().Get("state")]
+	login.verifier = "wrong"
+	oidcState.logins[state.Query().Get("state")] = login
+	oidcState.Unlock()
+	if w, _ := callback(t, cb, cookie); !strings.Contains(w.Header().Get("Location"), "error=exchange_failed") {
+		t.Fatalf("PKCE mismatch: %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestOIDCTOTP(t *testing.T) {
+	iss := setupOIDC(t, "oidc-dave")
+	cookie, cb := startOIDC(t, iss)
+	if _, ticket := callback(t, cb, cookie); ticket == "" {
+		t.Fatal("first login failed")
+	}
+
+	// 绑定了两步验证的账号只能换到 challenge
+	Db.Model(&models.User{}).Where("username = ?", "oidc-dave").Update("totp_enabled", true)
+	cookie, cb = startOIDC(t, iss)
+	_, ticket := callback(t, cb, cookie)
+	resp := exchange(t, ticket)
+	if resp.Code != http.StatusAccepted || !resp.Result.TOTPRequired || resp.Result.Challenge == "" || resp.Result.Token != "" {
+		t.Fatalf("exchange with TOTP enabled: %+v", resp)
+	}
+	totpChallenges.Lock()
+	_, ok := totpChallenges.m[resp.Result.Challenge]
+	totpChallenges.Unlock()
+	if !ok {
+		t.Fatal("challenge not registered for /login/totp")
+	}
+}
+
+func TestOIDCRequireTOTPRole(t *testing.T) {
+	Db.Create(&models.Role{Name: "oidc-mfa", RequireTOTP: true})
+	iss := setupOIDC(t, "oidc-erin")
+	iss.Claims["groups"] = []string{"mfa"}
+	cookie, cb := startOIDC(t, iss)
+	_, ticket := callback(t, cb, cookie)
+	resp := exchange(t, ticket)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("exchange: %+v", resp)
+	}
+
+	router := mux.NewRouter()
+	RegisterRoutes(router)
+	router.Use(auth.Middleware)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+resp.Result.Token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	// 角色要求两步验证时，单点登录的会话同样只能访问绑定接口
+	if w := do(http.MethodGet, "/user/apikeys", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("unenrolled OIDC session: %d %s", w.Code, w.Body)
+	}
+
+	// 单点登录的账号可以自己绑定，绑定后恢复访问
+	w := do(http.MethodPost, "/user/totp/setup", "")
+	var setup struct {
+		Result struct {
+			Secret string `json:"secret"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&setup); err != nil || w.Code != http.StatusOK || setup.Result.Secret == "" {
+		t.Fatalf("setup: %d %v", w.Code, err)
+	}
+	secret, _ := totpEncoding.DecodeString(setup.Result.Secret)
+	code := totpCode(secret, time.Now().Unix()/totpPeriod)
+	if w := do(http.MethodPost, "/user/totp/enable", `{"code":"`+code+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("enable: %d %s", w.Code, w.Body)
+	}
+	if w := do(http.MethodGet, "/user/apikeys", ""); w.Code != http.StatusOK {
+		t.Fatalf("enrolled OIDC session: %d %s", w.Code, w.Body)
+	}
+}
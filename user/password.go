@@ -0,0 +1,303 @@
+package user
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"net/http"
+	"rbi/audit"
+	"rbi/auth"
+	"rbi/config"
+	"rbi/models"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var (
+	errPasswordReused     = errors.New("password was used recently")
+	errAlreadyInitialized = errors.New("users already exist")
+	errExternalPassword   = errors.New("password is managed by the directory")
+)
+
+// checkPolicy 按 config.yml 中的 password 策略校验密码强度
+func checkPolicy(password string) error {
+	policy := config.Config.Password
+	if n := len([]rune(password)); n == 0 || n < policy.MinLength {
+		return fmt.Errorf("password must be at least %d characters", policy.MinLength)
+	}
+	var upper, lower, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	var missing []string
+	if policy.RequireUpper && !upper {
+		missing = append(missing, "an uppercase letter")
+	}
+	if policy.RequireLower && !lower {
+		missing = append(missing, "a lowercase letter")
+	}
+	if policy.RequireDigit && !digit {
+		missing = append(missing, "a digit")
+	}
+	if policy.RequireSymbol && !symbol {
+		missing = append(missing, "a symbol")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("password must contain %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hashed), err
+}
+
+// reused 新密码是否与当前密码或最近 History 次密码相同
+func reused(user *models.User, password string) bool {
+	n := config.Config.Password.History
+	if n <= 0 {
+		return false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) == nil {
+		return true
+	}
+	var history []models.PasswordHistory
+	Db.Where("user_id = ?", user.UserID).Order("id desc").Limit(n).Find(&history)
+	for _, h := range history {
+		if bcrypt.CompareHashAndPassword([]byte(h.Hash), []byte(password)) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// setPassword 更新密码并记入历史，只保留策略需要的条数
+func setPassword(tx *gorm.DB, user *models.User, password string, mustChange bool) error {
+	hashed, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	user.Password = hashed
+	user.MustChangePassword = mustChange
+	user.PasswordChangedAt = &now
+	err = tx.Model(user).Select("Password", "MustChangePassword", "PasswordChangedAt").Updates(user).Error
+	if err != nil {
+		return err
+	}
+	return recordPassword(tx, user)
+}
+
+func recordPassword(tx *gorm.DB, user *models.User) error {
+	n := config.Config.Password.History
+	if n <= 0 {
+		return nil
+	}
+	if err := tx.Create(&models.PasswordHistory{UserID: user.UserID, Hash: user.Password}).Error; err != nil {
+		return err
+	}
+	var keep []int64
+	tx.Model(&models.PasswordHistory{}).Where("user_id = ?", user.UserID).Order("id desc").Limit(n).Pluck("id", &keep)
+	return tx.Where("user_id = ? AND id NOT IN ?", user.UserID, keep).Delete(&models.PasswordHistory{}).Error
+}
+
+// tempPassword 重置时生成的临时密码，包含各类字符以满足策略
+func tempPassword() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	pw := base64.RawURLEncoding.EncodeToString(b) + "Aa1!"
+	if pad := config.Config.Password.MinLength - len(pw); pad > 0 {
+		pw += strings.Repeat("x", pad)
+	}
+	return pw
+}
+
+type passwordRequest struct {
+	UserID          uint   `json:"userId"`
+	Username        string `json:"username"`
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+	Password        string `json:"password"`
+}
+
+// parsePassword 支持 JSON、表单和查询参数
+func parsePassword(r *http.Request) (passwordRequest, error) {
+	var req passwordRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		return req, err
+	}
+	if err := r.ParseForm(); err != nil {
+		return req, err
+	}
+	uid, _ := strconv.ParseUint(r.Form.Get("userId"), 10, 64)
+	req.UserID = uint(uid)
+	req.Username = r.Form.Get("username")
+	req.CurrentPassword = r.Form.Get("currentPassword")
+	req.NewPassword = r.Form.Get("newPassword")
+	req.Password = r.Form.Get("password")
+	return req, nil
+}
+
+// changePassword 用户用当前密码修改自己的密码，其它登录会话随之作废
+func changePassword(w http.ResponseWriter, r *http.Request) {
+	id := auth.Current(r)
+	uid, err := strconv.ParseUint(mux.Vars(r)["uid"], 10, 64)
+	if err != nil || uint(uid) != id.UserID {
+		writeResult(w, http.StatusForbidden, "Can only change your own password", nil)
+		return
+	}
+	req, err := parsePassword(r)
+	if err != nil {
+		writeResult(w, http.StatusBadRequest, "Invalid request body", nil)
+		return
+	}
+
+	var user models.User
+	if err := Db.First(&user, id.UserID).Error; err != nil {
+		writeResult(w, http.StatusNotFound, "User not found", nil)
+		return
+	}
+	if !isLocal(&user) {
+		writeResult(w, http.StatusBadRequest, errExternalPassword.Error(), nil)
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.CurrentPassword)); err != nil {
+		writeResult(w, http.StatusUnauthorized, "Current password is incorrect", nil)
+		return
+	}
+	if err := checkPolicy(req.NewPassword); err != nil {
+		writeResult(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	if reused(&user, req.NewPassword) {
+		writeResult(w, http.StatusBadRequest, errPasswordReused.Error(), nil)
+		return
+	}
+
+	err = Db.Transaction(func(tx *gorm.DB) error {
+		return setPassword(tx, &user, req.NewPassword, false)
+	})
+	if err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	if err := auth.RevokeOthers(user.UserID, id.SessionID); err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	audit.Record(r, models.AuditUser, "password_change", user.Username, models.AuditSuccess, "")
+	writeResult(w, http.StatusOK, "Password changed", nil)
+}
+
+// resetPassword 管理员重置密码，未指定密码时生成临时密码；用户下次登录必须修改
+func resetPassword(w http.ResponseWriter, r *http.Request) {
+	req, err := parsePassword(r)
+	if err != nil {
+		writeResult(w, http.StatusBadRequest, "Invalid request body", nil)
+		return
+	}
+	user, err := findUser(auth.Current(r), req.UserID, req.Username)
+	if err != nil {
+		writeResult(w, http.StatusNotFound, "User not found", nil)
+		return
+	}
+	if !isLocal(user) {
+		writeResult(w, http.StatusBadRequest, errExternalPassword.Error(), nil)
+		return
+	}
+
+	password := req.Password
+	if password == "" {
+		password = tempPassword()
+	} else if err := checkPolicy(password); err != nil {
+		writeResult(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	err = Db.Transaction(func(tx *gorm.DB) error {
+		return setPassword(tx, user, password, true)
+	})
+	if err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	if err := auth.RevokeUser(user.UserID); err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	audit.Record(r, models.AuditUser, "password_reset", user.Username, models.AuditSuccess, "")
+	result := map[string]interface{}{"userId": user.UserID, "username": user.Username}
+	if req.Password == "" {
+		result["password"] = password
+	}
+	writeResult(w, http.StatusOK, "Password reset", result)
+}
+
+// bootstrap 系统中没有任何用户时创建第一个管理员
+func bootstrap(w http.ResponseWriter, r *http.Request) {
+	req, err := parsePassword(r)
+	if err != nil || req.Username == "" {
+		writeResult(w, http.StatusBadRequest, "Invalid request body", nil)
+		return
+	}
+	if err := checkPolicy(req.Password); err != nil {
+		writeResult(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	hashed, err := hashPassword(req.Password)
+	if err != nil {
+		writeResult(w, http.StatusInternalServerError, "Error hashing password", nil)
+		return
+	}
+
+	var admin models.Role
+	if err := Db.Where("name = ?", roleAdmin).First(&admin).Error; err != nil {
+		writeResult(w, http.StatusInternalServerError, "Admin role not found", nil)
+		return
+	}
+	now := time.Now()
+	user := models.User{Username: req.Username, Password: hashed, Source: models.UserSourceLocal, IsAdmin: true, TenantID: models.DefaultTenantID,
+		Roles: []models.Role{admin}, PasswordChangedAt: &now}
+	err = Db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&models.User{}).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return errAlreadyInitialized
+		}
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		return recordPassword(tx, &user)
+	})
+	if errors.Is(err, errAlreadyInitialized) {
+		writeResult(w, http.StatusConflict, err.Error(), nil)
+		return
+	}
+	if err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	audit.RecordAs(r, user.UserID, user.Username, models.AuditUser, "user_create", user.Username, models.AuditSuccess, "initial administrator")
+	writeResult(w, http.StatusCreated, "Administrator created", map[string]interface{}{"userId": user.UserID, "username": user.Username})
+}
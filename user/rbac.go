@@ -0,0 +1,436 @@
+package user
+
+import (
+	"encoding/json"
+	"fmt"
+	"gorm.io/gorm"
+	"log"
+	"net/http"
+	"rbi/audit"
+	"rbi/auth"
+	"rbi/models"
+	"rbi/tenant"
+	"strconv"
+	"strings"
+)
+
+var defaultPermissions = []models.Permission{
+	{Code: models.PermContainerView, Name: "查看容器"},
+	{Code: models.PermContainerManage, Name: "启动/停止容器"},
+	{Code: models.PermAutomationView, Name: "查看自动化脚本"},
+	{Code: models.PermAutomationManage, Name: "编辑自动化脚本"},
+	{Code: models.PermAutomationRun, Name: "运行自动化脚本"},
+	{Code: models.PermGraphView, Name: "查看流程图"},
+	{Code: models.PermGraphManage, Name: "编辑流程图"},
+	{Code: models.PermUserManage, Name: "用户与角色管理"},
+	{Code: models.PermAuditView, Name: "查看审计日志"},
+}
+
+// 普通用户默认拥有的权限
+var userPermissions = []string{
+	models.PermContainerView,
+	models.PermContainerManage,
+	models.PermAutomationView,
+	models.PermAutomationManage,
+	models.PermAutomationRun,
+	models.PermGraphView,
+	models.PermGraphManage,
+}
+
+const (
+	roleAdmin = "admin"
+	roleUser  = "user"
+)
+
+// 与 web/src/router/modules 中的路由对应
+var defaultMenus = []struct {
+	models.Menu
+	Children []models.Menu
+}{
+	{models.Menu{Name: "container", Path: "/container", Component: "LAYOUT", Title: "容器管理", Icon: "ContainerRegistry", Sort: 1, Permission: models.PermContainerView},
+		[]models.Menu{{Name: "container", Path: "index", Component: "/container/index", Title: "容器管理"}}},
+	{models.Menu{Name: "auto", Path: "/auto", Component: "LAYOUT", Title: "自动配置", Icon: "Carbon3DCurveAutoColon", Sort: 4, Permission: models.PermAutomationView},
+		[]models.Menu{{Name: "auto", Path: "index", Component: "/auto/index", Title: "自动化"}}},
+	{models.Menu{Name: "configuration", Path: "/configuration", Component: "LAYOUT", Title: "配置管理", Icon: "AppstoreOutlined", Sort: 3},
+		[]models.Menu{{Name: "configuration", Path: "index", Component: "/configuration/index", Title: "配置管理"}}},
+	{models.Menu{Name: "recently", Path: "/recently", Component: "LAYOUT", Title: "快速访问", Icon: "RecentlyViewed", Sort: 0},
+		[]models.Menu{{Name: "recently", Path: "index", Component: "/recently/index", Title: "快速访问"}}},
+	{models.Menu{Name: "audit", Path: "/audit", Component: "LAYOUT", Title: "审计服务", Icon: "AuditOutlined", Sort: 6, Permission: models.PermAuditView},
+		[]models.Menu{{Name: "audit", Path: "index", Component: "/audit/index", Title: "审计服务"}}},
+}
+
+// Seed 初始化默认权限、角色和菜单，已存在的数据不覆盖
+func Seed() {
+	for _, p := range defaultPermissions {
+		if err := Db.Where(models.Permission{Code: p.Code}).Attrs(p).FirstOrCreate(&p).Error; err != nil {
+			log.Printf("Failed to seed permission %s: %v", p.Code, err)
+		}
+	}
+
+	// admin 角色始终拥有全部权限
+	var all []models.Permission
+	Db.Find(&all)
+	admin := models.Role{Name: roleAdmin}
+	if err := Db.Where(admin).Attrs(models.Role{Explain: "管理员"}).FirstOrCreate(&admin).Error; err != nil {
+		log.Printf("Failed to seed admin role: %v", err)
+	} else if err := Db.Model(&admin).Association("Permissions").Replace(all); err != nil {
+		log.Printf("Failed to grant admin permissions: %v", err)
+	}
+
+	user := models.Role{Name: roleUser}
+	result := Db.Where(user).Attrs(models.Role{Explain: "普通用户", IsDefault: true}).FirstOrCreate(&user)
+	if result.Error != nil {
+		log.Printf("Failed to seed user role: %v", result.Error)
+	} else if result.RowsAffected > 0 {
+		var perms []models.Permission
+		Db.Where("code IN ?", userPermissions).Find(&perms)
+		if err := Db.Model(&user).Association("Permissions").Replace(perms); err != nil {
+			log.Printf("Failed to grant user permissions: %v", err)
+		}
+	}
+
+	var count int64
+	Db.Model(&models.Menu{}).Count(&count)
+	if count == 0 {
+		for _, m := range defaultMenus {
+			parent := m.Menu
+			if err := Db.Create(&parent).Error; err != nil {
+				log.Printf("Failed to seed menu %s: %v", parent.Name, err)
+				continue
+			}
+			for _, child := range m.Children {
+				child.ParentID = parent.ID
+				Db.Create(&child)
+			}
+		}
+	}
+	// 审计菜单原先使用用户管理权限
+	Db.Model(&models.Menu{}).Where("name = ? AND permission = ?", "audit", models.PermUserManage).Update("permission", models.PermAuditView)
+
+	// 启用角色之前创建的用户按 IsAdmin 分配角色
+	var users []models.User
+	Db.Preload("Roles").Find(&users)
+	for i := range users {
+		if len(users[i].Roles) > 0 {
+			continue
+		}
+		role := user
+		if users[i].IsAdmin {
+			role = admin
+		}
+		if err := Db.Model(&users[i]).Association("Roles").Append(&role); err != nil {
+			log.Printf("Failed to assign role to %s: %v", users[i].Username, err)
+		}
+	}
+}
+
+// defaultRoles 新注册用户获得的角色
+func defaultRoles() []models.Role {
+	var roles []models.Role
+	Db.Where("is_default = ?", true).Find(&roles)
+	return roles
+}
+
+type adminInfo struct {
+	UserID      uint                `json:"userId"`
+	Username    string              `json:"username"`
+	RealName    string              `json:"realName"`
+	Avatar      string              `json:"avatar"`
+	Desc        string              `json:"desc"`
+	IsAdmin     bool                `json:"isAdmin"`
+	TenantID    uint                `json:"tenantId"`
+	TenantName  string              `json:"tenantName"`
+	TenantAdmin bool                `json:"tenantAdmin"`
+	Roles       []string            `json:"roles"`
+	Permissions []models.Permission `json:"permissions"`
+}
+
+// getAdminInfo 当前用户信息及权限，前端据此过滤菜单
+func getAdminInfo(w http.ResponseWriter, r *http.Request) {
+	id := auth.Current(r)
+	var user models.User
+	if err := Db.Preload("Roles").First(&user, id.UserID).Error; err != nil {
+		writeResult(w, http.StatusNotFound, "User not found", nil)
+		return
+	}
+	info := adminInfo{UserID: user.UserID, Username: user.Username, RealName: user.Username, IsAdmin: user.IsAdmin, Roles: []string{},
+		TenantID: user.TenantID, TenantAdmin: user.TenantAdmin}
+	if t, err := tenant.Get(user.TenantID); err == nil {
+		info.TenantName = t.Name
+	}
+	for _, role := range user.Roles {
+		info.Roles = append(info.Roles, role.Name)
+	}
+	if len(info.Roles) > 0 {
+		info.Desc = info.Roles[0]
+	}
+
+	var all []models.Permission
+	if err := Db.Order("id").Find(&all).Error; err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	info.Permissions = []models.Permission{}
+	for _, p := range all {
+		if id.Can(p.Code) {
+			info.Permissions = append(info.Permissions, p)
+		}
+	}
+	writeResult(w, http.StatusOK, "ok", info)
+}
+
+type menuMeta struct {
+	Title       string   `json:"title"`
+	Icon        string   `json:"icon,omitempty"`
+	Sort        int      `json:"sort"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// menuNode 前端 generateRoutes 使用的路由结构
+type menuNode struct {
+	ID        uint        `json:"id"`
+	Name      string      `json:"name"`
+	Path      string      `json:"path"`
+	Component string      `json:"component"`
+	Redirect  string      `json:"redirect,omitempty"`
+	Meta      menuMeta    `json:"meta"`
+	Children  []*menuNode `json:"children,omitempty"`
+}
+
+// menuTree 按 ParentID 组装菜单树，visible 返回 false 的菜单及其子菜单不输出
+func menuTree(visible func(*models.Menu) bool) ([]*menuNode, error) {
+	var menus []models.Menu
+	if err := Db.Order("sort, id").Find(&menus).Error; err != nil {
+		return nil, err
+	}
+	children := make(map[uint][]*models.Menu)
+	for i := range menus {
+		children[menus[i].ParentID] = append(children[menus[i].ParentID], &menus[i])
+	}
+	var build func(parent uint) []*menuNode
+	build = func(parent uint) []*menuNode {
+		nodes := []*menuNode{}
+		for _, m := range children[parent] {
+			if !visible(m) {
+				continue
+			}
+			node := &menuNode{ID: m.ID, Name: m.Name, Path: m.Path, Component: m.Component, Redirect: m.Redirect,
+				Meta: menuMeta{Title: m.Title, Icon: m.Icon, Sort: m.Sort}}
+			if m.Permission != "" {
+				node.Meta.Permissions = []string{m.Permission}
+			}
+			node.Children = build(m.ID)
+			// 子菜单全部不可见时父菜单也不显示
+			if len(children[m.ID]) > 0 && len(node.Children) == 0 {
+				continue
+			}
+			nodes = append(nodes, node)
+		}
+		return nodes
+	}
+	return build(0), nil
+}
+
+// getMenus 当前用户可见的菜单
+func getMenus(w http.ResponseWriter, r *http.Request) {
+	id := auth.Current(r)
+	tree, err := menuTree(func(m *models.Menu) bool {
+		return m.Permission == "" || id.Can(m.Permission)
+	})
+	if err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	writeResult(w, http.StatusOK, "ok", tree)
+}
+
+// listMenus 完整菜单树，供菜单管理使用
+func listMenus(w http.ResponseWriter, r *http.Request) {
+	tree, err := menuTree(func(*models.Menu) bool { return true })
+	if err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	writeResult(w, http.StatusOK, "ok", map[string]interface{}{"list": tree})
+}
+
+func listPermissions(w http.ResponseWriter, r *http.Request) {
+	var perms []models.Permission
+	if err := Db.Order("id").Find(&perms).Error; err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	writeResult(w, http.StatusOK, "ok", perms)
+}
+
+// listRoles 分页列出角色
+func listRoles(w http.ResponseWriter, r *http.Request) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page <= 0 {
+		page = 1
+	}
+	pageSize, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	if pageSize <= 0 || pageSize > 100 {
+		pageSize = 10
+	}
+	var total int64
+	var roles []models.Role
+	if err := Db.Model(&models.Role{}).Count(&total).Error; err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	if err := Db.Preload("Permissions").Order("id").Offset((page - 1) * pageSize).Limit(pageSize).Find(&roles).Error; err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	writeResult(w, http.StatusOK, "ok", map[string]interface{}{
+		"page":      page,
+		"pageSize":  pageSize,
+		"pageCount": (int(total) + pageSize - 1) / pageSize,
+		"list":      roles,
+	})
+}
+
+type roleRequest struct {
+	ID          uint     `json:"id"`
+	Name        string   `json:"name"`
+	Explain     string   `json:"explain"`
+	IsDefault   bool     `json:"isDefault"`
+	RequireTOTP bool     `json:"requireTotp"`
+	Permissions []string `json:"permissions"` // 权限标识
+}
+
+// saveRole 新建或更新角色，permissions 整体替换
+func saveRole(w http.ResponseWriter, r *http.Request) {
+	var req roleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		writeResult(w, http.StatusBadRequest, "Invalid request body", nil)
+		return
+	}
+	var role models.Role
+	if req.ID != 0 {
+		if err := Db.First(&role, req.ID).Error; err != nil {
+			writeResult(w, http.StatusNotFound, "Role not found", nil)
+			return
+		}
+		if role.Name == roleAdmin && req.Name != roleAdmin {
+			writeResult(w, http.StatusBadRequest, "The admin role cannot be renamed", nil)
+			return
+		}
+	}
+	role.Name, role.Explain, role.IsDefault, role.RequireTOTP = req.Name, req.Explain, req.IsDefault, req.RequireTOTP
+
+	var perms []models.Permission
+	if len(req.Permissions) > 0 {
+		if err := Db.Where("code IN ?", req.Permissions).Find(&perms).Error; err != nil {
+			writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+			return
+		}
+	}
+	if len(perms) != len(req.Permissions) {
+		writeResult(w, http.StatusBadRequest, "Unknown permission", nil)
+		return
+	}
+
+	err := Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Permissions").Save(&role).Error; err != nil {
+			return err
+		}
+		return tx.Model(&role).Association("Permissions").Replace(perms)
+	})
+	if err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	role.Permissions = perms
+	audit.Record(r, models.AuditUser, "role_save", role.Name, models.AuditSuccess, strings.Join(req.Permissions, ","))
+	writeResult(w, http.StatusOK, "Role saved", role)
+}
+
+// deleteRole 删除角色，admin 角色不能删除
+func deleteRole(w http.ResponseWriter, r *http.Request) {
+	var role models.Role
+	if err := Db.First(&role, r.URL.Query().Get("id")).Error; err != nil {
+		writeResult(w, http.StatusNotFound, "Role not found", nil)
+		return
+	}
+	if role.Name == roleAdmin {
+		writeResult(w, http.StatusBadRequest, "The admin role cannot be deleted", nil)
+		return
+	}
+	err := Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&role).Association("Permissions").Clear(); err != nil {
+			return err
+		}
+		if err := tx.Exec("DELETE FROM user_roles WHERE role_id = ?", role.ID).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&role).Error
+	})
+	if err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	audit.Record(r, models.AuditUser, "role_delete", role.Name, models.AuditSuccess, "")
+	writeResult(w, http.StatusOK, "Role deleted", nil)
+}
+
+// checkAssignable 只能分配权限不超过自己的角色，否则持有 user:manage 即可给自己或他人授予管理员权限。
+// 全局管理员不受限制
+func checkAssignable(id *auth.Identity, roles []models.Role) error {
+	if id.IsAdmin {
+		return nil
+	}
+	for _, role := range roles {
+		for _, p := range role.Permissions {
+			if !id.Can(p.Code) {
+				return fmt.Errorf("Role %s grants %s, which you do not have", role.Name, p.Code)
+			}
+		}
+	}
+	return nil
+}
+
+type userRolesRequest struct {
+	UserID uint   `json:"userId"`
+	Roles  []uint `json:"roles"`
+}
+
+// setUserRoles 整体替换用户的角色
+func setUserRoles(w http.ResponseWriter, r *http.Request) {
+	var req userRolesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeResult(w, http.StatusBadRequest, "Invalid request body", nil)
+		return
+	}
+	user, err := findUser(auth.Current(r), req.UserID, "")
+	if err != nil {
+		writeResult(w, http.StatusNotFound, "User not found", nil)
+		return
+	}
+	var roles []models.Role
+	if len(req.Roles) > 0 {
+		if err := Db.Preload("Permissions").Find(&roles, req.Roles).Error; err != nil {
+			writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+			return
+		}
+	}
+	if len(roles) != len(req.Roles) {
+		writeResult(w, http.StatusBadRequest, "Unknown role", nil)
+		return
+	}
+	if err := checkAssignable(auth.Current(r), roles); err != nil {
+		writeResult(w, http.StatusForbidden, err.Error(), nil)
+		return
+	}
+	if err := Db.Model(user).Association("Roles").Replace(roles); err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	names := make([]string, 0, len(roles))
+	for _, role := range roles {
+		names = append(names, role.Name)
+	}
+	audit.Record(r, models.AuditUser, "user_roles", user.Username, models.AuditSuccess, strings.Join(names, ","))
+	writeResult(w, http.StatusOK, "Roles updated", roles)
+}
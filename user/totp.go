@@ -0,0 +1,414 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gorm.io/gorm"
+	"net/http"
+	"net/url"
+	"rbi/auth"
+	"rbi/config"
+	"rbi/models"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RFC 6238 参数，与常见验证器 App 的默认值一致
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// 前后各允许一个时间步的时钟误差
+	totpSkew = 1
+	// 每次生成的恢复码数量
+	recoveryCodeCount = 10
+	// 密码通过后输入验证码的时限和次数
+	totpChallengeTTL      = 5 * time.Minute
+	totpChallengeAttempts = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode 计算某个时间步的验证码
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return totpEncoding.EncodeToString(b)
+}
+
+// provisioningURI otpauth:// 地址，前端据此生成二维码
+func provisioningURI(username, secret string) string {
+	issuer := config.Config.Auth.TOTP.Issuer
+	if issuer == "" {
+		issuer = "RBI"
+	}
+	q := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {strconv.Itoa(totpDigits)},
+		"period":    {strconv.Itoa(totpPeriod)},
+	}
+	label := url.PathEscape(issuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// verifyTOTP 校验验证码，通过的时间步写回用户，同一验证码不能再次使用
+func verifyTOTP(user *models.User, code string) bool {
+	secret, err := totpEncoding.DecodeString(user.TOTPSecret)
+	if err != nil || len(code) != totpDigits {
+		return false
+	}
+	now := time.Now().Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= user.TOTPLastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) != 1 {
+			continue
+		}
+		// 并发请求中只有一个能推进时间步
+		result := Db.Model(&models.User{}).
+			Where("user_id = ? AND totp_last_step < ?", user.UserID, step).
+			Update("totp_last_step", step)
+		if result.Error != nil || result.RowsAffected != 1 {
+			return false
+		}
+		user.TOTPLastStep = step
+		return true
+	}
+	return false
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCodes 替换用户全部恢复码，明文只在生成时返回一次
+func newRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	rows := make([]models.RecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes[i] = raw[:4] + "-" + raw[4:]
+		rows[i] = models.RecoveryCode{UserID: userID, Hash: hashRecoveryCode(raw)}
+	}
+	return codes, tx.Create(&rows).Error
+}
+
+// useRecoveryCode 核销一个未使用的恢复码
+func useRecoveryCode(userID uint, code string) bool {
+	result := Db.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND hash = ? AND used_at IS NULL", userID, hashRecoveryCode(code)).
+		Update("used_at", time.Now())
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+// secondFactor 校验验证码或恢复码，recovery 表示使用了恢复码
+func secondFactor(user *models.User, code string) (ok, recovery bool) {
+	code = strings.TrimSpace(code)
+	if len(code) == totpDigits {
+		return verifyTOTP(user, code), false
+	}
+	return useRecoveryCode(user.UserID, code), true
+}
+
+// totpChallenge 密码已通过、等待验证码的登录
+type totpChallenge struct {
+	userID   uint
+	username string
+	attempts int
+	expires  time.Time
+}
+
+var totpChallenges = struct {
+	sync.Mutex
+	m map[string]*totpChallenge
+}{m: map[string]*totpChallenge{}}
+
+// newTOTPChallenge 密码通过后生成一次性的 challenge，验证码提交时携带
+func newTOTPChallenge(user *models.User) string {
+	challenge := newTOTPSecret()
+	now := time.Now()
+	totpChallenges.Lock()
+	defer totpChallenges.Unlock()
+	for k, c := range totpChallenges.m {
+		if now.After(c.expires) {
+			delete(totpChallenges.m, k)
+		}
+	}
+	totpChallenges.m[challenge] = &totpChallenge{userID: user.UserID, username: user.Username, expires: now.Add(totpChallengeTTL)}
+	return challenge
+}
+
+type totpLoginRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+// totpLogin 登录第二步，验证码或恢复码通过后签发令牌
+func totpLogin(w http.ResponseWriter, r *http.Request) {
+	var req totpLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Challenge == "" || req.Code == "" {
+		writeResult(w, http.StatusBadRequest, "challenge and code are required", nil)
+		return
+	}
+	totpChallenges.Lock()
+	c, ok := totpChallenges.m[req.Challenge]
+	if ok && (time.Now().After(c.expires) || c.attempts >= totpChallengeAttempts) {
+		delete(totpChallenges.m, req.Challenge)
+		ok = false
+	}
+	if ok {
+		c.attempts++
+	}
+	totpChallenges.Unlock()
+	if !ok {
+		writeResult(w, http.StatusUnauthorized, "Login expired, sign in again", nil)
+		return
+	}
+
+	ip := auth.ClientIP(r)
+	if _, locked := lockedUntil(c.username, ip); locked {
+		writeResult(w, http.StatusTooManyRequests, "Too many failed attempts, try again later", nil)
+		return
+	}
+	var user models.User
+	if err := Db.First(&user, c.userID).Error; err != nil || !user.TOTPEnabled {
+		writeResult(w, http.StatusUnauthorized, "Login expired, sign in again", nil)
+		return
+	}
+	valid, recovery := secondFactor(&user, req.Code)
+	if !valid {
+		loginFailed(user.Username, ip)
+		authLog(r, models.AuthLoginFailed, user.Username, user.UserID, "invalid two-factor code")
+		writeResult(w, http.StatusUnauthorized, "Invalid verification code", nil)
+		return
+	}
+	totpChallenges.Lock()
+	delete(totpChallenges.m, req.Challenge)
+	totpChallenges.Unlock()
+	if recovery {
+		authLog(r, models.AuthTOTPRecovery, user.Username, user.UserID, "")
+	}
+	finishLogin(w, r, &user)
+}
+
+type totpRequest struct {
+	Code   string `json:"code"`
+	UserID uint   `json:"userId"`
+}
+
+func parseTOTP(r *http.Request) (totpRequest, error) {
+	var req totpRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	return req, err
+}
+
+// currentUser 当前登录用户的完整记录
+func currentUser(r *http.Request) (*models.User, error) {
+	var user models.User
+	err := Db.First(&user, auth.Current(r).UserID).Error
+	return &user, err
+}
+
+// totpStatus 当前用户的两步验证状态
+func totpStatus(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(r)
+	if err != nil {
+		writeResult(w, http.StatusNotFound, "User not found", nil)
+		return
+	}
+	var remaining int64
+	Db.Model(&models.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", user.UserID).Count(&remaining)
+	required, _ := auth.RequiresTOTP(user.UserID)
+	writeResult(w, http.StatusOK, "ok", map[string]interface{}{
+		"enabled":       user.TOTPEnabled,
+		"required":      required,
+		"recoveryCodes": remaining,
+	})
+}
+
+// totpSetup 生成新的密钥，用验证码确认后才生效
+func totpSetup(w http.ResponseWriter, r *http.Request) {
+	user, err := currentUser(r)
+	if err != nil {
+		writeResult(w, http.StatusNotFound, "User not found", nil)
+		return
+	}
+	if user.TOTPEnabled {
+		writeResult(w, http.StatusConflict, "Two-factor authentication is already enabled", nil)
+		return
+	}
+	secret := newTOTPSecret()
+	if err := Db.Model(user).Update("totp_secret", secret).Error; err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	writeResult(w, http.StatusOK, "Scan the code with an authenticator app", map[string]string{
+		"secret": secret,
+		"uri":    provisioningURI(user.Username, secret),
+	})
+}
+
+// totpEnable 校验第一个验证码后启用，返回恢复码
+func totpEnable(w http.ResponseWriter, r *http.Request) {
+	req, err := parseTOTP(r)
+	if err != nil {
+		writeResult(w, http.StatusBadRequest, "Invalid request body", nil)
+		return
+	}
+	user, err := currentUser(r)
+	if err != nil {
+		writeResult(w, http.StatusNotFound, "User not found", nil)
+		return
+	}
+	if user.TOTPEnabled {
+		writeResult(w, http.StatusConflict, "Two-factor authentication is already enabled", nil)
+		return
+	}
+	if user.TOTPSecret == "" {
+		writeResult(w, http.StatusBadRequest, "Call setup first", nil)
+		return
+	}
+	if !verifyTOTP(user, strings.TrimSpace(req.Code)) {
+		writeResult(w, http.StatusBadRequest, "Invalid verification code", nil)
+		return
+	}
+	var codes []string
+	err = Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Update("totp_enabled", true).Error; err != nil {
+			return err
+		}
+		codes, err = newRecoveryCodes(tx, user.UserID)
+		return err
+	})
+	if err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	authLog(r, models.AuthTOTPEnabled, user.Username, user.UserID, "")
+	writeResult(w, http.StatusOK, "Two-factor authentication enabled", map[string]interface{}{"recoveryCodes": codes})
+}
+
+// totpDisable 用验证码或恢复码确认后关闭两步验证
+func totpDisable(w http.ResponseWriter, r *http.Request) {
+	req, err := parseTOTP(r)
+	if err != nil {
+		writeResult(w, http.StatusBadRequest, "Invalid request body", nil)
+		return
+	}
+	user, err := currentUser(r)
+	if err != nil {
+		writeResult(w, http.StatusNotFound, "User not found", nil)
+		return
+	}
+	if !user.TOTPEnabled {
+		writeResult(w, http.StatusBadRequest, "Two-factor authentication is not enabled", nil)
+		return
+	}
+	if ok, _ := secondFactor(user, req.Code); !ok {
+		writeResult(w, http.StatusBadRequest, "Invalid verification code", nil)
+		return
+	}
+	if err := clearTOTP(user.UserID); err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	authLog(r, models.AuthTOTPDisabled, user.Username, user.UserID, "")
+	writeResult(w, http.StatusOK, "Two-factor authentication disabled", nil)
+}
+
+// totpRecovery 用验证码确认后重新生成恢复码，旧的全部作废
+func totpRecovery(w http.ResponseWriter, r *http.Request) {
+	req, err := parseTOTP(r)
+	if err != nil {
+		writeResult(w, http.StatusBadRequest, "Invalid request body", nil)
+		return
+	}
+	user, err := currentUser(r)
+	if err != nil {
+		writeResult(w, http.StatusNotFound, "User not found", nil)
+		return
+	}
+	if !user.TOTPEnabled || !verifyTOTP(user, strings.TrimSpace(req.Code)) {
+		writeResult(w, http.StatusBadRequest, "Invalid verification code", nil)
+		return
+	}
+	var codes []string
+	err = Db.Transaction(func(tx *gorm.DB) error {
+		codes, err = newRecoveryCodes(tx, user.UserID)
+		return err
+	})
+	if err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	writeResult(w, http.StatusOK, "Recovery codes regenerated", map[string]interface{}{"recoveryCodes": codes})
+}
+
+// totpReset 管理员为丢失设备的用户关闭两步验证，并作废其会话
+func totpReset(w http.ResponseWriter, r *http.Request) {
+	req, err := parseTOTP(r)
+	if err != nil || req.UserID == 0 {
+		writeResult(w, http.StatusBadRequest, "userId is required", nil)
+		return
+	}
+	user, err := findUser(auth.Current(r), req.UserID, "")
+	if err != nil {
+		writeResult(w, http.StatusNotFound, "User not found", nil)
+		return
+	}
+	if err := clearTOTP(user.UserID); err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	if err := auth.RevokeUser(user.UserID); err != nil {
+		writeResult(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	authLog(r, models.AuthTOTPDisabled, user.Username, user.UserID, "reset by "+auth.Current(r).Username)
+	writeResult(w, http.StatusOK, "Two-factor authentication reset", nil)
+}
+
+func clearTOTP(userID uint) error {
+	return Db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.User{}).Where("user_id = ?", userID).
+			Updates(map[string]interface{}{"totp_enabled": false, "totp_secret": "", "totp_last_step": 0}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error
+	})
+}
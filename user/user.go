@@ -2,89 +2,295 @@ package user
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/gorilla/mux"
-	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 	"net/http"
+	"rbi/audit"
+	"rbi/auth"
+	"rbi/config"
 	"rbi/models"
 	"rbi/sqlite"
+	"rbi/tenant"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func RegisterRoutes(router *mux.Router) {
-	router.HandleFunc("/register", newUser).Methods(http.MethodPost)
-	router.HandleFunc("/deactivate", deleteUser).Methods(http.MethodPost)
-	router.HandleFunc("/login", userLogin).Methods(http.MethodGet)
+	router.Handle("/register", auth.Require(models.PermUserManage, newUser)).Methods(http.MethodPost)
+	router.Handle("/deactivate", auth.Require(models.PermUserManage, deactivateUser)).Methods(http.MethodPost)
+	router.Handle("/reactivate", auth.Require(models.PermUserManage, reactivateUser)).Methods(http.MethodPost)
+	router.HandleFunc("/login", userLogin).Methods(http.MethodPost)
+	router.HandleFunc("/login/refresh", refreshLogin).Methods(http.MethodPost)
+	router.HandleFunc("/login/logout", userLogout).Methods(http.MethodPost)
+	router.HandleFunc("/login/code", loginCode).Methods(http.MethodPost)
+	router.HandleFunc("/login/totp", totpLogin).Methods(http.MethodPost)
 	router.HandleFunc("/user/check", hasUsers).Methods(http.MethodGet)
+	router.HandleFunc("/user/check", bootstrap).Methods(http.MethodPost)
+	router.HandleFunc("/user/u{uid:[0-9]+}/changepw", changePassword).Methods(http.MethodPost)
+	router.Handle("/user/reset", auth.Require(models.PermUserManage, resetPassword)).Methods(http.MethodPost)
+	router.Handle("/user/unlock", auth.RequireAdmin(unlockLogin)).Methods(http.MethodPost)
+	router.Handle("/user/lockouts", auth.RequireAdmin(listLockouts)).Methods(http.MethodGet)
+	router.Handle("/user/authlog", auth.Require(models.PermUserManage, listAuthLogs)).Methods(http.MethodGet)
+	router.HandleFunc("/user/apikeys", listAPIKeys).Methods(http.MethodGet)
+	router.HandleFunc("/user/apikeys", createAPIKey).Methods(http.MethodPost)
+	router.HandleFunc("/user/apikeys/revoke", revokeAPIKey).Methods(http.MethodPost)
+	router.HandleFunc("/user/totp", totpStatus).Methods(http.MethodGet)
+	router.HandleFunc("/user/totp/setup", totpSetup).Methods(http.MethodPost)
+	router.HandleFunc("/user/totp/enable", totpEnable).Methods(http.MethodPost)
+	router.HandleFunc("/user/totp/disable", totpDisable).Methods(http.MethodPost)
+	router.HandleFunc("/user/totp/recovery", totpRecovery).Methods(http.MethodPost)
+	router.Handle("/user/totp/reset", auth.Require(models.PermUserManage, totpReset)).Methods(http.MethodPost)
+	router.HandleFunc("/admin_info", getAdminInfo).Methods(http.MethodGet)
+	router.HandleFunc("/menus", getMenus).Methods(http.MethodGet)
+	router.Handle("/menu/list", auth.Require(models.PermUserManage, listMenus)).Methods(http.MethodGet)
+	router.Handle("/permission/list", auth.Require(models.PermUserManage, listPermissions)).Methods(http.MethodGet)
+	router.Handle("/role/list", auth.Require(models.PermUserManage, listRoles)).Methods(http.MethodGet)
+	router.Handle("/role/save", auth.RequireAdmin(saveRole)).Methods(http.MethodPost)
+	router.Handle("/role/delete", auth.RequireAdmin(deleteRole)).Methods(http.MethodPost)
+	router.Handle("/user/roles", auth.Require(models.PermUserManage, setUserRoles)).Methods(http.MethodPost)
+	router.HandleFunc("/oidc/login", oidcStart).Methods(http.MethodGet)
+	router.HandleFunc("/oidc/callback", oidcCallback).Methods(http.MethodGet)
+	router.HandleFunc("/oidc/exchange", oidcExchange).Methods(http.MethodPost)
+	auth.Public("/login", "/login/refresh", "/login/totp", "/user/check", "/oidc/login", "/oidc/callback", "/oidc/exchange")
+	auth.AllowPasswordChange("/user/u*/changepw", "/login/logout", "/admin_info")
+	auth.AllowTOTPEnrollment("/user/totp", "/user/totp/setup", "/user/totp/enable", "/login/logout", "/admin_info")
 }
 
 var Db = sqlite.Db
 
+// newUserRequest 创建用户时客户端可以指定的字段，其余字段由服务端决定
+type newUserRequest struct {
+	Username    string
+	Password    string
+	IsAdmin     bool
+	TenantID    uint
+	TenantAdmin bool
+	// 只取角色 ID，为空时使用默认角色
+	Roles []models.Role
+}
+
 func newUser(w http.ResponseWriter, r *http.Request) {
-	var user models.User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+	var req newUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	if err := checkPolicy(req.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	// Hash the password before saving
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	hashedPassword, err := hashPassword(req.Password)
 	if err != nil {
 		http.Error(w, "Error hashing password", http.StatusInternalServerError)
 		return
 	}
-	user.Password = string(hashedPassword)
+	now := time.Now()
+	user := models.User{
+		Username:          req.Username,
+		Password:          hashedPassword,
+		IsAdmin:           req.IsAdmin,
+		TenantID:          req.TenantID,
+		TenantAdmin:       req.TenantAdmin,
+		Roles:             req.Roles,
+		Source:            models.UserSourceLocal,
+		PasswordChangedAt: &now,
+	}
+	// 只有全局管理员可以创建管理员和指定租户，其他人创建的用户进入创建者的租户
+	id := auth.Current(r)
+	switch {
+	case !id.IsAdmin:
+		user.IsAdmin = false
+		user.TenantID = id.TenantID
+		user.TenantAdmin = user.TenantAdmin && id.TenantAdmin
+	case user.TenantID == 0:
+		user.TenantID = id.TenantID
+	}
+	if _, err := tenant.Get(user.TenantID); err != nil {
+		http.Error(w, "Unknown tenant", http.StatusBadRequest)
+		return
+	}
+	if err := tenant.CheckQuota(user.TenantID, tenant.QuotaUsers); err != nil {
+		tenant.WriteQuotaError(w, err)
+		return
+	}
+	if len(user.Roles) == 0 {
+		user.Roles = defaultRoles()
+	} else {
+		ids := make([]uint, 0, len(user.Roles))
+		for _, role := range user.Roles {
+			ids = append(ids, role.ID)
+		}
+		user.Roles = nil
+		if err := Db.Preload("Permissions").Find(&user.Roles, ids).Error; err != nil || len(user.Roles) != len(ids) {
+			http.Error(w, "Unknown role", http.StatusBadRequest)
+			return
+		}
+		if err := checkAssignable(id, user.Roles); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
 
 	// Create new user in the database
-	if err := Db.Create(&user).Error; err != nil {
+	err = Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		return recordPassword(tx, &user)
+	})
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	audit.RecordAs(r, user.UserID, user.Username, models.AuditUser, "user_create", user.Username, models.AuditSuccess,
+		fmt.Sprintf("tenant=%d admin=%t tenantAdmin=%t", user.TenantID, user.IsAdmin, user.TenantAdmin))
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{
 		"message": "User registered successfully",
 	})
 }
 
-func deleteUser(w http.ResponseWriter, r *http.Request) {
-	var user models.User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
+type loginRequest struct {
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	RefreshToken string `json:"refreshToken"`
+}
 
-	// Find and delete the user by username
-	if err := Db.Where("username = ?", user.Username).Delete(&models.User{}).Error; err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// parseLogin 支持 JSON 和表单两种请求体
+func parseLogin(r *http.Request) (loginRequest, error) {
+	var req loginRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		return req, err
+	}
+	if err := r.ParseForm(); err != nil {
+		return req, err
 	}
+	req.Username = r.PostForm.Get("username")
+	req.Password = r.PostForm.Get("password")
+	req.RefreshToken = r.PostForm.Get("refreshToken")
+	return req, nil
+}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"message": "User deactivated successfully",
+// writeResult 前端约定的 {code, message, result} 格式
+func writeResult(w http.ResponseWriter, status int, message string, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":    status,
+		"message": message,
+		"result":  result,
 	})
 }
 
+type loginResult struct {
+	*auth.Tokens
+	UserID   uint   `json:"userId"`
+	Username string `json:"username"`
+	IsAdmin  bool   `json:"isAdmin"`
+	// 为 true 时前端应引导用户修改密码，其它接口返回 403
+	MustChangePassword bool `json:"mustChangePassword"`
+}
+
 // userLogin handles user login
 func userLogin(w http.ResponseWriter, r *http.Request) {
-	username := r.URL.Query().Get("username")
-	password := r.URL.Query().Get("password")
+	req, err := parseLogin(r)
+	if err != nil {
+		writeResult(w, http.StatusBadRequest, "Invalid request body", nil)
+		return
+	}
 
-	var user models.User
-	if err := Db.Where("username = ?", username).First(&user).Error; err != nil {
-		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+	ip := auth.ClientIP(r)
+	if until, locked := lockedUntil(req.Username, ip); locked {
+		authLog(r, models.AuthLoginLocked, req.Username, 0, "locked until "+until.Format(time.RFC3339))
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+		writeResult(w, http.StatusTooManyRequests, "Too many failed attempts, try again later", nil)
 		return
 	}
 
-	// Compare the hashed password with the entered password
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
-		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+	user, err := authenticate(req.Username, req.Password)
+	if err != nil {
+		var userID uint
+		if user != nil {
+			userID = user.UserID
+		}
+		if errors.Is(err, ErrDisabled) {
+			authLog(r, models.AuthLoginFailed, req.Username, userID, err.Error())
+			writeResult(w, http.StatusForbidden, "Account disabled", nil)
+			return
+		}
+		loginFailed(req.Username, ip)
+		authLog(r, models.AuthLoginFailed, req.Username, userID, err.Error())
+		writeResult(w, http.StatusUnauthorized, "Invalid username or password", nil)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"message": "Login successful",
-	})
+	// 启用了两步验证时先返回 challenge，由 /login/totp 完成登录
+	if user.TOTPEnabled {
+		writeResult(w, http.StatusAccepted, "Verification code required", map[string]interface{}{
+			"totpRequired": true,
+			"challenge":    newTOTPChallenge(user),
+		})
+		return
+	}
+	finishLogin(w, r, user)
+}
+
+// finishLogin 签发令牌并清除失败记录
+func finishLogin(w http.ResponseWriter, r *http.Request, user *models.User) {
+	tokens, err := auth.Issue(user, r)
+	if err != nil {
+		writeResult(w, http.StatusInternalServerError, "Failed to create session", nil)
+		return
+	}
+	loginSucceeded(user.Username)
+	authLog(r, models.AuthLoginSuccess, user.Username, user.UserID, "")
+	auth.SetCookie(w, tokens)
+	writeResult(w, http.StatusOK, "Login successful", loginResult{Tokens: tokens, UserID: user.UserID, Username: user.Username, IsAdmin: user.IsAdmin, MustChangePassword: user.MustChangePassword})
+}
+
+// refreshLogin 用刷新令牌换取新的令牌
+func refreshLogin(w http.ResponseWriter, r *http.Request) {
+	req, err := parseLogin(r)
+	if err != nil || req.RefreshToken == "" {
+		writeResult(w, http.StatusBadRequest, "Missing refresh token", nil)
+		return
+	}
+	tokens, user, err := auth.Refresh(req.RefreshToken, r)
+	if err != nil {
+		writeResult(w, http.StatusUnauthorized, err.Error(), nil)
+		return
+	}
+	auth.SetCookie(w, tokens)
+	writeResult(w, http.StatusOK, "Token refreshed", loginResult{Tokens: tokens, UserID: user.UserID, Username: user.Username, IsAdmin: user.IsAdmin, MustChangePassword: user.MustChangePassword})
+}
+
+// userLogout 作废当前令牌
+func userLogout(w http.ResponseWriter, r *http.Request) {
+	id := auth.Current(r)
+	if err := auth.Revoke(id.Token); err != nil {
+		writeResult(w, http.StatusUnauthorized, err.Error(), nil)
+		return
+	}
+	auth.ClearCookie(w)
+	authLog(r, models.AuthLogout, id.Username, id.UserID, "")
+	writeResult(w, http.StatusOK, "Logout successful", nil)
+}
+
+// loginCode 为新窗口生成一次性换取码，地址中不再携带访问令牌
+func loginCode(w http.ResponseWriter, r *http.Request) {
+	id := auth.Current(r)
+	if id.APIKeyID != 0 {
+		writeResult(w, http.StatusForbidden, "API 密钥不能换取登录会话", nil)
+		return
+	}
+	writeResult(w, http.StatusOK, "ok", map[string]string{"code": auth.NewExchangeCode(id)})
 }
 
 func hasUsers(w http.ResponseWriter, r *http.Request) {
@@ -99,5 +305,7 @@ func hasUsers(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]bool{
 		"hasUsers": hasUsers,
+		// 前端据此显示单点登录入口
+		"sso": config.Config.Auth.OIDC.Enabled,
 	})
 }
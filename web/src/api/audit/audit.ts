@@ -0,0 +1,28 @@
+import api from '../api';
+
+export interface AuditQuery {
+  category?: string;
+  action?: string;
+  actor?: string;
+  target?: string;
+  outcome?: string;
+  from?: string;
+  to?: string;
+  q?: string;
+  page?: number;
+  pageSize?: number;
+}
+
+export function getAuditEvents(params: AuditQuery) {
+  return api.get('/audit/events', { params });
+}
+
+// 导出带登录令牌，以 blob 方式下载
+export function exportAuditEvents(params: AuditQuery, format: 'csv' | 'jsonl') {
+  return api.get('/audit/export', { params: { ...params, format }, responseType: 'blob' });
+}
+
+// 校验哈希链，仅全局管理员
+export function verifyAuditChain() {
+  return api.get('/audit/verify');
+}
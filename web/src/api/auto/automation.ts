@@ -15,3 +15,26 @@ export function delScript(ID: string) {
 export function updateScript(data: any) {
   return api.post('/automation/updateAction', data);
 }
+
+// 在自己的会话中运行脚本，params 为动作中 {{name}} 引用的运行参数
+export function runScript(data: {
+  automation_id: number;
+  session: string;
+  params?: Record<string, string>;
+}) {
+  return api.post('/automation/runScript', data);
+}
+
+// 租户密钥只返回名称，值只写不读
+export function getSecrets() {
+  return api.get('/automation/secrets');
+}
+
+// origins 为允许填入密钥的页面来源，如 https://login.example.com；修改时 value 为空表示保留原值
+export function saveSecret(data: { name: string; value?: string; origins: string[] }) {
+  return api.post('/automation/secrets/save', data);
+}
+
+export function delSecret(name: string) {
+  return api.post(`/automation/secrets/delete?name=${encodeURIComponent(name)}`);
+}
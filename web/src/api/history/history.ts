@@ -0,0 +1,5 @@
+import api from '../api';
+
+export function getRecentlyVisited() {
+  return api.get('/history/recently', { withCredentials: true });
+}
@@ -3,3 +3,13 @@ import api from '../api';
 export function getIsInit() {
   return api.get('/user/check');
 }
+
+// 没有任何用户时创建第一个管理员
+export function initAdmin(data) {
+  return api.post('/user/check', data);
+}
+
+// 新窗口打开会话前换取一次性登录码
+export function getLoginCode() {
+  return api.post('/login/code');
+}
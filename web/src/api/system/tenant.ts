@@ -0,0 +1,55 @@
+import { http } from '@/utils/http/axios';
+
+/**
+ * @description: 租户列表，全局管理员看到全部租户
+ */
+export function getTenantList() {
+  return http.request({
+    url: '/tenant/list',
+    method: 'GET',
+  });
+}
+
+/**
+ * @description: 租户配额和用量，不传 id 时为当前用户的租户
+ */
+export function getTenantUsage(id?: number) {
+  return http.request({
+    url: '/tenant/usage',
+    method: 'GET',
+    params: id ? { id } : undefined,
+  });
+}
+
+/**
+ * @description: 新建或更新租户
+ */
+export function saveTenant(data) {
+  return http.request({
+    url: '/tenant/save',
+    method: 'POST',
+    data,
+  });
+}
+
+/**
+ * @description: 删除没有用户和脚本的租户
+ */
+export function deleteTenant(id: number) {
+  return http.request({
+    url: '/tenant/delete',
+    method: 'POST',
+    params: { id },
+  });
+}
+
+/**
+ * @description: 把用户分配到租户
+ */
+export function assignTenant(data: { userId: number; tenantId: number; tenantAdmin: boolean }) {
+  return http.request({
+    url: '/tenant/assign',
+    method: 'POST',
+    data,
+  });
+}
@@ -25,12 +25,75 @@ export function getUserInfo() {
 /**
  * @description: 用户登录
  */
-export function login(params) {
+export function login(data) {
   return http.request<BasicResponseModel>(
     {
       url: '/login',
       method: 'POST',
-      params,
+      data,
+    },
+    {
+      isTransformResponse: false,
+    }
+  );
+}
+
+/**
+ * @description: 两步验证，提交密码登录返回的 challenge 和验证码
+ */
+export function loginTOTP(data) {
+  return http.request<BasicResponseModel>(
+    {
+      url: '/login/totp',
+      method: 'POST',
+      data,
+    },
+    {
+      isTransformResponse: false,
+    }
+  );
+}
+
+/**
+ * @description: 两步验证状态
+ */
+export function getTOTPStatus() {
+  return http.request({
+    url: '/user/totp',
+    method: 'GET',
+  });
+}
+
+/**
+ * @description: 生成两步验证密钥，返回 otpauth 地址
+ */
+export function setupTOTP() {
+  return http.request({
+    url: '/user/totp/setup',
+    method: 'POST',
+  });
+}
+
+/**
+ * @description: 用第一个验证码启用两步验证，返回恢复码
+ */
+export function enableTOTP(code: string) {
+  return http.request({
+    url: '/user/totp/enable',
+    method: 'POST',
+    data: { code },
+  });
+}
+
+/**
+ * @description: 单点登录回调后用一次性 ticket 换取令牌
+ */
+export function oidcExchange(ticket: string) {
+  return http.request<BasicResponseModel>(
+    {
+      url: '/oidc/exchange',
+      method: 'POST',
+      data: { ticket },
     },
     {
       isTransformResponse: false,
@@ -41,12 +104,12 @@ export function login(params) {
 /**
  * @description: 用户修改密码
  */
-export function changePassword(params, uid) {
+export function changePassword(data, uid) {
   return http.request(
     {
       url: `/user/u${uid}/changepw`,
       method: 'POST',
-      params,
+      data,
     },
     {
       isTransformResponse: false,
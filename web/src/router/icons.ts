@@ -1,7 +1,13 @@
 import { renderIcon } from '@/utils/index';
-import { DashboardOutlined } from '@vicons/antd';
+import { AppstoreOutlined, AuditOutlined, DashboardOutlined } from '@vicons/antd';
+import { Carbon3DCurveAutoColon, ContainerRegistry, RecentlyViewed } from '@vicons/carbon';
 
 //前端路由图标映射表
 export const constantRouterIcon = {
   DashboardOutlined: renderIcon(DashboardOutlined),
+  AppstoreOutlined: renderIcon(AppstoreOutlined),
+  AuditOutlined: renderIcon(AuditOutlined),
+  Carbon3DCurveAutoColon: renderIcon(Carbon3DCurveAutoColon),
+  ContainerRegistry: renderIcon(ContainerRegistry),
+  RecentlyViewed: renderIcon(RecentlyViewed),
 };
@@ -12,6 +12,7 @@ const routes: Array<RouteRecordRaw> = [
       title: '审计服务',
       icon: renderIcon(AuditOutlined),
       sort: 6,
+      permissions: ['audit:view'],
       is_root: true
     },
     children: [{
@@ -12,6 +12,7 @@ const routes: Array<RouteRecordRaw> = [
       title: '自动配置',
       icon: renderIcon(Carbon3DCurveAutoColon),
       sort: 4,
+      permissions: ['automation:view'],
       is_root: true,
     },
     children: [
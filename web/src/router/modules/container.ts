@@ -12,6 +12,7 @@ const routes: Array<RouteRecordRaw> = [
       title: '容器管理',
       icon: renderIcon(ContainerRegistry),
       sort: 1,
+      permissions: ['container:view'],
       is_root: true
     },
     children: [{
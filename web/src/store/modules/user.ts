@@ -3,7 +3,13 @@ import { store } from '@/store';
 import { ACCESS_TOKEN, CURRENT_USER, IS_SCREENLOCKED } from '@/store/mutation-types';
 import { ResultEnum } from '@/enums/httpEnum';
 
-import { getUserInfo as getUserInfoApi, login } from '@/api/system/user';
+import {
+  getUserInfo as getUserInfoApi,
+  login,
+  loginTOTP,
+  logout as logoutApi,
+  oidcExchange,
+} from '@/api/system/user';
 import { storage } from '@/utils/Storage';
 
 export type UserInfoType = {
@@ -63,10 +69,23 @@ export const useUserStore = defineStore({
     },
     // 登录
     async login(params: any) {
-      const response = await login(params);
+      return this.saveLogin(await login(params));
+    },
+
+    // 两步验证
+    async loginWithTOTP(params: { challenge: string; code: string }) {
+      return this.saveLogin(await loginTOTP(params));
+    },
+
+    // 单点登录
+    async loginWithTicket(ticket: string) {
+      return this.saveLogin(await oidcExchange(ticket));
+    },
+
+    saveLogin(response) {
       const { result, code } = response;
       if (code === ResultEnum.SUCCESS) {
-        const ex = 7 * 24 * 60 * 60;
+        const ex = Math.max(Math.floor((new Date(result.expiresAt).getTime() - Date.now()) / 1000), 0);
         storage.set(ACCESS_TOKEN, result.token, ex);
         storage.set(CURRENT_USER, result, ex);
         storage.set(IS_SCREENLOCKED, false);
@@ -92,6 +111,7 @@ export const useUserStore = defineStore({
 
     // 登出
     async logout() {
+      await logoutApi({}).catch(() => {});
       this.setPermissions([]);
       this.setUserInfo({ name: '', email: '' });
       storage.remove(ACCESS_TOKEN);